@@ -261,7 +261,8 @@ class VpnService : BaseVpnService(),
             DataStore.enableFakeDns,
             DataStore.enableLog,
             data.proxy!!.config.dumpUid,
-            DataStore.trafficStatistics
+            DataStore.trafficStatistics,
+            null
         )
     }
 
@@ -0,0 +1,38 @@
+package libcore
+
+// AppListener is notified the first time each uid opens a connection
+// through the tun, once per tun instance.
+type AppListener interface {
+	OnAppFirstSeen(uid int32, info *UidInfo)
+}
+
+// SetAppListener sets the listener for newly seen apps, nil disables it.
+func (t *Tun2socks) SetAppListener(listener AppListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.appListener = listener
+}
+
+func (t *Tun2socks) markAppSeen(uid uint16) {
+	t.access.Lock()
+	listener := t.appListener
+	if listener == nil {
+		t.access.Unlock()
+		return
+	}
+	if _, seen := t.seenApps[uid]; seen {
+		t.access.Unlock()
+		return
+	}
+	if t.seenApps == nil {
+		t.seenApps = map[uint16]struct{}{}
+	}
+	t.seenApps[uid] = struct{}{}
+	t.access.Unlock()
+
+	go func() {
+		info, _ := loadUidDumper().GetUidInfo(int32(uid))
+		listener.OnAppFirstSeen(int32(uid), info)
+	}()
+}
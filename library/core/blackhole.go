@@ -0,0 +1,49 @@
+package libcore
+
+import (
+	"context"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/blackhole"
+	"sync/atomic"
+)
+
+// SetDetectBlockedOutbound sets whether connections the core routes to a
+// blackhole outbound are blocked by the tun instead of being relayed, so
+// they are handled with the block action, skip the traffic stats and are
+// reported with the "blocked" close reason. An HTTP response configured on
+// the blackhole is not sent then.
+//
+// The route is picked ahead of the core, which is only possible when it
+// does not depend on the sniffed domain, so this has no effect with
+// sniffing enabled.
+func (t *Tun2socks) SetDetectBlockedOutbound(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&t.detectBlocked, value)
+}
+
+// blockedOutbound returns the tag of the blackhole outbound the core would
+// route dest to, or false if it is not routed to one.
+func (t *Tun2socks) blockedOutbound(ctx context.Context, dest v2rayNet.Destination) (string, bool) {
+	if atomic.LoadInt32(&t.detectBlocked) == 0 || t.sniffing {
+		return "", false
+	}
+
+	handler := t.pickOutbound(ctx, dest)
+	if handler == nil {
+		return "", false
+	}
+
+	getter, ok := handler.(proxy.GetOutbound)
+	if !ok {
+		return "", false
+	}
+	if _, ok := getter.GetOutbound().(*blackhole.Handler); !ok {
+		return "", false
+	}
+	atomic.AddUint32(&t.blockedOutbounds, 1)
+	return handler.Tag(), true
+}
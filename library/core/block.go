@@ -0,0 +1,61 @@
+package libcore
+
+import (
+	"github.com/xjasonlyu/tun2socks/core"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BlockActionReject = iota
+	BlockActionDrop
+)
+
+// blockDropTimeout is how long a dropped connection is held before it is
+// released, long enough for most clients to give up on their own.
+const blockDropTimeout = 30 * time.Second
+
+// SetBlockAction sets how blocked TCP connections are handled. The stack
+// completes the handshake before a connection is handed over, so a reject
+// resets it right away for a fast failure, while a drop keeps it open
+// without reading so the app sees a timeout.
+func (t *Tun2socks) SetBlockAction(action int32) {
+	atomic.StoreInt32(&t.blockAction, action)
+}
+
+func (t *Tun2socks) blockTCP(conn core.TCPConn) {
+	t.blockTCPWith(conn, atomic.LoadInt32(&t.blockAction))
+}
+
+func (t *Tun2socks) blockTCPWith(conn core.TCPConn, action int32) {
+	if action == BlockActionDrop {
+		time.AfterFunc(blockDropTimeout, func() {
+			_ = conn.Close()
+		})
+		return
+	}
+	_ = abortTCP(t.stack.Stack, conn)
+}
+
+// abortTCP closes conn with a RST rather than a FIN, so the app sees a
+// refusal instead of a clean end of stream. The stack closes an endpoint
+// with a zero linger timeout that way. The endpoint is looked up in s by
+// the id of conn, a conn s does not know is closed normally.
+func abortTCP(s *stack.Stack, conn core.TCPConn) error {
+	id := conn.ID()
+	network := ipv4.ProtocolNumber
+	if len(id.LocalAddress) == net.IPv6len {
+		network = ipv6.ProtocolNumber
+	}
+	// accepted endpoints are not bound to a NIC
+	if endpoint, ok := s.FindTransportEndpoint(network, tcp.ProtocolNumber, *id, 0).(tcpip.Endpoint); ok {
+		endpoint.SocketOptions().SetLinger(tcpip.LingerOption{Enabled: true})
+	}
+	return conn.Close()
+}
@@ -0,0 +1,87 @@
+package libcore
+
+import (
+	"errors"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/loopback"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The app of an aborted connection sees it reset rather than closed.
+func TestAbortTCPResetsPeer(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	defer s.Close()
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatal(err)
+	}
+	address := tcpip.Address(net.IPv4(10, 0, 0, 1).To4())
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, address); err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+
+	// accept connections the way the tun's stack hands them over, and abort
+	// them once the app saw them established
+	dialed := make(chan struct{})
+	aborted := make(chan error, 1)
+	forwarder := tcp.NewForwarder(s, 0, 16, func(r *tcp.ForwarderRequest) {
+		var wq waiter.Queue
+		id := r.ID()
+		endpoint, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			r.Complete(true)
+			aborted <- errors.New(err.String())
+			return
+		}
+		r.Complete(false)
+		<-dialed
+		aborted <- abortTCP(s, &testTCPConn{gonet.NewTCPConn(&wq, endpoint), &id})
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+
+	app, err := gonet.DialTCP(s, tcpip.FullAddress{NIC: 1, Addr: address, Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	close(dialed)
+	if err := <-aborted; err != nil {
+		t.Fatal(err)
+	}
+
+	_ = app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = app.Read(make([]byte, 1))
+	if err == nil || !strings.Contains(err.Error(), (&tcpip.ErrConnectionReset{}).String()) {
+		t.Fatalf("read error %v, want a reset", err)
+	}
+}
+
+func TestAbortTCPOtherConn(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	defer s.Close()
+
+	left, right := net.Pipe()
+	defer right.Close()
+
+	if err := abortTCP(s, newTestTCPConn(left, "10.0.0.2:40000", "198.51.100.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := left.Write([]byte{0}); err == nil {
+		t.Fatal("pipe still open after abort")
+	}
+}
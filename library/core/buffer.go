@@ -0,0 +1,85 @@
+package libcore
+
+import (
+	"github.com/xjasonlyu/tun2socks/common/pool"
+	"io"
+)
+
+const maxRelayBufferSize = 65536
+
+// SetRelayBufferWatermarks sizes the buffers TCP relays copy through. A
+// relay starts with low bytes, doubles its buffer up to high while reads
+// fill it and drops back to low after any read that does not, so
+// connections that are open but idle only hold a small buffer. Zero low
+// restores the fixed buffers of io.Copy.
+func (t *Tun2socks) SetRelayBufferWatermarks(low int32, high int32) {
+	if low > maxRelayBufferSize {
+		low = maxRelayBufferSize
+	}
+	if high < low {
+		high = low
+	}
+	if high > maxRelayBufferSize {
+		high = maxRelayBufferSize
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.bufferLow = int(low)
+	t.bufferHigh = int(high)
+}
+
+func (t *Tun2socks) relayCopy(dst io.Writer, src io.Reader) (int64, error) {
+	t.access.Lock()
+	low, high := t.bufferLow, t.bufferHigh
+	t.access.Unlock()
+
+	if low <= 0 {
+		return io.Copy(dst, src)
+	}
+	return watermarkCopy(dst, src, low, high)
+}
+
+func watermarkCopy(dst io.Writer, src io.Reader, low int, high int) (written int64, err error) {
+	size := low
+	buf := pool.Get(size)
+	defer func() {
+		_ = pool.Put(buf)
+	}()
+
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			var w int
+			w, err = dst.Write(buf[:n])
+			written += int64(w)
+			if err != nil {
+				return
+			}
+			if w != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			return
+		}
+
+		next := size
+		if n == size && size < high {
+			next = size * 2
+			if next > high {
+				next = high
+			}
+		} else if n < size {
+			next = low
+		}
+		if next != size {
+			_ = pool.Put(buf)
+			buf = pool.Get(next)
+			size = next
+		}
+	}
+}
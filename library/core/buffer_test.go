@@ -0,0 +1,57 @@
+package libcore
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// scriptedReader returns reads of the given sizes and records the size of
+// the buffer each was made with.
+type scriptedReader struct {
+	reads   []int
+	buffers []int
+}
+
+func (r *scriptedReader) Read(b []byte) (int, error) {
+	if len(r.reads) == 0 {
+		return 0, io.EOF
+	}
+	r.buffers = append(r.buffers, len(b))
+	n := r.reads[0]
+	if n > len(b) {
+		n = len(b)
+	}
+	r.reads = r.reads[1:]
+	return n, nil
+}
+
+func TestWatermarkCopyBufferSizes(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		reads   []int
+		buffers []int
+	}{
+		{"grows while full", []int{512, 1024, 2048, 4096}, []int{512, 1024, 2048, 4096}},
+		{"stops at high", []int{512, 1024, 2048, 4096, 4096}, []int{512, 1024, 2048, 4096, 4096}},
+		{"shrinks after a partial read", []int{512, 1024, 1500, 100}, []int{512, 1024, 2048, 512}},
+		{"shrinks above low", []int{512, 1024, 2047, 2048}, []int{512, 1024, 2048, 512}},
+		{"stays at low", []int{100, 100}, []int{512, 512}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader := &scriptedReader{reads: test.reads}
+			var out bytes.Buffer
+			written, err := watermarkCopy(&out, reader, 512, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != int64(out.Len()) {
+				t.Errorf("written = %d, copied %d", written, out.Len())
+			}
+			if !reflect.DeepEqual(reader.buffers, test.buffers) {
+				t.Errorf("buffers = %v, want %v", reader.buffers, test.buffers)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	captureQueueSize = 256
+	captureSnapLen   = 65535
+
+	// linkTypeRaw marks records starting directly with an IPv4 or IPv6
+	// header, which is what the tun device carries.
+	linkTypeRaw = 101
+)
+
+// CaptureWriter receives the capture in the pcap file format.
+type CaptureWriter interface {
+	Write(p []byte) (n int, err error)
+}
+
+// packetCapture copies packets to the writer on its own goroutine, so the
+// device is never blocked by a slow writer and drops packets instead.
+type packetCapture struct {
+	writer   CaptureWriter
+	uid      uint16
+	maxBytes int64
+	deadline time.Time
+	queue    chan []byte
+	done     chan struct{}
+	once     sync.Once
+	written  int64
+}
+
+// StartCapture records the packets passing through the tun to writer in
+// pcap format, until StopCapture is called or maxBytes bytes or duration
+// seconds are reached, zero means no cap. A non-zero uid only records
+// packets of the relays owned by that uid, the handshake packets sent
+// before a relay is set up are missed in that case.
+func (t *Tun2socks) StartCapture(writer CaptureWriter, uid int32, maxBytes int64, duration int32) error {
+	if writer == nil {
+		return errors.New("nil writer")
+	}
+	if uid > 0 && uid < 10000 {
+		uid = 1000
+	}
+
+	c := &packetCapture{
+		writer:   writer,
+		uid:      uint16(uid),
+		maxBytes: maxBytes,
+		queue:    make(chan []byte, captureQueueSize),
+		done:     make(chan struct{}),
+	}
+	if duration > 0 {
+		c.deadline = time.Now().Add(time.Duration(duration) * time.Second)
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], captureSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+
+	t.access.Lock()
+	old, _ := t.capture.Load().(*packetCapture)
+	t.capture.Store(c)
+	t.access.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+	go c.loop()
+	return nil
+}
+
+func (t *Tun2socks) StopCapture() {
+	t.access.Lock()
+	c, _ := t.capture.Load().(*packetCapture)
+	t.capture.Store((*packetCapture)(nil))
+	t.access.Unlock()
+
+	if c != nil {
+		c.stop()
+	}
+}
+
+func (c *packetCapture) stop() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *packetCapture) loop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case record := <-c.queue:
+			if c.maxBytes > 0 && c.written+int64(len(record)) > c.maxBytes {
+				c.stop()
+				return
+			}
+			if _, err := c.writer.Write(record); err != nil {
+				c.stop()
+				return
+			}
+			c.written += int64(len(record))
+		}
+	}
+}
+
+func (t *Tun2socks) capturePacket(packet []byte) {
+	c, _ := t.capture.Load().(*packetCapture)
+	if c == nil || len(packet) == 0 {
+		return
+	}
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	now := time.Now()
+	if !c.deadline.IsZero() && now.After(c.deadline) {
+		c.stop()
+		return
+	}
+	if c.uid > 0 && !t.conns.hasUidPacket(c.uid, packet) {
+		return
+	}
+
+	length := len(packet)
+	if length > captureSnapLen {
+		length = captureSnapLen
+	}
+	record := make([]byte, 16+length)
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(length))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	copy(record[16:], packet[:length])
+
+	select {
+	case c.queue <- record:
+	default:
+	}
+}
+
+// packetEndpoints returns the network of a TCP or UDP packet and its source
+// and destination as host:port strings, in the format used by the relays.
+func packetEndpoints(packet []byte) (network string, source string, destination string, ok bool) {
+	var src, dst net.IP
+	var proto byte
+	var payload []byte
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < ihl+4 {
+			return
+		}
+		proto = packet[9]
+		src, dst = packet[12:16], packet[16:20]
+		payload = packet[ihl:]
+	case 6:
+		if len(packet) < 44 {
+			return
+		}
+		proto = packet[6]
+		src, dst = packet[8:24], packet[24:40]
+		payload = packet[40:]
+	default:
+		return
+	}
+	switch proto {
+	case 6:
+		network = "tcp"
+	case 17:
+		network = "udp"
+	default:
+		return
+	}
+
+	srcPort := strconv.Itoa(int(binary.BigEndian.Uint16(payload)))
+	dstPort := strconv.Itoa(int(binary.BigEndian.Uint16(payload[2:])))
+	return network, net.JoinHostPort(src.String(), srcPort), net.JoinHostPort(dst.String(), dstPort), true
+}
+
+// captureDevice taps the packets read from and written to the tun.
+type captureDevice struct {
+	io.ReadWriter
+	t *Tun2socks
+}
+
+func (d *captureDevice) Read(p []byte) (n int, err error) {
+	for {
+		n, err = d.ReadWriter.Read(p)
+		if n <= 0 {
+			return
+		}
+		if reply := d.t.pathMtuReply(p[:n]); reply != nil {
+			_, _ = d.Write(reply)
+			continue
+		}
+		d.t.capturePacket(p[:n])
+		d.t.inspectTos(p[:n])
+		d.t.inspectTtl(p[:n])
+		return
+	}
+}
+
+func (d *captureDevice) Write(p []byte) (n int, err error) {
+	d.t.capturePacket(p)
+	n, err = d.ReadWriter.Write(p)
+	if err != nil {
+		d.t.onDeviceWriteFailed(len(p), err)
+	} else {
+		d.t.onDeviceWritten(len(p))
+	}
+	return
+}
@@ -0,0 +1,163 @@
+package libcore
+
+import (
+	"encoding/json"
+	"golang.org/x/time/rate"
+	"sync/atomic"
+)
+
+type tunConfig struct {
+	Router       string `json:"router"`
+	HijackDns    bool   `json:"hijack_dns"`
+	Sniffing     bool   `json:"sniffing"`
+	FakeDns      bool   `json:"fakedns"`
+	Debug        bool   `json:"debug"`
+	DumpUid      bool   `json:"dump_uid"`
+	TrafficStats bool   `json:"traffic_stats"`
+	Mtu          int32  `json:"mtu"`
+
+	IdleTimeout       int32 `json:"idle_timeout"`
+	MaxConnLifetime   int32 `json:"max_conn_lifetime"`
+	UdpSetupTimeout   int64 `json:"udp_setup_timeout"`
+	UdpLinger         int32 `json:"udp_linger"`
+	DnsSessionTimeout int32 `json:"dns_session_timeout"`
+	UdpSessionTimeout int32 `json:"udp_session_timeout"`
+	UdpStickiness     int32 `json:"udp_stickiness"`
+
+	DnsCache           bool  `json:"dns_cache"`
+	DnsLog             bool  `json:"dns_log"`
+	DnsWorkers         bool  `json:"dns_workers"`
+	DnsRateLimit       int   `json:"dns_rate_limit"`
+	DnsUidRateLimit    int   `json:"dns_uid_rate_limit"`
+	DnsMinTTL          int32 `json:"dns_min_ttl"`
+	DnsMaxTTL          int32 `json:"dns_max_ttl"`
+	DnsMaxUdpSize      int32 `json:"dns_max_udp_size"`
+	DnsMaxInflight     int   `json:"dns_max_inflight"`
+	DnsRoutes          int   `json:"dns_routes"`
+	DnsMalformedAction int32 `json:"dns_malformed_action"`
+	UplinkRateLimit    int64 `json:"uplink_rate_limit"`
+	DownlinkRateLimit  int64 `json:"downlink_rate_limit"`
+	UidConnLimits      int   `json:"uid_conn_limits"`
+	UidTags            int   `json:"uid_tags"`
+	AppStatsLimit      int   `json:"app_stats_limit"`
+	WritebackBuffer    int32 `json:"udp_writeback_buffer"`
+	RelayBufferLow     int   `json:"relay_buffer_low"`
+	RelayBufferHigh    int   `json:"relay_buffer_high"`
+	IcmpEchoReply      bool  `json:"icmp_echo_reply"`
+	PreserveTos        bool  `json:"preserve_tos"`
+	PreserveTtl        bool  `json:"preserve_ttl"`
+	DisableIPv6        bool  `json:"disable_ipv6"`
+	IPv6BlockAction    int32 `json:"ipv6_block_action"`
+	BlockAction        int32 `json:"block_action"`
+	LanPolicy          int32 `json:"lan_policy"`
+	BypassDestinations int   `json:"bypass_destinations"`
+	BypassPolicy       int32 `json:"bypass_policy"`
+	DomainFamily       int32 `json:"domain_address_family"`
+	MetricsPackage     bool  `json:"metrics_package_label"`
+	DetectBlocked      bool  `json:"detect_blocked_outbound"`
+	SniffingMode       int32 `json:"sniffing_mode"`
+	RouterTraffic      int32 `json:"router_traffic"`
+
+	InboundUser string `json:"inbound_user,omitempty"`
+	FallbackTag string `json:"fallback_tag,omitempty"`
+	DnsMirror   string `json:"dns_mirror,omitempty"`
+	DnsTls      string `json:"dns_tls,omitempty"`
+}
+
+// GetConfig returns the settings currently in effect as a JSON object, rate
+// limits are in bytes per second and zero means unlimited or disabled. DNS
+// upstreams are part of the V2Ray config and not included.
+func (t *Tun2socks) GetConfig() []byte {
+	config := tunConfig{
+		Router:       t.router,
+		HijackDns:    t.hijackDns,
+		Sniffing:     t.sniffing,
+		FakeDns:      t.fakedns,
+		Debug:        t.debug,
+		DumpUid:      t.dumpUid,
+		TrafficStats: t.trafficStats,
+		Mtu:          atomic.LoadInt32(&tunMtu),
+
+		IdleTimeout:     atomic.LoadInt32(&t.idleTimeout),
+		MaxConnLifetime: atomic.LoadInt32(&t.maxLifetime),
+		UdpSetupTimeout: t.getUdpSetupTimeout().Milliseconds(),
+		UdpLinger:       atomic.LoadInt32(&t.udpLinger),
+
+		DnsSessionTimeout: atomic.LoadInt32(&t.dnsSessionTimeout),
+		UdpSessionTimeout: atomic.LoadInt32(&t.udpSessionTimeout),
+		UdpStickiness:     atomic.LoadInt32(&t.stickyWindow),
+
+		DnsMinTTL:         atomic.LoadInt32(&t.dnsMinTTL),
+		DnsMaxTTL:         atomic.LoadInt32(&t.dnsMaxTTL),
+		DnsMaxUdpSize:     atomic.LoadInt32(&t.dnsMaxUdpSize),
+		UplinkRateLimit:   rateLimit(t.uplinkLimiter),
+		DownlinkRateLimit: rateLimit(t.downlinkLimiter),
+		WritebackBuffer:   atomic.LoadInt32(&t.writebackSize),
+		PreserveTos:       atomic.LoadInt32(&t.preserveTos) == 1,
+		DisableIPv6:       atomic.LoadInt32(&t.disableIPv6) == 1,
+		IPv6BlockAction:   atomic.LoadInt32(&t.ipv6Action),
+		BlockAction:       atomic.LoadInt32(&t.blockAction),
+		LanPolicy:         atomic.LoadInt32(&t.lanPolicy),
+		DomainFamily:      atomic.LoadInt32(&t.domainFamily),
+		DetectBlocked:     atomic.LoadInt32(&t.detectBlocked) == 1,
+		SniffingMode:      atomic.LoadInt32(&t.sniffingMode),
+		RouterTraffic:     atomic.LoadInt32(&t.routerTraffic),
+	}
+
+	config.DnsMalformedAction = atomic.LoadInt32(&t.dnsMalformedAction)
+
+	t.dnsCache.access.Lock()
+	config.DnsCache = t.dnsCache.enabled
+	t.dnsCache.access.Unlock()
+
+	t.dnsLog.access.Lock()
+	config.DnsLog = t.dnsLog.enabled
+	t.dnsLog.access.Unlock()
+
+	t.dnsLimit.access.Lock()
+	config.DnsRateLimit = t.dnsLimit.global
+	config.DnsUidRateLimit = t.dnsLimit.perUid
+	t.dnsLimit.access.Unlock()
+
+	t.access.Lock()
+	config.DnsWorkers = t.dnsPool != nil
+	config.UidConnLimits = len(t.connLimits)
+	config.UidTags = len(t.uidTags)
+	config.AppStatsLimit = t.appStatsLimit
+	config.BypassDestinations = len(t.bypassNetworks)
+	config.BypassPolicy = t.bypassPolicy
+	config.RelayBufferLow = t.bufferLow
+	config.RelayBufferHigh = t.bufferHigh
+	config.IcmpEchoReply = t.stack.ICMPLimit() > 0
+	config.MetricsPackage = t.metricsPackage
+	if t.inboundUser != nil {
+		config.InboundUser = t.inboundUser.Email
+	}
+	config.FallbackTag = t.fallbackTag
+	t.access.Unlock()
+
+	if slots, _ := t.dnsInflight.Load().(chan struct{}); slots != nil {
+		config.DnsMaxInflight = cap(slots)
+	}
+
+	routes, _ := t.dnsRoutes.Load().([]*dnsRoute)
+	config.DnsRoutes = len(routes)
+
+	if mirror, _ := t.dnsMirror.Load().(*dnsMirror); mirror != nil {
+		config.DnsMirror = mirror.server.NetAddr()
+	}
+
+	if resolver, _ := t.dnsTls.Load().(*dnsTlsResolver); resolver != nil {
+		config.DnsTls = resolver.server.NetAddr()
+	}
+
+	content, _ := json.Marshal(config)
+	return content
+}
+
+func rateLimit(limiter *rateLimiter) int64 {
+	if limiter.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(limiter.Limit())
+}
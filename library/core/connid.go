@@ -0,0 +1,32 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"github.com/xtls/xray-core/common/session"
+	"sync/atomic"
+)
+
+// SetConnectionIdLogging prefixes the log lines of each relay with its
+// connection id, as in "[TCP #42]", the Id reported in Connection. The id
+// is always passed to the core as the session id, which its own logs show
+// as "[42]", truncated to 32 bits.
+func (t *Tun2socks) SetConnectionIdLogging(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&t.connIdLogging, value)
+}
+
+// logTag returns the prefix for the log lines of entry.
+func (t *Tun2socks) logTag(network string, entry *connEntry) string {
+	if atomic.LoadInt32(&t.connIdLogging) == 0 {
+		return network
+	}
+	return fmt.Sprintf("%s #%d", network, entry.id)
+}
+
+func withConnectionId(ctx context.Context, entry *connEntry) context.Context {
+	return session.ContextWithID(ctx, session.ID(entry.id))
+}
@@ -0,0 +1,299 @@
+package libcore
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type Connection struct {
+	Id          int64
+	Uid         int32
+	Network     string
+	Source      string
+	Destination string
+
+	// SniffedDestination is the domain the connection was routed to after
+	// sniffing or fakedns, empty if the destination was not rewritten.
+	SniffedDestination string
+
+	// Outbound is the tag of the outbound the core relays the connection
+	// through, known once it first responded. It is only reported for TCP
+	// connections through the core.
+	Outbound string
+
+	// TlsServerName, TlsAlpn and TlsVersion come from the ClientHello of
+	// TLS connections, see TlsHello.
+	TlsServerName string
+	TlsAlpn       string
+	TlsVersion    string
+
+	// ReadErrors, WriteErrors and Resets count the failures of the remote
+	// side of the relay, LocalErrors those of the app side, so a lossy
+	// proxy can be told apart from a local problem.
+	ReadErrors  int32
+	WriteErrors int32
+	Resets      int32
+	LocalErrors int32
+
+	StartedAt    int64
+	LastActiveAt int64
+
+	// Latency is the time in milliseconds until the destination first
+	// responded, zero if it has not yet.
+	Latency int64
+
+	// CloseReason is only set for connections passed to OnConnClosed.
+	CloseReason string
+}
+
+type ConnectionListener interface {
+	UpdateConnection(c *Connection)
+}
+
+type ConnectionCloseListener interface {
+	OnConnClosed(c *Connection)
+}
+
+const (
+	CloseReasonClientClosed = "client closed"
+	CloseReasonRemoteClosed = "remote closed"
+	CloseReasonDialFailed   = "dial failed"
+	CloseReasonTimeout      = "timeout"
+	CloseReasonReset        = "reset"
+	CloseReasonBlocked      = "blocked"
+	CloseReasonLifetime     = "lifetime"
+)
+
+type connEntry struct {
+	// lastActive, latency and the byte counts are accessed atomically and
+	// must stay 64-bit aligned.
+	lastActive int64
+	latency    int64
+
+	// uplink and downlink are only counted for UDP sessions.
+	uplink   int64
+	downlink int64
+
+	readErrors  uint32
+	writeErrors uint32
+	resets      uint32
+	localErrors uint32
+
+	id          int64
+	uid         uint16
+	network     string
+	source      string
+	destination string
+	sniffed     atomic.Value
+	outbound    atomic.Value
+	rateLimit   atomic.Value
+	tlsHello    atomic.Value
+	startedAt   time.Time
+
+	closeOnce   sync.Once
+	closeReason string
+	closer      atomic.Value
+}
+
+// Update marks the relay as active, it is called by activityConn for every
+// byte transfer.
+func (e *connEntry) Update() {
+	atomic.StoreInt64(&e.lastActive, time.Now().UnixNano())
+}
+
+func (e *connEntry) lastActiveAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&e.lastActive))
+}
+
+// setCloser sets the function tearing down the relay once it is running.
+func (e *connEntry) setCloser(closer func()) {
+	e.closer.Store(closer)
+}
+
+func (e *connEntry) setSniffed(destination string) {
+	e.sniffed.Store(destination)
+}
+
+// setCloseReason records why the connection ended, the first reason wins.
+func (e *connEntry) setCloseReason(reason string) {
+	e.closeOnce.Do(func() {
+		e.closeReason = reason
+	})
+}
+
+func (e *connEntry) export() *Connection {
+	export := &Connection{
+		Id:          e.id,
+		Uid:         int32(e.uid),
+		Network:     e.network,
+		Source:      e.source,
+		Destination: e.destination,
+		StartedAt:   e.startedAt.Unix(),
+
+		LastActiveAt: e.lastActiveAt().Unix(),
+		Latency:      time.Duration(atomic.LoadInt64(&e.latency)).Milliseconds(),
+
+		ReadErrors:  int32(atomic.LoadUint32(&e.readErrors)),
+		WriteErrors: int32(atomic.LoadUint32(&e.writeErrors)),
+		Resets:      int32(atomic.LoadUint32(&e.resets)),
+		LocalErrors: int32(atomic.LoadUint32(&e.localErrors)),
+	}
+	if sniffed, ok := e.sniffed.Load().(string); ok {
+		export.SniffedDestination = sniffed
+	}
+	if outbound, ok := e.outbound.Load().(string); ok {
+		export.Outbound = outbound
+	}
+	if hello, ok := e.tlsHello.Load().(*TlsHello); ok {
+		export.TlsServerName = hello.ServerName
+		export.TlsAlpn = hello.Alpn
+		export.TlsVersion = hello.Version
+	}
+	return export
+}
+
+// connRegistry keeps the relays currently running through the tun.
+type connRegistry struct {
+	access  sync.Mutex
+	nextId  int64
+	conns   map[int64]*connEntry
+	sources map[string]*connEntry
+}
+
+func (r *connRegistry) add(entry *connEntry) *connEntry {
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	if r.conns == nil {
+		r.conns = map[int64]*connEntry{}
+		r.sources = map[string]*connEntry{}
+	}
+	r.nextId++
+	entry.id = r.nextId
+	entry.startedAt = time.Now()
+	entry.lastActive = entry.startedAt.UnixNano()
+	r.conns[entry.id] = entry
+	r.sources[entry.network+":"+entry.source] = entry
+	return entry
+}
+
+func (r *connRegistry) remove(entry *connEntry) {
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	delete(r.conns, entry.id)
+	key := entry.network + ":" + entry.source
+	if r.sources[key] == entry {
+		delete(r.sources, key)
+	}
+}
+
+// hasUidPacket tells whether packet belongs to a relay owned by uid, in
+// either direction.
+func (r *connRegistry) hasUidPacket(uid uint16, packet []byte) bool {
+	network, src, dst, ok := packetEndpoints(packet)
+	if !ok {
+		return false
+	}
+
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	for _, addr := range []string{src, dst} {
+		if entry := r.sources[network+":"+addr]; entry != nil && entry.uid == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *connRegistry) list() []*connEntry {
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	entries := make([]*connEntry, 0, len(r.conns))
+	for _, entry := range r.conns {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// ListConnections reports every active relay to listener, including the
+// original destination and the sniffed one it was rewritten to, if any.
+func (t *Tun2socks) ListConnections(listener ConnectionListener) error {
+	for _, entry := range t.conns.list() {
+		listener.UpdateConnection(entry.export())
+	}
+	return nil
+}
+
+// CloseIdleConnections closes every relay without a byte transferred in
+// either direction for the last idleFor seconds and returns their count.
+func (t *Tun2socks) CloseIdleConnections(idleFor int32) int32 {
+	threshold := time.Now().Add(-time.Duration(idleFor) * time.Second)
+	var closed int32
+	for _, entry := range t.conns.list() {
+		if entry.lastActiveAt().After(threshold) {
+			continue
+		}
+		if entry.closeIdle() {
+			closed++
+		}
+	}
+	return closed
+}
+
+// closeIdle tears down the running relay of entry as timed out, returns
+// false if it is not running yet.
+func (e *connEntry) closeIdle() bool {
+	closer, ok := e.closer.Load().(func())
+	if !ok {
+		return false
+	}
+	e.setCloseReason(CloseReasonTimeout)
+	closer()
+	return true
+}
+
+// SetConnectionCloseListener reports every relay that ended along with the
+// reason, a nil listener stops the reports.
+func (t *Tun2socks) SetConnectionCloseListener(listener ConnectionCloseListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.closeListener = listener
+}
+
+func (t *Tun2socks) closeConn(entry *connEntry) {
+	t.conns.remove(entry)
+	t.tosMarks.forget(entry.network + ":" + entry.source)
+	t.ttlMarks.forget(entry.network + ":" + entry.source)
+
+	t.access.Lock()
+	listener := t.closeListener
+	t.access.Unlock()
+
+	if listener == nil {
+		return
+	}
+	entry.setCloseReason(CloseReasonClientClosed)
+	export := entry.export()
+	export.CloseReason = entry.closeReason
+	listener.OnConnClosed(export)
+}
+
+// copyCloseReason maps the end of a relay copy to a close reason, remote
+// tells whether the copy was reading from the core side.
+func copyCloseReason(err error, remote bool) string {
+	if err != nil && (errors.Is(err, syscall.ECONNRESET) || strings.Contains(err.Error(), "connection reset")) {
+		return CloseReasonReset
+	}
+	if remote {
+		return CloseReasonRemoteClosed
+	}
+	return CloseReasonClientClosed
+}
@@ -1,7 +1,9 @@
 package libcore
 
 import (
+	"errors"
 	"github.com/sagernet/libping"
+	"net"
 	"os"
 	"runtime"
 )
@@ -24,6 +26,63 @@ func SetIPv6Mode(mode int) {
 	ipv6Mode = mode
 }
 
+var tcpNoDelay = true
+
+// SetTCPNoDelay toggles Nagle's algorithm on both legs of relayed TCP
+// connections, takes effect for tun instances created afterwards.
+func SetTCPNoDelay(enabled bool) {
+	tcpNoDelay = enabled
+}
+
+var udpReuseAddr bool
+
+// SetUDPReuseAddr sets SO_REUSEADDR and SO_REUSEPORT on outbound UDP
+// sockets, so hole punching helpers can bind the same local port the
+// relay uses to keep the NAT mapping of the proxy server alive.
+func SetUDPReuseAddr(enabled bool) {
+	udpReuseAddr = enabled
+}
+
+var sendThrough net.IP
+
+// SetSendThrough binds outbound sockets to the local address ip, an empty
+// string restores the default. Sockets fall back to the default address
+// when ip has a different family than the destination or can't be bound.
+func SetSendThrough(ip string) error {
+	if ip == "" {
+		sendThrough = nil
+		return nil
+	}
+	address := net.ParseIP(ip)
+	if address == nil {
+		return errors.New("invalid ip address: " + ip)
+	}
+	sendThrough = address
+	return nil
+}
+
+var mssClamp = -1
+
+var tunMtu int32
+
+// SetMSSClamp clamps the MSS of outbound TCP sockets to mss, zero derives
+// it from the tun or path MTU and a negative value disables clamping.
+func SetMSSClamp(mss int) {
+	mssClamp = mss
+}
+
+func clampedMSS() int {
+	if mssClamp != 0 {
+		return mssClamp
+	}
+	mtu := effectiveMtu()
+	if mtu <= 0 {
+		return -1
+	}
+	// leave room for the IPv6 and TCP headers
+	return int(mtu) - 60
+}
+
 func IcmpPing(address string, timeout int32) (int32, error) {
 	return libping.IcmpPing(address, timeout)
 }
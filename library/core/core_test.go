@@ -0,0 +1,195 @@
+package libcore
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// startTestCore runs a core loaded from config until the test ends.
+func startTestCore(t *testing.T, config string) *V2RayInstance {
+	t.Helper()
+	instance := NewV2rayInstance()
+	if err := instance.LoadConfig(config, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = instance.Close()
+	})
+	return instance
+}
+
+// startTestOrigin listens on loopback for the destination servers of a
+// test, accepted connections are passed on through the returned channel.
+func startTestOrigin(t *testing.T) (net.Listener, <-chan net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return listener, accepted
+}
+
+// domainRoutingConfig sends blockedDomain to a blackhole and every other
+// destination, sniffed domains included, to origin.
+func domainRoutingConfig(origin net.Addr, blockedDomain string) string {
+	return `{
+  "log": {"loglevel": "none"},
+  "outbounds": [
+    {"protocol": "freedom", "tag": "direct", "settings": {"redirect": "` + origin.String() + `"}},
+    {"protocol": "blackhole", "tag": "block"}
+  ],
+  "routing": {
+    "domainStrategy": "AsIs",
+    "rules": [
+      {"type": "field", "domain": ["full:` + blockedDomain + `"], "outboundTag": "block"}
+    ]
+  }
+}`
+}
+
+func originPort(t *testing.T, origin net.Addr) uint16 {
+	t.Helper()
+	_, port, err := net.SplitHostPort(origin.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint16(value)
+}
+
+const testUid = 10001
+
+// testUidDumper attributes every connection to testUid.
+type testUidDumper struct{}
+
+func (testUidDumper) DumpUid(bool, bool, string, int32, string, int32) (int32, error) {
+	return testUid, nil
+}
+
+func (testUidDumper) GetUidInfo(int32) (*UidInfo, error) {
+	return &UidInfo{PackageName: "test", Label: "test"}, nil
+}
+
+// testDevice is a tun no packet arrives on, the tests hand connections to
+// the tun directly.
+type testDevice struct {
+	*io.PipeReader
+}
+
+func (testDevice) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// startTestTun runs a tun with traffic stats through instance until the
+// test ends.
+func startTestTun(t *testing.T, instance *V2RayInstance) *Tun2socks {
+	t.Helper()
+	previous := loadUidDumper()
+	uidDumper.Store(uidDumperChain{{testUidDumper{}, 0}})
+	reader, writer := io.Pipe()
+	tun, err := newTun2socks(testDevice{reader}, 1500, instance, "", false, false, false, false, false, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tun.Close()
+		_ = writer.Close()
+		uidDumper.Store(previous)
+	})
+	return tun
+}
+
+// testTCPConn is an app connection accepted by the stack from src to dest.
+type testTCPConn struct {
+	net.Conn
+	id *stack.TransportEndpointID
+}
+
+func newTestTCPConn(conn net.Conn, src string, dest string) *testTCPConn {
+	return &testTCPConn{conn, testEndpointID(src, dest)}
+}
+
+func (c *testTCPConn) ID() *stack.TransportEndpointID {
+	return c.id
+}
+
+func testEndpointID(src string, dest string) *stack.TransportEndpointID {
+	address := func(addr string) (tcpip.Address, uint16) {
+		host, port, _ := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		value, _ := strconv.ParseUint(port, 10, 16)
+		return tcpip.Address(ip), uint16(value)
+	}
+	id := &stack.TransportEndpointID{}
+	id.RemoteAddress, id.RemotePort = address(src)
+	id.LocalAddress, id.LocalPort = address(dest)
+	return id
+}
+
+// testUDPPacket is a datagram from the app, recording what is written back
+// to it.
+type testUDPPacket struct {
+	data    []byte
+	src     *net.UDPAddr
+	dest    *net.UDPAddr
+	dropped int32
+	written chan []byte
+}
+
+func newTestUDPPacket(data []byte, src string, dest string) *testUDPPacket {
+	srcAddr, _ := net.ResolveUDPAddr("udp", src)
+	destAddr, _ := net.ResolveUDPAddr("udp", dest)
+	return &testUDPPacket{data: data, src: srcAddr, dest: destAddr, written: make(chan []byte, 16)}
+}
+
+func (p *testUDPPacket) Data() []byte {
+	return p.data
+}
+
+func (p *testUDPPacket) Drop() {
+	atomic.AddInt32(&p.dropped, 1)
+}
+
+func (p *testUDPPacket) ID() *stack.TransportEndpointID {
+	return testEndpointID(p.src.String(), p.dest.String())
+}
+
+func (p *testUDPPacket) LocalAddr() net.Addr {
+	return p.dest
+}
+
+func (p *testUDPPacket) RemoteAddr() net.Addr {
+	return p.src
+}
+
+func (p *testUDPPacket) WriteBack(b []byte, _ net.Addr) (int, error) {
+	p.written <- append([]byte(nil), b...)
+	return len(b), nil
+}
@@ -0,0 +1,69 @@
+package libcore
+
+import (
+	"errors"
+	"github.com/xtls/xray-core/core"
+	"sync/atomic"
+	"time"
+)
+
+const coreHoldPoll = 50 * time.Millisecond
+
+var errCoreNotRunning = errors.New("core not running")
+
+// SetCoreHoldTimeout makes new connections wait up to timeout milliseconds
+// for a running core when there is none, as while switching profiles
+// between closing the old instance and setting the new one. Connections
+// still without one at the timeout, and all of them with zero, fail with
+// "core not running" instead of dialing a stopped core. Direct connections
+// are not affected.
+func (t *Tun2socks) SetCoreHoldTimeout(timeout int32) {
+	atomic.StoreInt32(&t.coreHoldTimeout, timeout)
+}
+
+// runningCore returns the core of the instance if it is started.
+func (instance *V2RayInstance) runningCore() *core.Instance {
+	instance.access.Lock()
+	defer instance.access.Unlock()
+
+	if !instance.started {
+		return nil
+	}
+	return instance.core
+}
+
+// runningCore returns the core to dial new connections through, waiting
+// for one to be running up to the hold timeout.
+func (t *Tun2socks) runningCore() (*core.Instance, error) {
+	if err := t.injectFault(faultDial); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(time.Duration(atomic.LoadInt32(&t.coreHoldTimeout)) * time.Millisecond)
+	for {
+		t.access.Lock()
+		v2ray, swapped := t.v2ray, t.v2raySwapped
+		t.access.Unlock()
+
+		if v2ray != nil {
+			if instance := v2ray.runningCore(); instance != nil {
+				return instance, nil
+			}
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			atomic.AddUint32(&t.coreNotRunning, 1)
+			return nil, errCoreNotRunning
+		}
+		if remaining > coreHoldPoll {
+			remaining = coreHoldPoll
+		}
+		// the instance may be set before it is started, so it is polled
+		// in addition to waking up on a swap.
+		timer := time.NewTimer(remaining)
+		select {
+		case <-swapped:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
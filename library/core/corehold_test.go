@@ -0,0 +1,46 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"testing"
+	"time"
+)
+
+// Every path dialing the core must fail with errCoreNotRunning while there
+// is none, as during a profile switch, instead of dereferencing it.
+func TestDialsWithoutRunningCore(t *testing.T) {
+	stopped := NewV2rayInstance()
+	if err := stopped.LoadConfig(`{"log": {"loglevel": "none"}, "outbounds": [{"protocol": "freedom"}]}`, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, instance := range map[string]*V2RayInstance{"nil": nil, "stopped": stopped} {
+		t.Run(name, func(t *testing.T) {
+			tun := &Tun2socks{v2raySwapped: make(chan struct{})}
+			tun.SetV2RayInstance(instance)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			resolver := &dnsTlsResolver{t: tun, server: v2rayNet.TCPDestination(v2rayNet.ParseAddress("1.1.1.1"), 853), plain: true}
+			_, tlsErr := resolver.dial()
+			_, dnsErr := tun.dialDNS(ctx, "udp", "1.0.0.1:53")
+			_, reachErr := tun.CheckReachable("tcp", "127.0.0.1:80", 1000)
+			for step, err := range map[string]error{
+				"dns over tls":    tlsErr,
+				"resolver":        dnsErr,
+				"check reachable": reachErr,
+				"self test tcp":   tun.selfTestTcp(ctx),
+				"self test udp":   tun.selfTestUdp(ctx),
+			} {
+				if !errors.Is(err, errCoreNotRunning) {
+					t.Errorf("%s: error %v, want %v", step, err, errCoreNotRunning)
+				}
+			}
+			if handler := tun.pickOutbound(ctx, v2rayNet.TCPDestination(v2rayNet.ParseAddress("127.0.0.1"), 80)); handler != nil {
+				t.Errorf("outbound %s picked without a running core", handler.Tag())
+			}
+		})
+	}
+}
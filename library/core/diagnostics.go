@@ -0,0 +1,71 @@
+package libcore
+
+import (
+	"encoding/json"
+	"runtime"
+)
+
+type TunDiagnostics struct {
+	// Goroutines is the count of the whole process, the runtime can not
+	// attribute them. Each TCP relay runs three and each UDP session up to
+	// three, so a count far above that points at a leak.
+	Goroutines int `json:"goroutines"`
+
+	TcpRelays       int `json:"tcp_relays"`
+	UdpRelays       int `json:"udp_relays"`
+	NatSessions     int `json:"nat_sessions"`
+	NatPending      int `json:"nat_pending"`
+	StickyParked    int `json:"sticky_parked"`
+	AppStats        int `json:"app_stats"`
+	DnsCacheEntries int `json:"dns_cache_entries"`
+	DnsInflight     int `json:"dns_inflight"`
+	FlowMarks       int `json:"flow_marks"`
+}
+
+// Diagnostics reports the sizes of the tables kept by the tun as a JSON
+// object, to confirm or rule out leaks. It only takes the locks briefly
+// and does not stop the world. The relay buffers come from a sync.Pool,
+// which keeps no statistics, so they are not included.
+func (t *Tun2socks) Diagnostics() []byte {
+	d := TunDiagnostics{
+		Goroutines: runtime.NumGoroutine(),
+	}
+
+	for _, entry := range t.conns.list() {
+		if entry.network == "tcp" {
+			d.TcpRelays++
+		} else {
+			d.UdpRelays++
+		}
+	}
+
+	t.udpTable.mapping.Range(func(_, value interface{}) bool {
+		if _, ok := value.(*natSession); ok {
+			d.NatSessions++
+		} else {
+			d.NatPending++
+		}
+		return true
+	})
+
+	t.sticky.access.Lock()
+	d.StickyParked = len(t.sticky.upstreams)
+	t.sticky.access.Unlock()
+
+	t.access.Lock()
+	d.AppStats = len(t.appStats)
+	t.access.Unlock()
+
+	t.dnsCache.access.Lock()
+	d.DnsCacheEntries = len(t.dnsCache.entries)
+	t.dnsCache.access.Unlock()
+
+	if slots, _ := t.dnsInflight.Load().(chan struct{}); slots != nil {
+		d.DnsInflight = len(slots)
+	}
+
+	d.FlowMarks = t.tosMarks.size() + t.ttlMarks.size()
+
+	content, _ := json.Marshal(d)
+	return content
+}
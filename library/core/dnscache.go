@@ -0,0 +1,286 @@
+package libcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dnsCacheSize = 1024
+
+// dnsCache keeps the responses to hijacked queries for their TTL, so the
+// repeated lookups of an app are answered without a round trip.
+type dnsCache struct {
+	access  sync.Mutex
+	enabled bool
+	entries map[dnsCacheKey]*dnsCacheEntry
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type dnsCacheEntry struct {
+	msg      *dns.Msg
+	storedAt time.Time
+	expireAt time.Time
+}
+
+type DnsCacheEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  int64  `json:"ttl"`
+}
+
+// SetDnsCache toggles caching of DNS responses, disabling it also flushes
+// the cache.
+func (t *Tun2socks) SetDnsCache(enabled bool) {
+	t.dnsCache.access.Lock()
+	defer t.dnsCache.access.Unlock()
+
+	t.dnsCache.enabled = enabled
+	t.dnsCache.entries = nil
+}
+
+// DnsCacheEntries lists the cached names as a JSON array along with their
+// remaining TTL in seconds.
+func (t *Tun2socks) DnsCacheEntries() []byte {
+	t.dnsCache.access.Lock()
+	now := time.Now()
+	entries := []DnsCacheEntry{}
+	for key, entry := range t.dnsCache.entries {
+		if now.After(entry.expireAt) {
+			continue
+		}
+		entries = append(entries, DnsCacheEntry{
+			Name: key.name,
+			Type: dns.TypeToString[key.qtype],
+			TTL:  int64(entry.expireAt.Sub(now).Seconds()),
+		})
+	}
+	t.dnsCache.access.Unlock()
+
+	content, _ := json.Marshal(entries)
+	return content
+}
+
+// answerDns passes a response from upstream through the TTL clamp, the
+// cache, the DNS log and mirror, and returns it sized for the app. The
+// answers of the per-app servers are kept out of the shared cache.
+func (t *Tun2socks) answerDns(response []byte, upstream string) []byte {
+	response = t.clampDnsTTL(response)
+	if upstream != DnsUpstreamUid {
+		t.dnsCache.store(response)
+	}
+	t.recordDns(response, upstream)
+	t.mirrorDns(response)
+	return t.truncateDns(response)
+}
+
+func (t *Tun2socks) FlushDnsCache() {
+	t.dnsCache.access.Lock()
+	defer t.dnsCache.access.Unlock()
+
+	t.dnsCache.entries = nil
+}
+
+func cacheKey(msg *dns.Msg) (dnsCacheKey, bool) {
+	if len(msg.Question) != 1 {
+		return dnsCacheKey{}, false
+	}
+	question := msg.Question[0]
+	return dnsCacheKey{dns.CanonicalName(question.Name), question.Qtype, question.Qclass}, true
+}
+
+// lookup returns a packed response to query from the cache, nil on a miss.
+func (c *dnsCache) lookup(query []byte) []byte {
+	c.access.Lock()
+	enabled := c.enabled
+	c.access.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || msg.Response {
+		return nil
+	}
+	key, ok := cacheKey(msg)
+	if !ok {
+		return nil
+	}
+
+	c.access.Lock()
+	entry := c.entries[key]
+	if entry == nil {
+		c.access.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expireAt) {
+		delete(c.entries, key)
+		c.access.Unlock()
+		return nil
+	}
+	response := entry.msg.Copy()
+	c.access.Unlock()
+
+	elapsed := uint32(now.Sub(entry.storedAt).Seconds())
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+	response.Id = msg.Id
+	packed, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+// store caches a successful or NXDOMAIN response for its lowest TTL.
+func (c *dnsCache) store(response []byte) {
+	c.access.Lock()
+	enabled := c.enabled
+	c.access.Unlock()
+	if !enabled {
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil || !msg.Response || msg.Truncated {
+		return
+	}
+	key, ok := cacheKey(msg)
+	if !ok {
+		return
+	}
+
+	var ttl uint32
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+		if len(msg.Answer) == 0 {
+			return
+		}
+		ttl = minTTL(msg.Answer)
+	case dns.RcodeNameError:
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = soa.Minttl
+				if soa.Hdr.Ttl < ttl {
+					ttl = soa.Hdr.Ttl
+				}
+			}
+		}
+	default:
+		return
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	c.put(key, msg, ttl)
+}
+
+// put caches msg under key for ttl seconds, the caller holds access.
+func (c *dnsCache) put(key dnsCacheKey, msg *dns.Msg, ttl uint32) {
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = map[dnsCacheKey]*dnsCacheEntry{}
+	}
+	if len(c.entries) >= dnsCacheSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expireAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= dnsCacheSize {
+			return
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{
+		msg:      msg,
+		storedAt: now,
+		expireAt: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// PreloadDnsCache seeds the cache with known records, such as the address
+// of the proxy server, so the first lookups at startup skip the round trip.
+// entries has one resource record per line in zone file format, for example
+// "proxy.example.com. 300 IN A 203.0.113.1". The records of the same name
+// and type make up one answer, kept for their lowest TTL unless a fresh
+// response from upstream replaces it first. The cache has to be enabled
+// with SetDnsCache beforehand.
+func (t *Tun2socks) PreloadDnsCache(entries string) error {
+	answers := map[dnsCacheKey][]dns.RR{}
+	var keys []dnsCacheKey
+	for _, line := range strings.Split(entries, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return fmt.Errorf("invalid dns record %s: %v", line, err)
+		}
+		if rr == nil {
+			continue
+		}
+		header := rr.Header()
+		key := dnsCacheKey{dns.CanonicalName(header.Name), header.Rrtype, header.Class}
+		if _, ok := answers[key]; !ok {
+			keys = append(keys, key)
+		}
+		answers[key] = append(answers[key], rr)
+	}
+
+	t.dnsCache.access.Lock()
+	defer t.dnsCache.access.Unlock()
+
+	if !t.dnsCache.enabled {
+		return errors.New("dns cache disabled")
+	}
+	for _, key := range keys {
+		ttl := minTTL(answers[key])
+		if ttl == 0 {
+			continue
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion(key.name, key.qtype)
+		msg.Question[0].Qclass = key.qclass
+		msg.Response = true
+		msg.RecursionDesired = true
+		msg.RecursionAvailable = true
+		msg.Answer = answers[key]
+		t.dnsCache.put(key, msg, ttl)
+	}
+	return nil
+}
+
+func minTTL(records []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range records {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
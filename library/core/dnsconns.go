@@ -0,0 +1,59 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsConnWait is how long a DNS connection waits for a slot before it is
+// dropped.
+const dnsConnWait = 5 * time.Second
+
+// SetDnsMaxConnections caps the connections the DNS hijack keeps open to
+// the core at once, the UDP session of each source port queries come from
+// and each DNS over TCP connection, so DNS heavy pages do not open dozens
+// of them. New ones beyond it queue for up to five seconds until one is
+// closed and are dropped after. Queued and dropped ones are counted in the
+// metrics. Queries served by the DNS workers, DNS routes or the TLS
+// upstream reuse their own connections and are not counted, SetDnsWorkers
+// is the way to make all queries share a few. Zero means unlimited.
+func (t *Tun2socks) SetDnsMaxConnections(limit int32) {
+	var slots chan struct{}
+	if limit > 0 {
+		slots = make(chan struct{}, limit)
+	}
+	t.dnsConnSlots.Store(slots)
+}
+
+// acquireDnsConn takes a slot for a DNS connection, waiting for one if all
+// are taken, and returns the function freeing it. It returns false if none
+// was freed in time.
+func (t *Tun2socks) acquireDnsConn() (func(), bool) {
+	slots, _ := t.dnsConnSlots.Load().(chan struct{})
+	if slots == nil {
+		return func() {}, true
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			<-slots
+		})
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	atomic.AddUint32(&t.dnsConnQueued, 1)
+	timer := time.NewTimer(dnsConnWait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		atomic.AddUint32(&t.dnsConnDropped, 1)
+		return nil, false
+	}
+}
@@ -0,0 +1,110 @@
+package libcore
+
+import (
+	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/core"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsInflightWait is how long a query waits for a slot before it is
+// answered with SERVFAIL.
+const dnsInflightWait = 200 * time.Millisecond
+
+// dnsInflightTimeout frees the slot of a query that got no answer, the app
+// gave up on it by then and the session it went out on may stay open much
+// longer.
+var dnsInflightTimeout = 5 * time.Second
+
+// SetDnsMaxInflight caps the hijacked DNS queries being resolved at once,
+// whether by the core, the DNS workers or over TLS. Queries beyond it wait
+// briefly for one to finish and are then answered with SERVFAIL, which is
+// counted in the metrics. Queries answered from the cache do not count.
+// Zero means unlimited.
+func (t *Tun2socks) SetDnsMaxInflight(limit int32) {
+	var slots chan struct{}
+	if limit > 0 {
+		slots = make(chan struct{}, limit)
+	}
+	t.dnsInflight.Store(slots)
+}
+
+// dnsInflightPacket is a query holding a slot, which is freed once it is
+// answered, dropped or timed out.
+type dnsInflightPacket struct {
+	core.UDPPacket
+	slots chan struct{}
+	timer *time.Timer
+	once  sync.Once
+}
+
+func (p *dnsInflightPacket) release() {
+	p.once.Do(func() {
+		p.timer.Stop()
+		<-p.slots
+	})
+}
+
+// expire frees the slot when the timer fires, it can not stop the timer
+// as it may run before acquireDns stored it.
+func (p *dnsInflightPacket) expire() {
+	p.once.Do(func() {
+		<-p.slots
+	})
+}
+
+func (p *dnsInflightPacket) Drop() {
+	p.release()
+	p.UDPPacket.Drop()
+}
+
+// acquireDns takes a slot for packet and returns it wrapped to free it, or
+// false if there is none left, in which case the app has been answered.
+func (t *Tun2socks) acquireDns(packet core.UDPPacket) (core.UDPPacket, bool) {
+	slots, _ := t.dnsInflight.Load().(chan struct{})
+	if slots == nil {
+		return packet, true
+	}
+	select {
+	case slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(dnsInflightWait)
+		defer timer.Stop()
+		select {
+		case slots <- struct{}{}:
+		case <-timer.C:
+			atomic.AddUint32(&t.dnsInflightRejected, 1)
+			if response := serverFailure(packet.Data()); response != nil {
+				_, _ = packet.WriteBack(response, nil)
+			}
+			packet.Drop()
+			return nil, false
+		}
+	}
+	p := &dnsInflightPacket{UDPPacket: packet, slots: slots}
+	p.timer = time.AfterFunc(dnsInflightTimeout, p.expire)
+	return p, true
+}
+
+// releaseDns frees the slot of packet once the query is answered, the
+// packet itself stays in use for the rest of the session.
+func releaseDns(packet core.UDPPacket) {
+	if p, ok := packet.(*dnsInflightPacket); ok {
+		p.release()
+	}
+}
+
+func serverFailure(query []byte) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || msg.Response {
+		return nil
+	}
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, dns.RcodeServerFailure)
+	packed, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
@@ -0,0 +1,80 @@
+package libcore
+
+import (
+	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/core"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testDnsQuery(t *testing.T) *testUDPPacket {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	data, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestUDPPacket(data, "10.0.0.2:40000", "172.19.0.2:53")
+}
+
+func TestDnsInflightSlotTimesOut(t *testing.T) {
+	previous := dnsInflightTimeout
+	dnsInflightTimeout = 50 * time.Millisecond
+	defer func() {
+		dnsInflightTimeout = previous
+	}()
+
+	tun := &Tun2socks{}
+	tun.SetDnsMaxInflight(1)
+
+	// the query is never answered nor dropped, as on a session the core
+	// does not reply on
+	if _, ok := tun.acquireDns(testDnsQuery(t)); !ok {
+		t.Fatal("first query refused")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	packet, ok := tun.acquireDns(testDnsQuery(t))
+	if !ok {
+		t.Fatal("slot of the unanswered query not freed")
+	}
+	releaseDns(packet)
+	packet.Drop()
+	if rejected := atomic.LoadUint32(&tun.dnsInflightRejected); rejected != 0 {
+		t.Errorf("%d queries rejected", rejected)
+	}
+}
+
+func TestDnsPoolCloseDropsQueued(t *testing.T) {
+	tun := &Tun2socks{}
+	tun.SetDnsMaxInflight(1)
+
+	query := testDnsQuery(t)
+	packet, ok := tun.acquireDns(query)
+	if !ok {
+		t.Fatal("query refused")
+	}
+
+	// a pool without workers keeps the query queued
+	tun.dnsPool = &dnsPool{
+		queue: make(chan core.UDPPacket, dnsPoolQueueSize),
+		done:  make(chan struct{}),
+	}
+	if !tun.submitDns(packet) {
+		t.Fatal("query not queued")
+	}
+	tun.SetDnsWorkers(0)
+
+	if dropped := atomic.LoadInt32(&query.dropped); dropped != 1 {
+		t.Fatalf("queued query dropped %d times, want 1", dropped)
+	}
+	start := time.Now()
+	if _, ok := tun.acquireDns(testDnsQuery(t)); !ok || time.Since(start) >= dnsInflightWait {
+		t.Fatal("slot of the queued query not freed")
+	}
+	if tun.submitDns(testDnsQuery(t)) {
+		t.Fatal("query queued after the pool closed")
+	}
+}
@@ -0,0 +1,55 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+)
+
+// dnsLimiter counts DNS queries in fixed one second windows, globally and
+// per uid. Queries of unknown apps are only subject to the global limit.
+type dnsLimiter struct {
+	access    sync.Mutex
+	perUid    int
+	global    int
+	window    time.Time
+	total     int
+	uidCounts map[uint16]int
+}
+
+// SetDnsRateLimit caps the DNS queries per second handled by the tun, for
+// each uid and for all apps together, zero means unlimited. Excess queries
+// are dropped and counted in the metrics.
+func (t *Tun2socks) SetDnsRateLimit(perUid int32, global int32) {
+	t.dnsLimit.access.Lock()
+	defer t.dnsLimit.access.Unlock()
+
+	t.dnsLimit.perUid = int(perUid)
+	t.dnsLimit.global = int(global)
+}
+
+func (l *dnsLimiter) allow(uid uint16) bool {
+	l.access.Lock()
+	defer l.access.Unlock()
+
+	if l.perUid <= 0 && l.global <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(l.window) >= time.Second {
+		l.window = now
+		l.total = 0
+		l.uidCounts = map[uint16]int{}
+	}
+	if l.global > 0 && l.total >= l.global {
+		return false
+	}
+	if uid > 0 && l.perUid > 0 {
+		if l.uidCounts[uid] >= l.perUid {
+			return false
+		}
+		l.uidCounts[uid]++
+	}
+	l.total++
+	return true
+}
@@ -0,0 +1,102 @@
+package libcore
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dnsLogSize = 256
+
+const (
+	DnsUpstreamCore   = "core"
+	DnsUpstreamCache  = "cache"
+	DnsUpstreamTls    = "tls"
+	DnsUpstreamRoute  = "route"
+	DnsUpstreamSystem = "system"
+	DnsUpstreamUid    = "uid"
+)
+
+type DnsResolution struct {
+	Time     int64    `json:"time"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Rcode    string   `json:"rcode"`
+	Answers  []string `json:"answers"`
+	Upstream string   `json:"upstream"`
+}
+
+// dnsLog keeps the latest resolutions in a ring buffer.
+type dnsLog struct {
+	access  sync.Mutex
+	enabled bool
+	entries []DnsResolution
+	next    int
+}
+
+// SetDnsLog toggles recording of the responses to hijacked queries for
+// RecentDnsResolutions, disabling it also clears the records.
+func (t *Tun2socks) SetDnsLog(enabled bool) {
+	t.dnsLog.access.Lock()
+	defer t.dnsLog.access.Unlock()
+
+	t.dnsLog.enabled = enabled
+	t.dnsLog.entries = nil
+	t.dnsLog.next = 0
+}
+
+// RecentDnsResolutions returns the last recorded resolutions as a JSON
+// array, oldest first. The upstream is "core", "cache", "tls" or "route",
+// which server of the V2Ray DNS config answered is not known to the tun.
+func (t *Tun2socks) RecentDnsResolutions() []byte {
+	t.dnsLog.access.Lock()
+	entries := make([]DnsResolution, 0, len(t.dnsLog.entries))
+	entries = append(entries, t.dnsLog.entries[t.dnsLog.next:]...)
+	entries = append(entries, t.dnsLog.entries[:t.dnsLog.next]...)
+	t.dnsLog.access.Unlock()
+
+	content, _ := json.Marshal(entries)
+	return content
+}
+
+func (t *Tun2socks) recordDns(response []byte, upstream string) {
+	t.dnsLog.access.Lock()
+	enabled := t.dnsLog.enabled
+	t.dnsLog.access.Unlock()
+	if !enabled {
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil || !msg.Response || len(msg.Question) == 0 {
+		return
+	}
+	question := msg.Question[0]
+	resolution := DnsResolution{
+		Time:     time.Now().Unix(),
+		Name:     strings.TrimSuffix(question.Name, "."),
+		Type:     dns.TypeToString[question.Qtype],
+		Rcode:    dns.RcodeToString[msg.Rcode],
+		Answers:  []string{},
+		Upstream: upstream,
+	}
+	for _, rr := range msg.Answer {
+		answer := strings.TrimPrefix(rr.String(), rr.Header().String())
+		resolution.Answers = append(resolution.Answers, answer)
+	}
+
+	t.dnsLog.access.Lock()
+	defer t.dnsLog.access.Unlock()
+
+	if !t.dnsLog.enabled {
+		return
+	}
+	if len(t.dnsLog.entries) < dnsLogSize {
+		t.dnsLog.entries = append(t.dnsLog.entries, resolution)
+		return
+	}
+	t.dnsLog.entries[t.dnsLog.next] = resolution
+	t.dnsLog.next = (t.dnsLog.next + 1) % dnsLogSize
+}
@@ -0,0 +1,56 @@
+package libcore
+
+import (
+	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"sync/atomic"
+)
+
+const (
+	DnsMalformedPass = iota
+	DnsMalformedDrop
+)
+
+// SetDnsMalformedAction sets how UDP packets that look like DNS by their
+// destination but are not a query with a question are handled, such as
+// responses, empty questions or garbage. This covers packets to the router
+// address, which are otherwise handed to the core DNS like any query, and
+// with DNS hijacking packets to port 53 of other addresses, which are
+// otherwise relayed as plain UDP. DnsMalformedPass keeps that behavior,
+// DnsMalformedDrop drops them. They are counted in the metrics and logged
+// in debug mode either way.
+func (t *Tun2socks) SetDnsMalformedAction(action int32) {
+	atomic.StoreInt32(&t.dnsMalformedAction, action)
+}
+
+// dnsQueryProblem returns why payload is not a DNS query with a question,
+// or an empty string if it is one.
+func dnsQueryProblem(payload []byte) string {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(payload); err != nil {
+		return "unparsable"
+	}
+	if msg.Response {
+		return "response"
+	}
+	if len(msg.Question) == 0 {
+		return "no question"
+	}
+	return ""
+}
+
+// dropMalformedDns handles a packet to a DNS destination that is not a
+// query, returns true if it is to be dropped.
+func (t *Tun2socks) dropMalformedDns(src v2rayNet.Destination, dest v2rayNet.Destination, problem string) bool {
+	atomic.AddUint32(&t.dnsMalformed, 1)
+	drop := atomic.LoadInt32(&t.dnsMalformedAction) == DnsMalformedDrop
+	if t.debug {
+		action := "passed"
+		if drop {
+			action = "dropped"
+		}
+		log.Infof("[DNS] not a query (%s): %s ==> %s, %s", problem, src.NetAddr(), dest.NetAddr(), action)
+	}
+	return drop
+}
@@ -0,0 +1,137 @@
+package libcore
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dnsMirrorTimeout  = 5 * time.Second
+	dnsMirrorInFlight = 16
+)
+
+type dnsMirror struct {
+	server  v2rayNet.Destination
+	verbose bool
+	slots   chan struct{}
+}
+
+// SetDnsMirror sends the question of every hijacked query not answered from
+// the cache again to server, an ip:port reached directly by the protected
+// dialer, and logs a warning when the answers disagree, that is when the
+// rcode differs or they have no address in common. The app always gets the
+// upstream answer, the mirrored query runs afterwards in the background
+// and is skipped when too many are in flight. verbose also logs answers
+// that agree. An empty server disables it.
+func (t *Tun2socks) SetDnsMirror(server string, verbose bool) error {
+	if server == "" {
+		t.dnsMirror.Store((*dnsMirror)(nil))
+		return nil
+	}
+	dest, err := v2rayNet.ParseDestination("udp:" + server)
+	if err != nil {
+		return err
+	}
+	t.dnsMirror.Store(&dnsMirror{
+		server:  dest,
+		verbose: verbose,
+		slots:   make(chan struct{}, dnsMirrorInFlight),
+	})
+	return nil
+}
+
+func (t *Tun2socks) mirrorDns(response []byte) {
+	m, _ := t.dnsMirror.Load().(*dnsMirror)
+	if m == nil {
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return
+	}
+	primary := new(dns.Msg)
+	if err := primary.Unpack(response); err != nil || len(primary.Question) == 0 {
+		<-m.slots
+		return
+	}
+
+	go func() {
+		defer func() {
+			<-m.slots
+		}()
+
+		name := primary.Question[0].Name
+		secondary, err := m.exchange(primary.Question[0])
+		if err != nil {
+			log.Warnf("[DNS] mirror query %s to %s failed: %s", name, m.server.NetAddr(), err.Error())
+			return
+		}
+		primaryAnswers, secondaryAnswers := dnsAddresses(primary), dnsAddresses(secondary)
+		if primary.Rcode != secondary.Rcode || !overlaps(primaryAnswers, secondaryAnswers) {
+			atomic.AddUint32(&t.dnsMismatches, 1)
+			log.Warnf("[DNS] mirror mismatch for %s: upstream %s [%s], %s %s [%s]", name,
+				dns.RcodeToString[primary.Rcode], strings.Join(primaryAnswers, " "),
+				m.server.NetAddr(), dns.RcodeToString[secondary.Rcode], strings.Join(secondaryAnswers, " "))
+		} else if m.verbose {
+			log.Infof("[DNS] mirror match for %s: [%s]", name, strings.Join(primaryAnswers, " "))
+		}
+	}()
+}
+
+func (m *dnsMirror) exchange(question dns.Question) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsMirrorTimeout)
+	defer cancel()
+
+	conn, err := internet.DialSystem(ctx, m.server, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsMirrorTimeout))
+
+	query := new(dns.Msg)
+	query.SetQuestion(question.Name, question.Qtype)
+	dnsConn := &dns.Conn{Conn: conn}
+	if err = dnsConn.WriteMsg(query); err != nil {
+		return nil, err
+	}
+	return dnsConn.ReadMsg()
+}
+
+// dnsAddresses lists the A and AAAA records of msg, sorted.
+func dnsAddresses(msg *dns.Msg) []string {
+	var addresses []string
+	for _, rr := range msg.Answer {
+		switch record := rr.(type) {
+		case *dns.A:
+			addresses = append(addresses, record.A.String())
+		case *dns.AAAA:
+			addresses = append(addresses, record.AAAA.String())
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// overlaps reports whether a and b share an address, or are both empty.
+func overlaps(a []string, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package libcore
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/xjasonlyu/tun2socks/core"
+	"github.com/xjasonlyu/tun2socks/log"
+	"github.com/xtls/xray-core/common/session"
+	v2rayCore "github.com/xtls/xray-core/core"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dnsPoolQueueSize = 64
+	dnsPoolTimeout   = 10 * time.Second
+)
+
+// dnsPool serves DNS queries with a fixed set of workers, each of them
+// keeping a single connection to the core instead of dialing per query.
+type dnsPool struct {
+	queue chan core.UDPPacket
+	done  chan struct{}
+}
+
+// SetDnsWorkers serves DNS queries with the given number of persistent
+// workers, zero goes back to handling each query like any other UDP session.
+// Workers dial the running core on their first query and again after the
+// core is swapped by SetV2RayInstance.
+func (t *Tun2socks) SetDnsWorkers(workers int32) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if t.dnsPool != nil {
+		t.dnsPool.close()
+		t.dnsPool = nil
+	}
+	if workers <= 0 {
+		return
+	}
+
+	p := &dnsPool{
+		queue: make(chan core.UDPPacket, dnsPoolQueueSize),
+		done:  make(chan struct{}),
+	}
+	for i := int32(0); i < workers; i++ {
+		w := &dnsWorker{tun: t}
+		go w.loop(p)
+	}
+	t.dnsPool = p
+}
+
+// close stops the workers and drops the queries still queued, so their
+// in-flight slots are freed. It is called with the tun locked, which keeps
+// submitDns from queueing more.
+func (p *dnsPool) close() {
+	close(p.done)
+	for {
+		select {
+		case packet := <-p.queue:
+			packet.Drop()
+		default:
+			return
+		}
+	}
+}
+
+// submitDns hands packet to the DNS workers, returns false if there is no
+// pool or its queue is full.
+func (t *Tun2socks) submitDns(packet core.UDPPacket) bool {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	p := t.dnsPool
+	if p == nil {
+		return false
+	}
+	select {
+	case p.queue <- packet:
+		return true
+	default:
+		return false
+	}
+}
+
+type dnsQuery struct {
+	packet core.UDPPacket
+	id     uint16
+}
+
+type dnsWorker struct {
+	tun  *Tun2socks
+	conn *dnsWorkerConn
+}
+
+// dnsWorkerConn is the connection of a worker to one core.
+type dnsWorkerConn struct {
+	net.PacketConn
+	tun     *Tun2socks
+	core    *v2rayCore.Instance
+	access  sync.Mutex
+	nextId  uint16
+	pending map[uint16]*dnsQuery
+}
+
+func (w *dnsWorker) loop(p *dnsPool) {
+	for {
+		select {
+		case <-p.done:
+			if w.conn != nil {
+				_ = w.conn.Close()
+			}
+			return
+		case packet := <-p.queue:
+			conn := w.connect()
+			if conn == nil {
+				packet.Drop()
+				continue
+			}
+			conn.exchange(packet)
+		}
+	}
+}
+
+// connect returns the connection to the running core, dialing it if the
+// worker has none yet or the core was swapped since.
+func (w *dnsWorker) connect() *dnsWorkerConn {
+	instance, err := w.tun.runningCore()
+	if err != nil {
+		log.Errorf("[DNS] dial worker failed: %s", err.Error())
+		return nil
+	}
+	if w.conn != nil {
+		if w.conn.core == instance {
+			return w.conn
+		}
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+
+	conn, err := v2rayCore.DialUDP(session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag: "dns-in",
+	}), instance)
+	if err != nil {
+		log.Errorf("[DNS] dial worker failed: %s", err.Error())
+		return nil
+	}
+	w.conn = &dnsWorkerConn{PacketConn: conn, tun: w.tun, core: instance, pending: map[uint16]*dnsQuery{}}
+	go w.conn.readLoop()
+	return w.conn
+}
+
+func (w *dnsWorkerConn) exchange(packet core.UDPPacket) {
+	data := packet.Data()
+	if len(data) < 12 {
+		packet.Drop()
+		return
+	}
+
+	// queries of different apps share the connection, so the message id
+	// is rewritten to one unique within the worker and restored on reply.
+	query := make([]byte, len(data))
+	copy(query, data)
+
+	w.access.Lock()
+	w.nextId++
+	id := w.nextId
+	if old := w.pending[id]; old != nil {
+		old.packet.Drop()
+	}
+	w.pending[id] = &dnsQuery{packet, binary.BigEndian.Uint16(query)}
+	w.access.Unlock()
+
+	binary.BigEndian.PutUint16(query, id)
+	time.AfterFunc(dnsPoolTimeout, func() {
+		if q := w.take(id); q != nil {
+			q.packet.Drop()
+		}
+	})
+
+	if _, err := w.WriteTo(query, packet.LocalAddr()); err != nil {
+		if q := w.take(id); q != nil {
+			q.packet.Drop()
+		}
+	}
+}
+
+func (w *dnsWorkerConn) take(id uint16) *dnsQuery {
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	q := w.pending[id]
+	delete(w.pending, id)
+	return q
+}
+
+func (w *dnsWorkerConn) readLoop() {
+	buf := pool.Get(pool.RelayBufferSize)
+	defer pool.Put(buf)
+
+	for {
+		n, _, err := w.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n < 12 {
+			continue
+		}
+		q := w.take(binary.BigEndian.Uint16(buf))
+		if q == nil {
+			continue
+		}
+		binary.BigEndian.PutUint16(buf, q.id)
+		_, _ = q.packet.WriteBack(w.tun.answerDns(buf[:n], DnsUpstreamCore), nil)
+		q.packet.Drop()
+	}
+
+	w.access.Lock()
+	for id, q := range w.pending {
+		q.packet.Drop()
+		delete(w.pending, id)
+	}
+	w.access.Unlock()
+}
@@ -0,0 +1,123 @@
+package libcore
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/core"
+	"sort"
+	"strings"
+)
+
+const dnsTlsScheme = "tls://"
+
+// dnsRoute sends the queries for a domain to its own resolver, or to the
+// system resolvers if system is set.
+type dnsRoute struct {
+	domain   string
+	wildcard bool
+	system   bool
+	resolver *dnsTlsResolver
+}
+
+// SetDnsRoutes sends hijacked queries for some domains to their own
+// upstream, such as internal names to a corporate resolver. routes has one
+// "domain upstream" pair per line. A domain matches itself and its
+// subdomains, "*.domain" only its subdomains, and the longest match wins.
+// The upstream is the host[:port] of a DNS server queried over TCP, or
+// "tls://host[:port]" for DNS-over-TLS, dialed through the proxy like app
+// traffic so routing rules decide whether it is reached directly, or
+// "system" for the resolvers of the network set by SetSystemDns. Other
+// names go to the upstream set by SetDnsUpstream. Empty clears the routes.
+func (t *Tun2socks) SetDnsRoutes(routes string) error {
+	var parsed []*dnsRoute
+	for _, line := range strings.Split(routes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			closeDnsRoutes(parsed)
+			return fmt.Errorf("invalid dns route %s", line)
+		}
+		route := &dnsRoute{domain: strings.ToLower(fields[0])}
+		if strings.HasPrefix(route.domain, "*.") {
+			route.domain = route.domain[2:]
+			route.wildcard = true
+		}
+		route.domain = dns.Fqdn(route.domain)
+		if _, ok := dns.IsDomainName(route.domain); !ok {
+			closeDnsRoutes(parsed)
+			return fmt.Errorf("invalid domain %s", fields[0])
+		}
+
+		var err error
+		route.resolver, err = t.parseDnsUpstream(fields[1])
+		route.system = route.resolver == nil
+		if err != nil {
+			closeDnsRoutes(parsed)
+			return err
+		}
+		parsed = append(parsed, route)
+	}
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return len(parsed[i].domain) > len(parsed[j].domain)
+	})
+
+	old, _ := t.dnsRoutes.Load().([]*dnsRoute)
+	t.dnsRoutes.Store(parsed)
+	closeDnsRoutes(old)
+	return nil
+}
+
+// parseDnsUpstream parses an upstream in the format of SetDnsRoutes, nil
+// stands for the system resolvers.
+func (t *Tun2socks) parseDnsUpstream(upstream string) (*dnsTlsResolver, error) {
+	switch {
+	case upstream == dnsSystemUpstream:
+		return nil, nil
+	case strings.HasPrefix(upstream, dnsTlsScheme):
+		return t.newDnsResolver(strings.TrimPrefix(upstream, dnsTlsScheme), false)
+	default:
+		return t.newDnsResolver(upstream, true)
+	}
+}
+
+func closeDnsRoutes(routes []*dnsRoute) {
+	for _, route := range routes {
+		if route.resolver != nil {
+			route.resolver.close()
+		}
+	}
+}
+
+func (r *dnsRoute) match(name string) bool {
+	if !dns.IsSubDomain(r.domain, name) {
+		return false
+	}
+	return !r.wildcard || name != r.domain
+}
+
+// resolveDnsRoute answers packet through the resolver routed for its
+// question, returns false if no route matches.
+func (t *Tun2socks) resolveDnsRoute(packet core.UDPPacket) bool {
+	routes, _ := t.dnsRoutes.Load().([]*dnsRoute)
+	if len(routes) == 0 {
+		return false
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet.Data()); err != nil || len(msg.Question) == 0 {
+		return false
+	}
+	name := strings.ToLower(dns.Fqdn(msg.Question[0].Name))
+	for _, route := range routes {
+		if !route.match(name) {
+			continue
+		}
+		if route.system {
+			return t.resolveSystemDns(packet, DnsUpstreamSystem)
+		}
+		go t.resolveWith(route.resolver, packet, DnsUpstreamRoute)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package libcore
+
+import (
+	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/core"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	DnsAdPreserve = iota
+	DnsAdStrip
+)
+
+// SetDnsDnssec sets how hijacked DNS treats DNSSEC. adMode DnsAdPreserve
+// passes the AD bit of the upstream responses on to the app, DnsAdStrip
+// clears it, for when the app should not rely on a validation it can not
+// check itself. requestValidation sets the DO bit on the queries, adding an
+// EDNS0 OPT record to those without one, so a validating upstream sets AD
+// on secure answers. What was added is taken out of the response again:
+// apps that did not set DO get it without the signature records and DO
+// bit, and without the OPT record if their query had none. Queries sent
+// after the first on the same UDP flow through the core are forwarded as
+// they are.
+func (t *Tun2socks) SetDnsDnssec(adMode int32, requestValidation bool) {
+	var value int32
+	if requestValidation {
+		value = 1
+	}
+	atomic.StoreInt32(&t.dnsAdMode, adMode)
+	atomic.StoreInt32(&t.dnsRequestDo, value)
+}
+
+// dnssecPacket carries a query rewritten for DNSSEC, and undoes the
+// rewrite on the responses written back for it.
+type dnssecPacket struct {
+	core.UDPPacket
+	query    []byte
+	stripAd  bool
+	clientDo bool
+	addedOpt bool
+}
+
+// withDnssec wraps packet if DNSSEC options are set.
+func (t *Tun2socks) withDnssec(packet core.UDPPacket) core.UDPPacket {
+	stripAd := atomic.LoadInt32(&t.dnsAdMode) == DnsAdStrip
+	requestDo := atomic.LoadInt32(&t.dnsRequestDo) == 1
+	if !stripAd && !requestDo {
+		return packet
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet.Data()); err != nil || msg.Response {
+		return packet
+	}
+	wrapped := &dnssecPacket{UDPPacket: packet, stripAd: stripAd}
+	opt := msg.IsEdns0()
+	wrapped.clientDo = opt != nil && opt.Do()
+	if requestDo && !wrapped.clientDo {
+		if opt == nil {
+			msg.SetEdns0(dns.DefaultMsgSize, true)
+			wrapped.addedOpt = true
+		} else {
+			opt.SetDo()
+		}
+		if query, err := msg.Pack(); err == nil {
+			wrapped.query = query
+		} else {
+			wrapped.addedOpt = false
+		}
+	}
+	return wrapped
+}
+
+func (p *dnssecPacket) Data() []byte {
+	if p.query != nil {
+		return p.query
+	}
+	return p.UDPPacket.Data()
+}
+
+func (p *dnssecPacket) WriteBack(b []byte, addr net.Addr) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil || !msg.Response {
+		return p.UDPPacket.WriteBack(b, addr)
+	}
+	if p.stripAd {
+		msg.AuthenticatedData = false
+	}
+	if p.query != nil {
+		var qtype uint16
+		if len(msg.Question) > 0 {
+			qtype = msg.Question[0].Qtype
+		}
+		msg.Answer = stripDnssecRecords(msg.Answer, qtype)
+		msg.Ns = stripDnssecRecords(msg.Ns, qtype)
+		msg.Extra = stripDnssecRecords(msg.Extra, qtype)
+		if opt := msg.IsEdns0(); opt != nil {
+			if p.addedOpt {
+				msg.Extra = removeOpt(msg.Extra)
+			} else {
+				opt.SetDo(false)
+			}
+		}
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return p.UDPPacket.WriteBack(b, addr)
+	}
+	return p.UDPPacket.WriteBack(packed, addr)
+}
+
+// stripDnssecRecords drops the records only sent because of the DO bit,
+// except those of the type asked for.
+func stripDnssecRecords(records []dns.RR, qtype uint16) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range records {
+		switch rrtype := rr.Header().Rrtype; rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if rrtype != qtype {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+func removeOpt(records []dns.RR) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,176 @@
+package libcore
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+// dnssecExchange sends query through withDnssec and answers it the way a
+// validating upstream does, returning what the upstream received and what
+// was written back to the app.
+func dnssecExchange(t *testing.T, tun *Tun2socks, query *dns.Msg, qtype uint16) (*dns.Msg, *dns.Msg) {
+	t.Helper()
+	app := newTestUDPPacket(packResponse(t, query), "10.0.0.2:40000", "172.19.0.2:53")
+	packet := tun.withDnssec(app)
+
+	sent := new(dns.Msg)
+	if err := sent.Unpack(packet.Data()); err != nil {
+		t.Fatal(err)
+	}
+	response := new(dns.Msg)
+	response.SetReply(sent)
+	response.AuthenticatedData = true
+	response.Answer = []dns.RR{
+		mustRR(t, "example.com. 300 IN A 192.0.2.1"),
+		mustRR(t, "example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. AAAA"),
+	}
+	response.Ns = []dns.RR{
+		mustRR(t, "example.com. 300 IN NSEC www.example.com. A RRSIG NSEC"),
+		mustRR(t, "example.com. 300 IN NSEC3 1 0 0 - 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR A"),
+	}
+	if qtype != dns.TypeA {
+		response.Question[0].Qtype = qtype
+		response.Answer = append(response.Answer, mustRR(t, "example.com. 300 IN NSEC www.example.com. A NSEC"))
+	}
+	if opt := sent.IsEdns0(); opt != nil {
+		response.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	if _, err := packet.WriteBack(packResponse(t, response), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	received := new(dns.Msg)
+	if err := received.Unpack(<-app.written); err != nil {
+		t.Fatal(err)
+	}
+	return sent, received
+}
+
+func countRRs(records []dns.RR, rrtype uint16) int {
+	var count int
+	for _, rr := range records {
+		if rr.Header().Rrtype == rrtype {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDnssecAddsAndRemovesOpt(t *testing.T) {
+	tun := &Tun2socks{}
+	tun.SetDnsDnssec(DnsAdPreserve, true)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	sent, received := dnssecExchange(t, tun, query, dns.TypeA)
+
+	if opt := sent.IsEdns0(); opt == nil || !opt.Do() {
+		t.Fatal("query sent without an OPT record with DO")
+	}
+	if received.IsEdns0() != nil {
+		t.Error("added OPT record left in the response")
+	}
+	if !received.AuthenticatedData {
+		t.Error("AD bit not preserved")
+	}
+	for _, rrtype := range []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3} {
+		if count := countRRs(append(append(received.Answer, received.Ns...), received.Extra...), rrtype); count != 0 {
+			t.Errorf("%d %s records left in the response", count, dns.TypeToString[rrtype])
+		}
+	}
+	if count := countRRs(received.Answer, dns.TypeA); count != 1 {
+		t.Errorf("%d A records in the response, want 1", count)
+	}
+}
+
+func TestDnssecSetsAndRestoresDo(t *testing.T) {
+	tun := &Tun2socks{}
+	tun.SetDnsDnssec(DnsAdPreserve, true)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.SetEdns0(1232, false)
+	sent, received := dnssecExchange(t, tun, query, dns.TypeA)
+
+	if opt := sent.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 1232 {
+		t.Fatalf("query sent with OPT %v, want DO set and the size kept", opt)
+	}
+	opt := received.IsEdns0()
+	if opt == nil {
+		t.Fatal("OPT record of the app removed from the response")
+	}
+	if opt.Do() {
+		t.Error("DO bit not cleared in the response")
+	}
+	if count := countRRs(received.Answer, dns.TypeRRSIG); count != 0 {
+		t.Errorf("%d RRSIG records left in the response", count)
+	}
+}
+
+// Apps that set DO themselves get the response untouched.
+func TestDnssecKeepsRecordsForDoClients(t *testing.T) {
+	tun := &Tun2socks{}
+	tun.SetDnsDnssec(DnsAdPreserve, true)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.SetEdns0(1232, true)
+	_, received := dnssecExchange(t, tun, query, dns.TypeA)
+
+	if opt := received.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("DO bit of the app cleared")
+	}
+	if count := countRRs(received.Answer, dns.TypeRRSIG); count != 1 {
+		t.Errorf("%d RRSIG records in the response, want 1", count)
+	}
+	if count := countRRs(received.Ns, dns.TypeNSEC); count != 1 {
+		t.Errorf("%d NSEC records in the response, want 1", count)
+	}
+}
+
+// Records of the type asked for are kept even though DO was only added.
+func TestDnssecKeepsQueriedType(t *testing.T) {
+	tun := &Tun2socks{}
+	tun.SetDnsDnssec(DnsAdPreserve, true)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeNSEC)
+	_, received := dnssecExchange(t, tun, query, dns.TypeNSEC)
+
+	if count := countRRs(received.Answer, dns.TypeNSEC); count != 1 {
+		t.Errorf("%d NSEC answers, want 1", count)
+	}
+	if count := countRRs(received.Ns, dns.TypeNSEC); count != 1 {
+		t.Errorf("%d NSEC authority records, want 1", count)
+	}
+	if count := countRRs(received.Answer, dns.TypeRRSIG); count != 0 {
+		t.Errorf("%d RRSIG records left in the response", count)
+	}
+}
+
+func TestDnssecStripsAd(t *testing.T) {
+	tun := &Tun2socks{}
+	tun.SetDnsDnssec(DnsAdStrip, false)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.SetEdns0(1232, true)
+	_, received := dnssecExchange(t, tun, query, dns.TypeA)
+
+	if received.AuthenticatedData {
+		t.Error("AD bit not stripped")
+	}
+	if count := countRRs(received.Answer, dns.TypeRRSIG); count != 1 {
+		t.Errorf("%d RRSIG records in the response, want 1", count)
+	}
+}
+
+func TestDnssecDisabled(t *testing.T) {
+	tun := &Tun2socks{}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	app := newTestUDPPacket(packResponse(t, query), "10.0.0.2:40000", "172.19.0.2:53")
+	if packet := tun.withDnssec(app); packet != app {
+		t.Error("packet wrapped without DNSSEC options")
+	}
+}
@@ -0,0 +1,39 @@
+package libcore
+
+import (
+	"github.com/miekg/dns"
+	"sync/atomic"
+)
+
+// SetDnsMaxUdpSize caps the size of DNS responses returned over UDP, values
+// below 512 are raised to it. Larger responses have records removed and the
+// TC bit set, so the app retries the query over TCP where the full answer
+// is relayed unchanged. The cache keeps the full response. Zero disables it.
+func (t *Tun2socks) SetDnsMaxUdpSize(size int32) {
+	atomic.StoreInt32(&t.dnsMaxUdpSize, size)
+}
+
+func (t *Tun2socks) truncateDns(response []byte) []byte {
+	limit := int(atomic.LoadInt32(&t.dnsMaxUdpSize))
+	if limit <= 0 {
+		return response
+	}
+	if limit < dns.MinMsgSize {
+		limit = dns.MinMsgSize
+	}
+	if len(response) <= limit {
+		return response
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil || !msg.Response {
+		return response
+	}
+	msg.Truncate(limit)
+	packed, err := msg.Pack()
+	if err != nil || len(packed) > limit {
+		return response
+	}
+	atomic.AddUint32(&t.dnsTruncated, 1)
+	return packed
+}
@@ -0,0 +1,96 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"github.com/xjasonlyu/tun2socks/core"
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsSystemUpstream = "system"
+	dnsSystemTimeout  = 5 * time.Second
+)
+
+// SetSystemDns sets the resolvers of the underlying network, one ip[:port]
+// per line, as reported by its link properties. Queries sent to the
+// "system" upstream of SetDnsRoutes go to them over UDP by the protected
+// dialer instead of through the proxy, so names of bypassed destinations
+// are resolved the way the direct connections to them will be, and the
+// proxy upstream only sees the proxied ones. They are tried in order until
+// one answers. The app has to update them when the default network
+// changes. Empty clears them, the "system" routes then fall through to the
+// regular upstream.
+func (t *Tun2socks) SetSystemDns(servers string) error {
+	var parsed []v2rayNet.Destination
+	for _, server := range strings.Split(servers, "\n") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = server, dnsTcpPort
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid dns server %s", server)
+		}
+		dest, err := v2rayNet.ParseDestination("udp:" + net.JoinHostPort(host, port))
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, dest)
+	}
+	t.systemDns.Store(parsed)
+	return nil
+}
+
+// resolveSystemDns answers packet through the system resolvers, returns
+// false if none are set.
+func (t *Tun2socks) resolveSystemDns(packet core.UDPPacket, upstream string) bool {
+	servers, _ := t.systemDns.Load().([]v2rayNet.Destination)
+	if len(servers) == 0 {
+		return false
+	}
+	go func() {
+		defer packet.Drop()
+
+		for _, server := range servers {
+			response, err := exchangeSystemDns(server, packet.Data())
+			if err != nil {
+				log.Warnf("[DNS] query to %s failed: %s", server.NetAddr(), err.Error())
+				continue
+			}
+			_, _ = packet.WriteBack(t.answerDns(response, upstream), nil)
+			return
+		}
+	}()
+	return true
+}
+
+func exchangeSystemDns(server v2rayNet.Destination, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsSystemTimeout)
+	defer cancel()
+
+	conn, err := internet.DialSystem(ctx, server, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsSystemTimeout))
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 65535)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
@@ -0,0 +1,223 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/xjasonlyu/tun2socks/core"
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	v2rayCore "github.com/xtls/xray-core/core"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DnsModeCore = iota
+	DnsModeTls
+)
+
+const (
+	dnsTlsPort      = "853"
+	dnsTcpPort      = "53"
+	dnsTlsTimeout   = 10 * time.Second
+	dnsTlsIdleConns = 4
+)
+
+// dnsTlsResolver sends queries to a DNS-over-TLS server through the proxy,
+// keeping a few connections open for reuse. A plain resolver speaks DNS
+// over TCP without TLS.
+type dnsTlsResolver struct {
+	t          *Tun2socks
+	server     v2rayNet.Destination
+	serverName string
+	plain      bool
+
+	access sync.Mutex
+	idle   []net.Conn
+	closed bool
+}
+
+// SetDnsUpstream selects where hijacked queries are resolved. DnsModeCore
+// hands them to the "dns-in" inbound, so the servers of the V2Ray DNS
+// config answer them, DoH ones included. DnsModeTls sends them to server,
+// the host[:port] of a DNS-over-TLS resolver, over TLS connections dialed
+// through the proxy like app traffic and kept open between queries. The
+// answers are cached with their TTL either way.
+func (t *Tun2socks) SetDnsUpstream(mode int32, server string) error {
+	var resolver *dnsTlsResolver
+	switch mode {
+	case DnsModeCore:
+	case DnsModeTls:
+		var err error
+		resolver, err = t.newDnsResolver(server, false)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown dns mode %d", mode)
+	}
+
+	old, _ := t.dnsTls.Load().(*dnsTlsResolver)
+	t.dnsTls.Store(resolver)
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// newDnsResolver parses server, a host[:port], into a resolver using
+// DNS-over-TLS, or DNS over TCP if plain is set.
+func (t *Tun2socks) newDnsResolver(server string, plain bool) (*dnsTlsResolver, error) {
+	defaultPort := dnsTlsPort
+	if plain {
+		defaultPort = dnsTcpPort
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, defaultPort
+	}
+	dest, err := v2rayNet.ParseDestination("tcp:" + net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	return &dnsTlsResolver{t: t, server: dest, serverName: host, plain: plain}, nil
+}
+
+// resolveDnsTls answers packet through the DNS-over-TLS server if one is
+// set, returns false otherwise.
+func (t *Tun2socks) resolveDnsTls(packet core.UDPPacket) bool {
+	r, _ := t.dnsTls.Load().(*dnsTlsResolver)
+	if r == nil {
+		return false
+	}
+	go t.resolveWith(r, packet, DnsUpstreamTls)
+	return true
+}
+
+func (t *Tun2socks) resolveWith(r *dnsTlsResolver, packet core.UDPPacket, upstream string) {
+	defer packet.Drop()
+
+	response, err := r.exchange(packet.Data())
+	if err != nil {
+		log.Warnf("[DNS] query to %s failed: %s", r.server.NetAddr(), err.Error())
+		return
+	}
+	_, _ = packet.WriteBack(t.answerDns(response, upstream), nil)
+}
+
+func (r *dnsTlsResolver) exchange(query []byte) (response []byte, err error) {
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+
+	// an idle connection may have been closed by the server meanwhile, so
+	// a failure on one is retried on a new connection.
+	for {
+		conn, reused := r.get()
+		if conn == nil {
+			conn, err = r.dial()
+			if err != nil {
+				return nil, err
+			}
+		}
+		response, err = roundTrip(conn, message)
+		if err == nil {
+			r.put(conn)
+			return
+		}
+		_ = conn.Close()
+		if !reused {
+			return
+		}
+	}
+}
+
+func roundTrip(conn net.Conn, message []byte) ([]byte, error) {
+	// the connections of the core ignore deadlines
+	timer := time.AfterFunc(dnsTlsTimeout, func() {
+		_ = conn.Close()
+	})
+	defer timer.Stop()
+
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *dnsTlsResolver) dial() (net.Conn, error) {
+	instance, err := r.t.runningCore()
+	if err != nil {
+		return nil, err
+	}
+	// the connection lives as long as the context given to the core, so
+	// the handshake is bounded by closing it instead.
+	conn, err := v2rayCore.Dial(session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag: "socks",
+	}), instance, r.server)
+	if err != nil {
+		return nil, err
+	}
+	if r.plain {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: r.serverName,
+	})
+	timer := time.AfterFunc(dnsTlsTimeout, func() {
+		_ = conn.Close()
+	})
+	defer timer.Stop()
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (r *dnsTlsResolver) get() (net.Conn, bool) {
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	if len(r.idle) == 0 {
+		return nil, false
+	}
+	conn := r.idle[len(r.idle)-1]
+	r.idle = r.idle[:len(r.idle)-1]
+	return conn, true
+}
+
+func (r *dnsTlsResolver) put(conn net.Conn) {
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	if r.closed || len(r.idle) >= dnsTlsIdleConns {
+		_ = conn.Close()
+		return
+	}
+	r.idle = append(r.idle, conn)
+}
+
+func (r *dnsTlsResolver) close() {
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	for _, conn := range r.idle {
+		_ = conn.Close()
+	}
+	r.idle = nil
+	r.closed = true
+}
@@ -0,0 +1,53 @@
+package libcore
+
+import (
+	"github.com/miekg/dns"
+	"sync/atomic"
+)
+
+// SetDnsTTLRange clamps the TTL of every record in DNS responses, and the
+// SOA minimum used for negative caching, into [lower, upper] seconds before
+// they are cached or returned to apps. Zero leaves that bound unset.
+func (t *Tun2socks) SetDnsTTLRange(lower int32, upper int32) {
+	atomic.StoreInt32(&t.dnsMinTTL, lower)
+	atomic.StoreInt32(&t.dnsMaxTTL, upper)
+}
+
+func (t *Tun2socks) clampDnsTTL(response []byte) []byte {
+	lower := uint32(atomic.LoadInt32(&t.dnsMinTTL))
+	upper := uint32(atomic.LoadInt32(&t.dnsMaxTTL))
+	if lower == 0 && upper == 0 {
+		return response
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil || !msg.Response {
+		return response
+	}
+	clamp := func(ttl uint32) uint32 {
+		if lower > 0 && ttl < lower {
+			return lower
+		}
+		if upper > 0 && ttl > upper {
+			return upper
+		}
+		return ttl
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			header.Ttl = clamp(header.Ttl)
+			if soa, ok := rr.(*dns.SOA); ok {
+				soa.Minttl = clamp(soa.Minttl)
+			}
+		}
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+	return packed
+}
@@ -0,0 +1,134 @@
+package libcore
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func packResponse(t *testing.T, msg *dns.Msg) []byte {
+	t.Helper()
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func mustRR(t *testing.T, record string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestClampDnsTTL(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{
+		mustRR(t, "example.com. 5 IN A 192.0.2.1"),
+		mustRR(t, "example.com. 90000 IN A 192.0.2.2"),
+		mustRR(t, "example.com. 600 IN A 192.0.2.3"),
+	}
+	response.Ns = []dns.RR{mustRR(t, "example.com. 1 IN NS ns.example.com.")}
+	response.Extra = []dns.RR{mustRR(t, "ns.example.com. 100000 IN A 192.0.2.53")}
+	response.SetEdns0(1232, false)
+
+	tun := &Tun2socks{}
+	tun.SetDnsTTLRange(60, 3600)
+	clamped := new(dns.Msg)
+	if err := clamped.Unpack(tun.clampDnsTTL(packResponse(t, response))); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []uint32{60, 3600, 600} {
+		if ttl := clamped.Answer[i].Header().Ttl; ttl != want {
+			t.Errorf("answer %d ttl %d, want %d", i, ttl, want)
+		}
+	}
+	if ttl := clamped.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("authority ttl %d, want 60", ttl)
+	}
+	for _, rr := range clamped.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			if opt := rr.(*dns.OPT); opt.UDPSize() != 1232 {
+				t.Errorf("opt udp size %d changed", opt.UDPSize())
+			}
+			continue
+		}
+		if ttl := rr.Header().Ttl; ttl != 3600 {
+			t.Errorf("additional ttl %d, want 3600", ttl)
+		}
+	}
+}
+
+func TestClampDnsTTLNegative(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("missing.example.com.", dns.TypeA)
+
+	for _, test := range []struct {
+		name         string
+		lower, upper int32
+		soa          string
+		ttl, minimum uint32
+	}{
+		{"raised", 300, 0, "example.com. 10 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 30", 300, 300},
+		{"lowered", 0, 600, "example.com. 86400 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 86400", 600, 600},
+		{"in range", 60, 3600, "example.com. 900 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 120", 900, 120},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			response := new(dns.Msg)
+			response.SetRcode(query, dns.RcodeNameError)
+			response.Ns = []dns.RR{mustRR(t, test.soa)}
+
+			tun := &Tun2socks{}
+			tun.SetDnsTTLRange(test.lower, test.upper)
+			clamped := new(dns.Msg)
+			if err := clamped.Unpack(tun.clampDnsTTL(packResponse(t, response))); err != nil {
+				t.Fatal(err)
+			}
+			soa := clamped.Ns[0].(*dns.SOA)
+			if soa.Hdr.Ttl != test.ttl || soa.Minttl != test.minimum {
+				t.Fatalf("soa ttl %d minimum %d, want %d and %d", soa.Hdr.Ttl, soa.Minttl, test.ttl, test.minimum)
+			}
+		})
+	}
+}
+
+func TestClampDnsTTLUnset(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{mustRR(t, "example.com. 5 IN A 192.0.2.1")}
+	packed := packResponse(t, response)
+
+	tun := &Tun2socks{}
+	if clamped := tun.clampDnsTTL(packed); &clamped[0] != &packed[0] {
+		t.Fatal("response repacked without a range")
+	}
+}
+
+func TestClampDnsTTLBeforeCaching(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{mustRR(t, "example.com. 5 IN A 192.0.2.1")}
+
+	tun := &Tun2socks{}
+	tun.SetDnsCache(true)
+	tun.SetDnsTTLRange(300, 0)
+	tun.answerDns(packResponse(t, response), DnsUpstreamCore)
+
+	cached := new(dns.Msg)
+	if err := cached.Unpack(tun.dnsCache.lookup(packResponse(t, query))); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := cached.Answer[0].Header().Ttl; ttl < 299 {
+		t.Fatalf("cached ttl %d, want the clamped 300", ttl)
+	}
+}
@@ -0,0 +1,136 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// domainLimits holds the rate limits set per domain, each one shared by all
+// connections to the domain and its subdomains.
+type domainLimits struct {
+	access  sync.Mutex
+	domains map[string]*domainLimit
+}
+
+type domainLimit struct {
+	uplink   *rateLimiter
+	downlink *rateLimiter
+}
+
+// SetDomainRateLimit caps the total throughput of the connections to domain
+// and its subdomains in bytes per second for each direction, the most
+// specific domain set applies. Changes take effect on running connections
+// too, zero removes the limit. The domain is known from sniffing or
+// fakedns, so this requires sniffing, and TCP connections run unlimited
+// until their first payload is sniffed. The limit applies on top of the
+// global one, whichever is more restrictive wins.
+func (t *Tun2socks) SetDomainRateLimit(domain string, bytesPerSec int64) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	t.domainLimits.access.Lock()
+	defer t.domainLimits.access.Unlock()
+
+	limit := t.domainLimits.domains[domain]
+	if bytesPerSec <= 0 {
+		if limit != nil {
+			setRateLimit(limit.uplink, 0)
+			setRateLimit(limit.downlink, 0)
+			delete(t.domainLimits.domains, domain)
+		}
+		return
+	}
+	if limit == nil {
+		limit = &domainLimit{newRateLimiter(), newRateLimiter()}
+		if t.domainLimits.domains == nil {
+			t.domainLimits.domains = map[string]*domainLimit{}
+		}
+		t.domainLimits.domains[domain] = limit
+	}
+	setRateLimit(limit.uplink, bytesPerSec)
+	setRateLimit(limit.downlink, bytesPerSec)
+}
+
+// applyDomainLimit attaches the limit of the sniffed destination, a
+// host:port, to entry.
+func (t *Tun2socks) applyDomainLimit(entry *connEntry, sniffed string) {
+	host, _, err := net.SplitHostPort(sniffed)
+	if err != nil {
+		return
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	t.domainLimits.access.Lock()
+	defer t.domainLimits.access.Unlock()
+
+	if len(t.domainLimits.domains) == 0 {
+		return
+	}
+	for name := host; name != ""; {
+		if limit := t.domainLimits.domains[name]; limit != nil {
+			entry.rateLimit.Store(limit)
+			return
+		}
+		index := strings.IndexByte(name, '.')
+		if index < 0 {
+			break
+		}
+		name = name[index+1:]
+	}
+}
+
+func (e *connEntry) getRateLimit() *domainLimit {
+	limit, _ := e.rateLimit.Load().(*domainLimit)
+	return limit
+}
+
+type domainLimitedConn struct {
+	net.Conn
+	ctx   context.Context
+	entry *connEntry
+}
+
+func (c *domainLimitedConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if limit := c.entry.getRateLimit(); limit != nil {
+		if waitErr := waitRateLimit(c.ctx, limit.downlink, n); err == nil {
+			err = waitErr
+		}
+	}
+	return
+}
+
+func (c *domainLimitedConn) Write(b []byte) (n int, err error) {
+	if limit := c.entry.getRateLimit(); limit != nil {
+		if err = waitRateLimit(c.ctx, limit.uplink, len(b)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+type domainLimitedPacketConn struct {
+	net.PacketConn
+	ctx   context.Context
+	entry *connEntry
+}
+
+func (c *domainLimitedPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if limit := c.entry.getRateLimit(); limit != nil {
+		if waitErr := waitRateLimit(c.ctx, limit.downlink, n); err == nil {
+			err = waitErr
+		}
+	}
+	return
+}
+
+func (c *domainLimitedPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if limit := c.entry.getRateLimit(); limit != nil {
+		if err = waitRateLimit(c.ctx, limit.uplink, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
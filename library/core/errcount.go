@@ -0,0 +1,67 @@
+package libcore
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// countError counts err against the connection unless it is the normal end
+// of the relay. local tells the app side, the tun stack, from the remote
+// one through the core or the direct dialer.
+func (e *connEntry) countError(err error, write bool, local bool) {
+	if err == nil || err == io.EOF || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return
+	}
+	switch {
+	case local:
+		atomic.AddUint32(&e.localErrors, 1)
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || strings.Contains(err.Error(), "connection reset"):
+		atomic.AddUint32(&e.resets, 1)
+	case write:
+		atomic.AddUint32(&e.writeErrors, 1)
+	default:
+		atomic.AddUint32(&e.readErrors, 1)
+	}
+}
+
+// errorConn counts the failed reads and writes of a relayed connection.
+type errorConn struct {
+	net.Conn
+	entry *connEntry
+	local bool
+}
+
+func (c *errorConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.entry.countError(err, false, c.local)
+	return
+}
+
+func (c *errorConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.entry.countError(err, true, c.local)
+	return
+}
+
+type errorPacketConn struct {
+	net.PacketConn
+	entry *connEntry
+}
+
+func (c *errorPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	c.entry.countError(err, false, false)
+	return
+}
+
+func (c *errorPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	c.entry.countError(err, true, false)
+	return
+}
@@ -0,0 +1,38 @@
+package libcore
+
+import (
+	"context"
+	"github.com/xjasonlyu/tun2socks/log"
+	"github.com/xtls/xray-core/common/session"
+	"sync/atomic"
+)
+
+// SetFallbackTag sets the inbound tag a connection is dialed again with when
+// dialing through the core fails, so routing rules can send it to a backup
+// outbound. The core connects lazily, so this covers failures the core
+// reports at dial time, such as a missing or broken outbound, not servers
+// that turn out to be unreachable once data is sent. Empty disables it.
+func (t *Tun2socks) SetFallbackTag(tag string) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.fallbackTag = tag
+}
+
+// fallbackContext returns ctx with the inbound tag replaced by the fallback
+// tag, or false if there is none to retry with.
+func (t *Tun2socks) fallbackContext(ctx context.Context, network string, inbound *session.Inbound, err error) (context.Context, bool) {
+	t.access.Lock()
+	tag := t.fallbackTag
+	t.access.Unlock()
+
+	if tag == "" || tag == inbound.Tag {
+		return ctx, false
+	}
+	atomic.AddUint32(&t.fallbacks, 1)
+	log.Warnf("[%s] dial failed: %s, retrying with %s", network, err.Error(), tag)
+
+	fallback := *inbound
+	fallback.Tag = tag
+	return session.ContextWithInbound(ctx, &fallback), true
+}
@@ -0,0 +1,15 @@
+package libcore
+
+// faultPoint names a failure that tests built with the tunfaults tag can
+// force in Add and addPacket, see faults_inject.go. Without the tag the
+// hooks do nothing.
+type faultPoint int
+
+const (
+	// faultDial fails dialing the core, TCP and UDP alike.
+	faultDial faultPoint = iota
+	// faultWriteBack fails writing UDP responses back to the app.
+	faultWriteBack
+	// faultUidDump fails looking up the uid of a connection.
+	faultUidDump
+)
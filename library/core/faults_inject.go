@@ -0,0 +1,88 @@
+//go:build tunfaults
+// +build tunfaults
+
+package libcore
+
+import (
+	"github.com/xjasonlyu/tun2socks/core"
+	"net"
+	"sync"
+)
+
+// This file is only built with the tunfaults tag, it lets tests force the
+// failures of the error paths of Add and addPacket, such as the cleanup of
+// the NAT table and stats after a failed dial. The state is kept outside
+// of Tun2socks so builds without the tag carry nothing of it.
+
+type faultSet struct {
+	access sync.Mutex
+	faults map[faultPoint]*fault
+}
+
+type fault struct {
+	remaining int
+	err       error
+}
+
+var faultSets sync.Map
+
+// setFault makes the next count passes through point fail with err, or all
+// of them with a negative count. Zero clears the fault.
+func (t *Tun2socks) setFault(point faultPoint, count int, err error) {
+	value, _ := faultSets.LoadOrStore(t, &faultSet{faults: map[faultPoint]*fault{}})
+	set := value.(*faultSet)
+
+	set.access.Lock()
+	defer set.access.Unlock()
+
+	if count == 0 {
+		delete(set.faults, point)
+		return
+	}
+	set.faults[point] = &fault{remaining: count, err: err}
+}
+
+// clearFaults drops all faults of the tun.
+func (t *Tun2socks) clearFaults() {
+	faultSets.Delete(t)
+}
+
+func (t *Tun2socks) injectFault(point faultPoint) error {
+	value, ok := faultSets.Load(t)
+	if !ok {
+		return nil
+	}
+	set := value.(*faultSet)
+
+	set.access.Lock()
+	defer set.access.Unlock()
+
+	f := set.faults[point]
+	if f == nil {
+		return nil
+	}
+	if f.remaining > 0 {
+		f.remaining--
+		if f.remaining == 0 {
+			delete(set.faults, point)
+		}
+	}
+	return f.err
+}
+
+func (t *Tun2socks) withFaults(packet core.UDPPacket) core.UDPPacket {
+	return &faultyPacket{packet, t}
+}
+
+// faultyPacket fails the write backs while faultWriteBack is set.
+type faultyPacket struct {
+	core.UDPPacket
+	t *Tun2socks
+}
+
+func (p *faultyPacket) WriteBack(b []byte, addr net.Addr) (int, error) {
+	if err := p.t.injectFault(faultWriteBack); err != nil {
+		return 0, err
+	}
+	return p.UDPPacket.WriteBack(b, addr)
+}
@@ -0,0 +1,14 @@
+//go:build !tunfaults
+// +build !tunfaults
+
+package libcore
+
+import "github.com/xjasonlyu/tun2socks/core"
+
+func (t *Tun2socks) injectFault(point faultPoint) error {
+	return nil
+}
+
+func (t *Tun2socks) withFaults(packet core.UDPPacket) core.UDPPacket {
+	return packet
+}
@@ -0,0 +1,197 @@
+//go:build tunfaults
+// +build tunfaults
+
+package libcore
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected fault")
+
+// failOnce makes the next pass through point fail.
+func failOnce(t *testing.T, tun *Tun2socks, point faultPoint) {
+	tun.setFault(point, 1, errInjected)
+	t.Cleanup(tun.clearFaults)
+}
+
+// startUdpFaultTest runs a tun whose core relays every destination to a UDP
+// echo server.
+func startUdpFaultTest(t *testing.T) (*Tun2socks, *closedConns) {
+	t.Helper()
+	echo := startUdpEcho(t)
+	tun := startTestTun(t, startTestCore(t, domainRoutingConfig(echo.LocalAddr(), "blocked")))
+	closed := &closedConns{}
+	tun.SetConnectionCloseListener(closed)
+	return tun, closed
+}
+
+func waitClosed(t *testing.T, closed *closedConns) *Connection {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		closed.access.Lock()
+		count := len(closed.conns)
+		closed.access.Unlock()
+		if count > 0 {
+			return closed.only(t)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("connection not closed")
+	return nil
+}
+
+func natEntries(tun *Tun2socks) int {
+	var entries int
+	tun.udpTable.mapping.Range(func(interface{}, interface{}) bool {
+		entries++
+		return true
+	})
+	return entries
+}
+
+func checkReply(t *testing.T, packet *testUDPPacket) {
+	t.Helper()
+	select {
+	case reply := <-packet.written:
+		if string(reply) != string(packet.data) {
+			t.Errorf("reply %q, want %q", reply, packet.data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no reply to %q", packet.data)
+	}
+}
+
+func checkNoConns(t *testing.T, tun *Tun2socks) {
+	t.Helper()
+	if entries := tun.conns.list(); len(entries) != 0 {
+		t.Errorf("%d connections still registered", len(entries))
+	}
+}
+
+func TestFaultDialTcp(t *testing.T) {
+	tun, _, closed := startRelayTest(t)
+	failOnce(t, tun, faultDial)
+
+	app, peer := net.Pipe()
+	defer peer.Close()
+	relay(t, tun, app)
+
+	if conn := closed.only(t); conn.CloseReason != CloseReasonDialFailed {
+		t.Errorf("close reason = %q, want %q", conn.CloseReason, CloseReasonDialFailed)
+	}
+	if failures := atomic.LoadUint32(&tun.dialFailures); failures != 1 {
+		t.Errorf("dial failures = %d, want 1", failures)
+	}
+	checkNoConns(t, tun)
+	stats := tun.getAppStats(testUid)
+	if conns, total := atomic.LoadInt32(&stats.tcpConn), atomic.LoadUint32(&stats.tcpConnTotal); conns != 0 || total != 0 {
+		t.Errorf("tcpConn = %d, tcpConnTotal = %d after a failed dial, want 0", conns, total)
+	}
+}
+
+// A failed dial leaves neither a session nor its setup lock in the NAT
+// table, so the next packet of the flow sets up a session again.
+func TestFaultDialUdp(t *testing.T) {
+	tun, closed := startUdpFaultTest(t)
+	failOnce(t, tun, faultDial)
+
+	tun.AddPacket(newTestUDPPacket([]byte("hello"), "10.0.0.2:40000", "198.51.100.1:9"))
+	if conn := waitClosed(t, closed); conn.CloseReason != CloseReasonDialFailed {
+		t.Errorf("close reason = %q, want %q", conn.CloseReason, CloseReasonDialFailed)
+	}
+	if entries := natEntries(tun); entries != 0 {
+		t.Errorf("%d NAT table entries after a failed dial", entries)
+	}
+	checkNoConns(t, tun)
+	stats := tun.getAppStats(testUid)
+	if conns, total := atomic.LoadInt32(&stats.udpConn), atomic.LoadUint32(&stats.udpConnTotal); conns != 0 || total != 0 {
+		t.Errorf("udpConn = %d, udpConnTotal = %d after a failed dial, want 0", conns, total)
+	}
+
+	packet := newTestUDPPacket([]byte("world"), "10.0.0.2:40000", "198.51.100.1:9")
+	tun.AddPacket(packet)
+	checkReply(t, packet)
+	if total := atomic.LoadUint32(&stats.udpConnTotal); total != 1 {
+		t.Errorf("udpConnTotal = %d, want 1", total)
+	}
+}
+
+// A failed write back ends the session, the flow's next packet starts a new
+// one.
+func TestFaultWriteBack(t *testing.T) {
+	tun, closed := startUdpFaultTest(t)
+	failOnce(t, tun, faultWriteBack)
+
+	tun.AddPacket(newTestUDPPacket([]byte("hello"), "10.0.0.2:40000", "198.51.100.1:9"))
+	conn := waitClosed(t, closed)
+	if conn.CloseReason != CloseReasonClientClosed || conn.LocalErrors != 1 {
+		t.Errorf("close reason = %q, local errors = %d, want %q and 1", conn.CloseReason, conn.LocalErrors, CloseReasonClientClosed)
+	}
+	if entries := natEntries(tun); entries != 0 {
+		t.Errorf("%d NAT table entries after the session ended", entries)
+	}
+	checkNoConns(t, tun)
+	stats := tun.getAppStats(testUid)
+	if conns, total := atomic.LoadInt32(&stats.udpConn), atomic.LoadUint32(&stats.udpConnTotal); conns != 0 || total != 1 {
+		t.Errorf("udpConn = %d, udpConnTotal = %d, want 0 and 1", conns, total)
+	}
+
+	packet := newTestUDPPacket([]byte("world"), "10.0.0.2:40000", "198.51.100.1:9")
+	tun.AddPacket(packet)
+	checkReply(t, packet)
+}
+
+// Connections whose uid is unknown are relayed and counted without an app.
+func TestFaultUidDump(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		tun, _, closed := startRelayTest(t)
+		failOnce(t, tun, faultUidDump)
+
+		app, peer := net.Pipe()
+		_ = peer.Close()
+		relay(t, tun, app)
+
+		if conn := closed.only(t); conn.Uid != 0 || conn.CloseReason != CloseReasonClientClosed {
+			t.Errorf("uid = %d, close reason = %q, want 0 and %q", conn.Uid, conn.CloseReason, CloseReasonClientClosed)
+		}
+		checkUidDumpFailed(t, tun, func(stats *appStats) uint32 {
+			return atomic.LoadUint32(&stats.tcpConnTotal)
+		})
+	})
+	t.Run("udp", func(t *testing.T) {
+		tun, _ := startUdpFaultTest(t)
+		failOnce(t, tun, faultUidDump)
+
+		packet := newTestUDPPacket([]byte("hello"), "10.0.0.2:40000", "198.51.100.1:9")
+		tun.AddPacket(packet)
+		checkReply(t, packet)
+		if entries := tun.conns.list(); len(entries) != 1 || entries[0].uid != 0 {
+			t.Errorf("registered connections %+v, want one without uid", entries)
+		}
+		checkUidDumpFailed(t, tun, func(stats *appStats) uint32 {
+			return atomic.LoadUint32(&stats.udpConnTotal)
+		})
+	})
+}
+
+func checkUidDumpFailed(t *testing.T, tun *Tun2socks, total func(*appStats) uint32) {
+	t.Helper()
+	if failures := atomic.LoadUint32(&tun.uidFailures); failures != 1 {
+		t.Errorf("uid failures = %d, want 1", failures)
+	}
+	tun.access.Lock()
+	_, counted := tun.appStats[testUid]
+	tun.access.Unlock()
+	if counted {
+		t.Error("connection counted for the app")
+	}
+	if conns := total(tun.getAppStats(0)); conns != 1 {
+		t.Errorf("%d connections counted without uid, want 1", conns)
+	}
+}
@@ -0,0 +1,27 @@
+package libcore
+
+// ConnectionFilter decides whether a connection may be relayed. Allow is
+// called after the uid is resolved and before dialing, on the goroutine of
+// the connection, so it should return quickly.
+type ConnectionFilter interface {
+	Allow(c *Connection) bool
+}
+
+// SetConnectionFilter sets the filter consulted for every new connection of
+// other apps, a nil filter allows all. Refused TCP connections are handled
+// according to the block action and refused UDP packets are dropped. DNS
+// queries answered from the cache or by the DNS workers are not filtered.
+func (t *Tun2socks) SetConnectionFilter(filter ConnectionFilter) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.filter = filter
+}
+
+func (t *Tun2socks) allowConn(entry *connEntry) bool {
+	t.access.Lock()
+	filter := t.filter
+	t.access.Unlock()
+
+	return filter == nil || filter.Allow(entry.export())
+}
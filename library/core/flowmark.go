@@ -0,0 +1,115 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	flowMarkTimeout   = 10 * time.Second
+	flowMarkSweepSize = 1024
+	flowMarkSweepWait = time.Second
+	flowMarkLimit     = 4096
+)
+
+// flowMarks keeps a byte of the first packet of a flow, such as its TOS or
+// TTL, until the relay of the flow takes it. Flows that never get a relay,
+// blocked ones for example, leave their mark behind, so marks expire and
+// the table is swept once it grows.
+type flowMarks struct {
+	access  sync.Mutex
+	marks   map[string]flowMark
+	sweptAt time.Time
+}
+
+type flowMark struct {
+	value    byte
+	storedAt time.Time
+}
+
+// put marks the flow of key with value unless it is marked already.
+func (m *flowMarks) put(key string, value byte) {
+	m.access.Lock()
+	defer m.access.Unlock()
+
+	now := time.Now()
+	if mark, ok := m.marks[key]; ok && now.Sub(mark.storedAt) < flowMarkTimeout {
+		return
+	}
+	if m.marks == nil {
+		m.marks = map[string]flowMark{}
+	}
+	if len(m.marks) >= flowMarkSweepSize {
+		if now.Sub(m.sweptAt) >= flowMarkSweepWait {
+			m.sweep(now)
+		}
+		if len(m.marks) >= flowMarkLimit {
+			return
+		}
+	}
+	m.marks[key] = flowMark{value, now}
+}
+
+func (m *flowMarks) sweep(now time.Time) {
+	m.sweptAt = now
+	for k, mark := range m.marks {
+		if now.Sub(mark.storedAt) >= flowMarkTimeout {
+			delete(m.marks, k)
+		}
+	}
+}
+
+// take removes the mark of key and returns it if it has not expired.
+func (m *flowMarks) take(key string) (byte, bool) {
+	m.access.Lock()
+	defer m.access.Unlock()
+
+	mark, ok := m.marks[key]
+	if !ok {
+		return 0, false
+	}
+	delete(m.marks, key)
+	if time.Since(mark.storedAt) >= flowMarkTimeout {
+		return 0, false
+	}
+	return mark.value, true
+}
+
+func (m *flowMarks) forget(key string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+
+	delete(m.marks, key)
+}
+
+func (m *flowMarks) size() int {
+	m.access.Lock()
+	defer m.access.Unlock()
+
+	return len(m.marks)
+}
+
+// flowStart returns the network and source of packet if it opens a flow: a
+// TCP SYN, or a UDP packet from a source without a session yet.
+func (t *Tun2socks) flowStart(packet []byte) (network string, source string, ok bool) {
+	network, source, _, ok = packetEndpoints(packet)
+	if !ok {
+		return
+	}
+	if network == "udp" {
+		ok = t.udpTable.session(source) == nil
+		return
+	}
+	var header int
+	if packet[0]>>4 == 4 {
+		header = int(packet[0]&0x0f) * 4
+	} else {
+		header = 40
+	}
+	if len(packet) < header+14 {
+		return "", "", false
+	}
+	flags := packet[header+13]
+	ok = flags&0x02 != 0 && flags&0x10 == 0
+	return
+}
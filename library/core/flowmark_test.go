@@ -0,0 +1,130 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// ipv4Packet builds an IPv4 packet of protocol from src to dst with a
+// transport header of which only the ports and flags are filled in.
+func ipv4Packet(protocol byte, src, dst string, srcPort, dstPort uint16, flags byte) []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = protocol
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(packet[20:], srcPort)
+	binary.BigEndian.PutUint16(packet[22:], dstPort)
+	packet[33] = flags
+	return packet
+}
+
+func TestFlowStart(t *testing.T) {
+	tun := &Tun2socks{udpTable: &natTable{}}
+	tun.udpTable.Set("172.19.0.1:5000", &natSession{entry: &connEntry{}})
+
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		start  bool
+	}{
+		{"tcp syn", ipv4Packet(6, "172.19.0.1", "192.0.2.1", 4000, 443, 0x02), true},
+		{"tcp syn ack", ipv4Packet(6, "172.19.0.1", "192.0.2.1", 4000, 443, 0x12), false},
+		{"tcp ack", ipv4Packet(6, "172.19.0.1", "192.0.2.1", 4000, 443, 0x10), false},
+		{"tcp fin", ipv4Packet(6, "172.19.0.1", "192.0.2.1", 4000, 443, 0x11), false},
+		{"udp without session", ipv4Packet(17, "172.19.0.1", "192.0.2.1", 4000, 443, 0), true},
+		{"udp with session", ipv4Packet(17, "172.19.0.1", "192.0.2.1", 5000, 443, 0), false},
+		{"icmp", ipv4Packet(1, "172.19.0.1", "192.0.2.1", 0, 0, 0), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, start := tun.flowStart(test.packet); start != test.start {
+				t.Fatalf("flow start %v, want %v", start, test.start)
+			}
+		})
+	}
+}
+
+func TestFlowMarks(t *testing.T) {
+	var marks flowMarks
+	marks.put("tcp:a", 1)
+	marks.put("tcp:a", 2)
+	if value, ok := marks.take("tcp:a"); !ok || value != 1 {
+		t.Fatalf("took %d, %v, want the first mark", value, ok)
+	}
+	if _, ok := marks.take("tcp:a"); ok {
+		t.Fatal("mark taken twice")
+	}
+
+	marks.put("tcp:b", 3)
+	marks.marks["tcp:b"] = flowMark{3, time.Now().Add(-flowMarkTimeout)}
+	if _, ok := marks.take("tcp:b"); ok {
+		t.Fatal("expired mark taken")
+	}
+
+	marks.put("tcp:c", 4)
+	marks.forget("tcp:c")
+	if marks.size() != 0 {
+		t.Fatalf("%d marks left", marks.size())
+	}
+}
+
+func TestFlowMarksBounded(t *testing.T) {
+	var marks flowMarks
+	for i := 0; i < flowMarkLimit*2; i++ {
+		marks.put("udp:"+strconv.Itoa(i), 1)
+	}
+	if marks.size() > flowMarkLimit {
+		t.Fatalf("%d marks kept, limit %d", marks.size(), flowMarkLimit)
+	}
+
+	for key := range marks.marks {
+		marks.marks[key] = flowMark{1, time.Now().Add(-flowMarkTimeout)}
+	}
+	marks.sweptAt = time.Time{}
+	marks.put("udp:fresh", 1)
+	if marks.size() != 1 {
+		t.Fatalf("%d marks kept after the sweep, want only the fresh one", marks.size())
+	}
+}
+
+func TestInspectTosFlowStartOnly(t *testing.T) {
+	tun := &Tun2socks{udpTable: &natTable{}}
+	tun.SetPreserveTos(true)
+
+	packet := ipv4Packet(6, "172.19.0.1", "192.0.2.1", 4000, 443, 0x10)
+	packet[1] = 0xb8
+	tun.inspectTos(packet)
+	if tun.tosMarks.size() != 0 {
+		t.Fatal("tos recorded for a packet in the middle of a flow")
+	}
+
+	packet[33] = 0x02
+	tun.inspectTos(packet)
+	if tos, ok := tun.tosMarks.take("tcp:172.19.0.1:4000"); !ok || tos != 0xb8 {
+		t.Fatalf("tos %#x, %v, want 0xb8", tos, ok)
+	}
+}
+
+func TestInspectTtlFlowStartOnly(t *testing.T) {
+	tun := &Tun2socks{udpTable: &natTable{}}
+	tun.SetPreserveTtl(true)
+	tun.udpTable.Set("172.19.0.1:5000", &natSession{entry: &connEntry{}})
+
+	packet := ipv4Packet(17, "172.19.0.1", "192.0.2.1", 5000, 53, 0)
+	packet[8] = 3
+	tun.inspectTtl(packet)
+	if tun.ttlMarks.size() != 0 {
+		t.Fatal("ttl recorded for a udp source with a session")
+	}
+
+	binary.BigEndian.PutUint16(packet[20:], 5001)
+	tun.inspectTtl(packet)
+	if ttl, ok := tun.ttlMarks.take("udp:172.19.0.1:5001"); !ok || ttl != 3 {
+		t.Fatalf("ttl %d, %v, want 3", ttl, ok)
+	}
+}
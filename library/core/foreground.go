@@ -0,0 +1,65 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const appStatusRecentlyForeground = "recently-foreground"
+
+var (
+	foregroundGrace int64
+
+	backgroundedAccess sync.Mutex
+	backgroundedAt     = map[uint16]time.Time{}
+)
+
+// SetForegroundGracePeriod keeps treating an app as foreground for seconds
+// after it left the foreground, so briefly switching apps does not move a
+// stream to background routing. Such connections carry "foreground" along
+// with "recently-foreground". Zero disables it.
+func SetForegroundGracePeriod(seconds int32) {
+	atomic.StoreInt64(&foregroundGrace, int64(time.Duration(seconds)*time.Second))
+}
+
+// leaveForeground records that old was replaced by uid as a foreground app.
+func leaveForeground(old uint16, uid uint16) {
+	if old == uid {
+		return
+	}
+	backgroundedAccess.Lock()
+	defer backgroundedAccess.Unlock()
+
+	delete(backgroundedAt, uid)
+	if old != 0 {
+		backgroundedAt[old] = time.Now()
+	}
+}
+
+func recentlyForeground(uid uint16) bool {
+	grace := time.Duration(atomic.LoadInt64(&foregroundGrace))
+	if grace <= 0 {
+		return false
+	}
+	backgroundedAccess.Lock()
+	defer backgroundedAccess.Unlock()
+
+	at, ok := backgroundedAt[uid]
+	if ok && time.Since(at) > grace {
+		delete(backgroundedAt, uid)
+		return false
+	}
+	return ok
+}
+
+func appStatus(uid uint16) []string {
+	switch {
+	case uid == foregroundUid || uid == foregroundImeUid:
+		return []string{appStatusForeground}
+	case recentlyForeground(uid):
+		return []string{appStatusForeground, appStatusRecentlyForeground}
+	default:
+		return []string{appStatusBackground}
+	}
+}
@@ -14,6 +14,8 @@ require (
 	github.com/xjasonlyu/tun2socks v1.18.4-0.20210813034434-85cf694b8fed
 	github.com/xtls/xray-core v1.4.2
 	golang.org/x/sys v0.0.0-20210823070655-63515b42dcdf
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
+	gvisor.dev/gvisor v0.0.0-20210813013607-83f71d012799
 )
 
 replace github.com/Dreamacro/clash v1.6.5 => github.com/ClashDotNetFramework/experimental-clash v1.7.2
@@ -0,0 +1,23 @@
+package libcore
+
+const (
+	icmpBurst = 50
+	icmpLimit = 1000
+)
+
+// SetIcmpEchoReply controls whether the stack answers ICMP echo requests
+// locally. Xray has no ICMP outbound, so pings can't be tunneled and a
+// local reply is only useful as a reachability check of the tun itself.
+// Disabling it also silences other ICMP messages generated by the stack.
+func (t *Tun2socks) SetIcmpEchoReply(enabled bool) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if enabled {
+		t.stack.SetICMPLimit(icmpLimit)
+		t.stack.SetICMPBurst(icmpBurst)
+	} else {
+		t.stack.SetICMPLimit(0)
+		t.stack.SetICMPBurst(0)
+	}
+}
@@ -0,0 +1,23 @@
+package libcore
+
+import (
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"sync/atomic"
+)
+
+// SetDisableIPv6 fails connections to IPv6 destinations locally instead of
+// letting them time out through the proxy on networks with broken IPv6.
+// action is BlockActionReject or BlockActionDrop and applies to TCP, UDP
+// packets are always dropped. DNS queries are still answered by the core.
+func (t *Tun2socks) SetDisableIPv6(disable bool, action int32) {
+	atomic.StoreInt32(&t.ipv6Action, action)
+	if disable {
+		atomic.StoreInt32(&t.disableIPv6, 1)
+	} else {
+		atomic.StoreInt32(&t.disableIPv6, 0)
+	}
+}
+
+func (t *Tun2socks) ipv6Blocked(dest v2rayNet.Destination) bool {
+	return atomic.LoadInt32(&t.disableIPv6) == 1 && dest.Address.Family().IsIPv6()
+}
@@ -0,0 +1,126 @@
+package libcore
+
+import (
+	"errors"
+	"fmt"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	LanPolicyProxy = iota
+	LanPolicyDirect
+	LanPolicyBlock
+)
+
+var lanNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"169.254.0.0/16",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// SetLanPolicy sets how connections to private and link-local destinations
+// are handled, one of LanPolicyProxy, LanPolicyDirect or LanPolicyBlock.
+// Direct connections bypass the core and are dialed by the protected dialer.
+func (t *Tun2socks) SetLanPolicy(policy int32) {
+	atomic.StoreInt32(&t.lanPolicy, policy)
+}
+
+// SetBypassDestinations keeps the destinations in cidrs, separated by
+// newlines, out of the proxy. Each is an IPv4 or IPv6 CIDR or a single
+// address, and policy is LanPolicyDirect or LanPolicyBlock. The list is
+// checked before the LAN policy, an empty one clears it.
+func (t *Tun2socks) SetBypassDestinations(cidrs string, policy int32) error {
+	if policy != LanPolicyDirect && policy != LanPolicyBlock {
+		return fmt.Errorf("invalid bypass policy %d", policy)
+	}
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(cidrs, "\n") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("invalid address %s", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, network)
+	}
+
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.bypassNetworks = networks
+	t.bypassPolicy = policy
+	return nil
+}
+
+func (t *Tun2socks) destinationPolicy(dest v2rayNet.Destination) int32 {
+	if !dest.Address.Family().IsIP() {
+		return LanPolicyProxy
+	}
+	ip := dest.Address.IP()
+
+	t.access.Lock()
+	bypass, bypassPolicy := t.bypassNetworks, t.bypassPolicy
+	t.access.Unlock()
+	for _, network := range bypass {
+		if network.Contains(ip) {
+			return bypassPolicy
+		}
+	}
+
+	policy := atomic.LoadInt32(&t.lanPolicy)
+	if policy == LanPolicyProxy {
+		return LanPolicyProxy
+	}
+	for _, network := range lanNetworks {
+		if network.Contains(ip) {
+			return policy
+		}
+	}
+	return LanPolicyProxy
+}
+
+// directPacketConn adapts a connected UDP socket to the relay, which only
+// ever writes to the destination the flow was opened for.
+type directPacketConn struct {
+	net.Conn
+	dest net.Addr
+}
+
+func (c *directPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, err = c.Conn.Read(p)
+	return n, c.dest, err
+}
+
+func (c *directPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if addr.String() != c.dest.String() {
+		return 0, errors.New("direct udp session to " + c.dest.String() + " can not reach " + addr.String())
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,98 @@
+package libcore
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var latencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// latencyHistogram counts durations into buckets. It is only used through
+// a pointer so its 64-bit counters stay aligned.
+type latencyHistogram struct {
+	sum     int64
+	count   uint64
+	bounds  []time.Duration
+	buckets []uint64
+}
+
+func newLatencyHistogram(bounds []time.Duration) *latencyHistogram {
+	return &latencyHistogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *latencyHistogram) observe(latency time.Duration) {
+	for i, bound := range h.bounds {
+		if latency <= bound {
+			atomic.AddUint64(&h.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&h.sum, int64(latency))
+	atomic.AddUint64(&h.count, 1)
+}
+
+func (h *latencyHistogram) write(b *strings.Builder, name string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		fmt.Fprintf(b, "%s_bucket{le=\"%g\"} %d\n", name, bound.Seconds(), cumulative)
+	}
+	count := atomic.LoadUint64(&h.count)
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(b, "%s_sum %g\n", name, time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+	fmt.Fprintf(b, "%s_count %d\n", name, count)
+}
+
+// recordLatency is called on the first response from the destination. The
+// core connects lazily, so the time from accepting the connection to that
+// response is what covers the proxy handshake, dialing alone does not.
+func (t *Tun2socks) recordLatency(entry *connEntry) {
+	latency := time.Since(entry.startedAt)
+	atomic.StoreInt64(&entry.latency, int64(latency))
+	t.latency.observe(latency)
+}
+
+// latencyConn calls onResponse once the first byte is read.
+type latencyConn struct {
+	net.Conn
+	once       sync.Once
+	onResponse func()
+}
+
+func (c *latencyConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(c.onResponse)
+	}
+	return
+}
+
+type latencyPacketConn struct {
+	net.PacketConn
+	once       sync.Once
+	onResponse func()
+}
+
+func (c *latencyPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.once.Do(c.onResponse)
+	}
+	return
+}
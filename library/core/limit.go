@@ -0,0 +1,58 @@
+package libcore
+
+import "sync/atomic"
+
+type connLimit struct {
+	maxTCP int
+	maxUDP int
+}
+
+// SetUidConnLimit caps the number of active TCP and UDP sessions for uid,
+// zero means unlimited. Limits are enforced on top of the traffic stats,
+// so they only take effect when trafficStats is enabled.
+func (t *Tun2socks) SetUidConnLimit(uid int32, maxTCP int, maxUDP int) {
+	if uid < 10000 {
+		uid = 1000
+	}
+
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if maxTCP <= 0 && maxUDP <= 0 {
+		delete(t.connLimits, uint16(uid))
+		return
+	}
+	if t.connLimits == nil {
+		t.connLimits = map[uint16]connLimit{}
+	}
+	t.connLimits[uint16(uid)] = connLimit{maxTCP, maxUDP}
+}
+
+func (t *Tun2socks) uidConnLimit(uid uint16, udp bool) int {
+	t.access.Lock()
+	limit, ok := t.connLimits[uid]
+	t.access.Unlock()
+
+	if !ok {
+		return 0
+	}
+	if udp {
+		return limit.maxUDP
+	}
+	return limit.maxTCP
+}
+
+// reserveConn takes a slot in the active count at conns, failing once it
+// reaches limit, zero means unlimited. The slot is taken before the dial so
+// a burst of connections can not all pass the check at once.
+func reserveConn(conns *int32, limit int) bool {
+	for {
+		active := atomic.LoadInt32(conns)
+		if limit > 0 && int(active) >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(conns, active, active+1) {
+			return true
+		}
+	}
+}
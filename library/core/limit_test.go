@@ -0,0 +1,36 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReserveConnConcurrent(t *testing.T) {
+	const limit = 8
+	var conns int32
+	var reserved int32
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveConn(&conns, limit) {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != limit || conns != limit {
+		t.Fatalf("reserved %d slots, count %d, want %d", reserved, conns, limit)
+	}
+}
+
+func TestReserveConnUnlimited(t *testing.T) {
+	var conns int32
+	for i := 0; i < 100; i++ {
+		if !reserveConn(&conns, 0) {
+			t.Fatalf("reservation %d refused without a limit", i)
+		}
+	}
+}
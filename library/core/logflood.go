@@ -0,0 +1,79 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+)
+
+// logLimiter collapses the repeats of an error into periodic summaries, so
+// a dead proxy does not flood the log with a line per connection.
+type logLimiter struct {
+	access     sync.Mutex
+	burst      int
+	window     time.Duration
+	categories map[string]*logCategory
+}
+
+type logCategory struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// SetLogRateLimit limits the repetitive error lines of failed dials and
+// unparsable addresses to burst per window milliseconds for each kind. The
+// lines over it are dropped and counted, and a summary such as "[TCP] dial
+// failed 500 more times in the last 10s" is logged once the window ends.
+// Counters are unaffected. Zero burst or window logs every line.
+func (t *Tun2socks) SetLogRateLimit(burst int32, window int32) {
+	t.logLimiter.access.Lock()
+	defer t.logLimiter.access.Unlock()
+
+	t.logLimiter.burst = int(burst)
+	t.logLimiter.window = time.Duration(window) * time.Millisecond
+	t.logLimiter.categories = nil
+}
+
+// logLimited logs with logf unless category, which prefixes its summary,
+// is over the limit.
+func (t *Tun2socks) logLimited(category string, logf func(format string, args ...interface{}), format string, args ...interface{}) {
+	l := &t.logLimiter
+	l.access.Lock()
+	if l.burst <= 0 || l.window <= 0 {
+		l.access.Unlock()
+		logf(format, args...)
+		return
+	}
+
+	now := time.Now()
+	c := l.categories[category]
+	if c == nil {
+		if l.categories == nil {
+			l.categories = map[string]*logCategory{}
+		}
+		c = &logCategory{start: now}
+		l.categories[category] = c
+	} else if now.Sub(c.start) >= l.window {
+		c.start, c.count = now, 0
+	}
+	c.count++
+	if c.count <= l.burst {
+		l.access.Unlock()
+		logf(format, args...)
+		return
+	}
+	c.suppressed++
+	if c.suppressed == 1 {
+		window := l.window
+		time.AfterFunc(c.start.Add(window).Sub(now), func() {
+			l.access.Lock()
+			suppressed := c.suppressed
+			c.suppressed = 0
+			l.access.Unlock()
+			if suppressed > 0 {
+				logf("%s %d more times in the last %s", category, suppressed, window)
+			}
+		})
+	}
+	l.access.Unlock()
+}
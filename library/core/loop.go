@@ -0,0 +1,48 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	loopDetectWindow    = 10 * time.Second
+	loopDetectThreshold = 16
+)
+
+// loopDetector tracks connections opened by our own uid. Session context
+// does not survive a round trip through the tun, so a relay loop can only
+// be seen as the proxy process repeatedly connecting to the same destination.
+type loopDetector struct {
+	access sync.Mutex
+	hits   map[string]*loopHit
+}
+
+type loopHit struct {
+	count int
+	since time.Time
+}
+
+func (d *loopDetector) check(dest string) bool {
+	d.access.Lock()
+	defer d.access.Unlock()
+
+	now := time.Now()
+	if d.hits == nil {
+		d.hits = map[string]*loopHit{}
+	} else if len(d.hits) > 256 {
+		for key, hit := range d.hits {
+			if now.Sub(hit.since) > loopDetectWindow {
+				delete(d.hits, key)
+			}
+		}
+	}
+
+	hit := d.hits[dest]
+	if hit == nil || now.Sub(hit.since) > loopDetectWindow {
+		hit = &loopHit{since: now}
+		d.hits[dest] = hit
+	}
+	hit.count++
+	return hit.count > loopDetectThreshold
+}
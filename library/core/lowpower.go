@@ -0,0 +1,68 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// statsBatchSize is how many bytes a connection counts on its own in low
+// power mode before adding them to the counters of its app.
+const statsBatchSize = 64 << 10
+
+// SetLowPowerStats trades the accuracy of the per-app traffic stats for
+// fewer wakeups, for the app to enable on battery saver. While enabled the
+// listener set by SetStatsListener is called every interval milliseconds
+// at most, or its own interval if longer, and only with the apps that had
+// traffic since the last update. Connections add their traffic to the
+// counters of their app every 64 KiB instead of on every read and write,
+// so the stats lag behind by up to that much per open connection and
+// direction until it is closed. Connections opened before the switch keep
+// counting the way they started.
+func (t *Tun2socks) SetLowPowerStats(enabled bool, interval int32) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if enabled {
+		atomic.StoreInt32(&t.lowPowerStats, 1)
+		t.lowPowerInterval = time.Duration(interval) * time.Millisecond
+	} else {
+		atomic.StoreInt32(&t.lowPowerStats, 0)
+		t.lowPowerInterval = 0
+	}
+	t.restartStatsLoop()
+}
+
+// newStatsCounter counts into total and proto, in batches when low power
+// stats are enabled.
+func (t *Tun2socks) newStatsCounter(total *uint64, proto *uint64) *statsCounter {
+	counter := &statsCounter{total: total, proto: proto}
+	if atomic.LoadInt32(&t.lowPowerStats) == 1 {
+		counter.batch = statsBatchSize
+	}
+	return counter
+}
+
+type statsCounter struct {
+	total   *uint64
+	proto   *uint64
+	batch   uint64
+	pending uint64
+}
+
+func (c *statsCounter) add(n int) {
+	if c.batch == 0 {
+		atomic.AddUint64(c.total, uint64(n))
+		atomic.AddUint64(c.proto, uint64(n))
+		return
+	}
+	if atomic.AddUint64(&c.pending, uint64(n)) >= c.batch {
+		c.flush()
+	}
+}
+
+func (c *statsCounter) flush() {
+	if pending := atomic.SwapUint64(&c.pending, 0); pending > 0 {
+		atomic.AddUint64(c.total, pending)
+		atomic.AddUint64(c.proto, pending)
+	}
+}
@@ -0,0 +1,168 @@
+package libcore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// SetMetricsPackageLabel adds the package name of each uid as a label to
+// the per-app metrics, which is off by default to keep cardinality low.
+func (t *Tun2socks) SetMetricsPackageLabel(enabled bool) {
+	t.access.Lock()
+	t.metricsPackage = enabled
+	t.access.Unlock()
+}
+
+// PrometheusMetrics renders the traffic counters in the Prometheus text
+// exposition format. Unlike ReadAppTraffics it does not reset the deltas.
+// The per-app series have no unlabelled total, sum() them for the tun.
+func (t *Tun2socks) PrometheusMetrics() string {
+	type appMetric struct {
+		uid      uint16
+		labels   string
+		uplink   uint64
+		downlink uint64
+		tcpConn  int32
+		udpConn  int32
+		tcpTotal uint32
+		udpTotal uint32
+	}
+
+	var apps []appMetric
+	t.access.Lock()
+	withPackage := t.metricsPackage
+	for uid, stat := range t.appStats {
+		apps = append(apps, appMetric{
+			uid:      uid,
+			labels:   fmt.Sprintf(`uid="%d"`, uid),
+			uplink:   atomic.LoadUint64(&stat.uplinkTotal) + atomic.LoadUint64(&stat.uplink),
+			downlink: atomic.LoadUint64(&stat.downlinkTotal) + atomic.LoadUint64(&stat.downlink),
+			tcpConn:  atomic.LoadInt32(&stat.tcpConn),
+			udpConn:  atomic.LoadInt32(&stat.udpConn),
+			tcpTotal: atomic.LoadUint32(&stat.tcpConnTotal),
+			udpTotal: atomic.LoadUint32(&stat.udpConnTotal),
+		})
+	}
+	t.access.Unlock()
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].uid < apps[j].uid
+	})
+	if dumper := loadUidDumper(); withPackage && len(dumper) > 0 {
+		for i := range apps {
+			if info, err := dumper.GetUidInfo(int32(apps[i].uid)); err == nil && info != nil {
+				apps[i].labels += fmt.Sprintf(`,package="%s"`, escapeLabel(info.PackageName))
+			}
+		}
+	}
+
+	var b strings.Builder
+
+	writeHeader(&b, "libcore_uplink_bytes_total", "counter", "Bytes sent through the tun.")
+	for _, app := range apps {
+		fmt.Fprintf(&b, "libcore_uplink_bytes_total{%s} %d\n", app.labels, app.uplink)
+	}
+
+	writeHeader(&b, "libcore_downlink_bytes_total", "counter", "Bytes received through the tun.")
+	for _, app := range apps {
+		fmt.Fprintf(&b, "libcore_downlink_bytes_total{%s} %d\n", app.labels, app.downlink)
+	}
+
+	writeHeader(&b, "libcore_active_conns", "gauge", "Relayed connections currently open.")
+	for _, app := range apps {
+		fmt.Fprintf(&b, "libcore_active_conns{%s,network=\"tcp\"} %d\n", app.labels, app.tcpConn)
+		fmt.Fprintf(&b, "libcore_active_conns{%s,network=\"udp\"} %d\n", app.labels, app.udpConn)
+	}
+
+	writeHeader(&b, "libcore_conns_total", "counter", "Relayed connections opened.")
+	for _, app := range apps {
+		fmt.Fprintf(&b, "libcore_conns_total{%s,network=\"tcp\"} %d\n", app.labels, app.tcpTotal)
+		fmt.Fprintf(&b, "libcore_conns_total{%s,network=\"udp\"} %d\n", app.labels, app.udpTotal)
+	}
+
+	writeHeader(&b, "libcore_dns_queries_total", "counter", "DNS queries handled by the tun.")
+	fmt.Fprintf(&b, "libcore_dns_queries_total %d\n", atomic.LoadUint32(&t.dnsQueries))
+
+	writeHeader(&b, "libcore_dns_dropped_total", "counter", "DNS queries dropped by the rate limiter.")
+	fmt.Fprintf(&b, "libcore_dns_dropped_total %d\n", atomic.LoadUint32(&t.dnsDropped))
+
+	writeHeader(&b, "libcore_dns_truncated_total", "counter", "DNS responses truncated to fit over UDP.")
+	fmt.Fprintf(&b, "libcore_dns_truncated_total %d\n", atomic.LoadUint32(&t.dnsTruncated))
+
+	writeHeader(&b, "libcore_dns_mirror_mismatches_total", "counter", "DNS answers that disagreed with the mirror resolver.")
+	fmt.Fprintf(&b, "libcore_dns_mirror_mismatches_total %d\n", atomic.LoadUint32(&t.dnsMismatches))
+
+	writeHeader(&b, "libcore_udp_dropped_total", "counter", "UDP packets dropped waiting for their session.")
+	fmt.Fprintf(&b, "libcore_udp_dropped_total %d\n", atomic.LoadUint32(&t.udpDropped))
+
+	writeHeader(&b, "libcore_udp_setup_wait_seconds", "histogram", "Time UDP packets waited for another packet of their flow to set up its session.")
+	t.udpSetupWait.write(&b, "libcore_udp_setup_wait_seconds")
+
+	writeHeader(&b, "libcore_udp_downlink_dropped_total", "counter", "UDP packets dropped because the app fell behind.")
+	fmt.Fprintf(&b, "libcore_udp_downlink_dropped_total %d\n", atomic.LoadUint32(&t.udpDownlinkDropped))
+
+	writeHeader(&b, "libcore_pmtu_rejected_total", "counter", "UDP packets answered with ICMP for exceeding the path MTU.")
+	fmt.Fprintf(&b, "libcore_pmtu_rejected_total %d\n", atomic.LoadUint32(&t.pmtuRejected))
+
+	writeHeader(&b, "libcore_startup_held_total", "counter", "Connections held by the startup grace before the tun was ready.")
+	fmt.Fprintf(&b, "libcore_startup_held_total %d\n", atomic.LoadUint32(&t.startupHeld))
+
+	writeHeader(&b, "libcore_core_not_running_total", "counter", "Connections failed for want of a running core.")
+	fmt.Fprintf(&b, "libcore_core_not_running_total %d\n", atomic.LoadUint32(&t.coreNotRunning))
+
+	writeHeader(&b, "libcore_dns_conn_queued_total", "counter", "DNS connections that waited for a free slot.")
+	fmt.Fprintf(&b, "libcore_dns_conn_queued_total %d\n", atomic.LoadUint32(&t.dnsConnQueued))
+
+	writeHeader(&b, "libcore_dns_conn_dropped_total", "counter", "DNS connections dropped for want of a free slot.")
+	fmt.Fprintf(&b, "libcore_dns_conn_dropped_total %d\n", atomic.LoadUint32(&t.dnsConnDropped))
+
+	writeHeader(&b, "libcore_mtu_write_failures_total", "counter", "Writes to the device that failed for the packet size.")
+	fmt.Fprintf(&b, "libcore_mtu_write_failures_total %d\n", atomic.LoadUint32(&t.mtuWriteFailures))
+
+	writeHeader(&b, "libcore_router_blocked_total", "counter", "Connections to the router address on ports other than 53 that were blocked.")
+	fmt.Fprintf(&b, "libcore_router_blocked_total %d\n", atomic.LoadUint32(&t.routerBlockedCount))
+
+	writeHeader(&b, "libcore_dns_malformed_total", "counter", "Packets to a DNS destination that were not a query.")
+	fmt.Fprintf(&b, "libcore_dns_malformed_total %d\n", atomic.LoadUint32(&t.dnsMalformed))
+
+	writeHeader(&b, "libcore_app_stats_evicted_total", "counter", "Per-app stats evicted for exceeding the entry limit.")
+	fmt.Fprintf(&b, "libcore_app_stats_evicted_total %d\n", atomic.LoadUint32(&t.appStatsEvicted))
+
+	writeHeader(&b, "libcore_conns_by_protocol_total", "counter", "Connections by the protocol of their first payload.")
+	for protocol, name := range protocolNames {
+		fmt.Fprintf(&b, "libcore_conns_by_protocol_total{protocol=\"%s\"} %d\n", name, atomic.LoadUint32(&t.protocols[protocol]))
+	}
+
+	writeHeader(&b, "libcore_dns_inflight_rejected_total", "counter", "DNS queries answered with SERVFAIL for too many in flight.")
+	fmt.Fprintf(&b, "libcore_dns_inflight_rejected_total %d\n", atomic.LoadUint32(&t.dnsInflightRejected))
+
+	writeHeader(&b, "libcore_blocked_outbound_total", "counter", "Connections blocked for being routed to a blackhole outbound.")
+	fmt.Fprintf(&b, "libcore_blocked_outbound_total %d\n", atomic.LoadUint32(&t.blockedOutbounds))
+
+	writeHeader(&b, "libcore_uid_resolve_failures_total", "counter", "Connections whose uid could not be resolved.")
+	fmt.Fprintf(&b, "libcore_uid_resolve_failures_total %d\n", atomic.LoadUint32(&t.uidFailures))
+
+	writeHeader(&b, "libcore_dial_failures_total", "counter", "Failed dials through the core.")
+	fmt.Fprintf(&b, "libcore_dial_failures_total %d\n", atomic.LoadUint32(&t.dialFailures))
+
+	writeHeader(&b, "libcore_dial_fallbacks_total", "counter", "Failed dials retried with the fallback tag.")
+	fmt.Fprintf(&b, "libcore_dial_fallbacks_total %d\n", atomic.LoadUint32(&t.fallbacks))
+
+	writeHeader(&b, "libcore_lifetime_closed_total", "counter", "TCP connections closed for exceeding the maximum lifetime.")
+	fmt.Fprintf(&b, "libcore_lifetime_closed_total %d\n", atomic.LoadUint32(&t.lifetimeExpired))
+
+	writeHeader(&b, "libcore_connect_latency_seconds", "histogram", "Time from accepting a connection to the first response of its destination.")
+	t.latency.write(&b, "libcore_connect_latency_seconds")
+
+	return b.String()
+}
+
+func writeHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
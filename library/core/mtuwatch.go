@@ -0,0 +1,102 @@
+package libcore
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xjasonlyu/tun2socks/log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// mtuMismatchFailures is how many writes of large packets must fail in a
+// row, while smaller ones pass, before the MTU is reported as too high.
+const mtuMismatchFailures = 5
+
+// MtuListener is told when the device rejects packets for their size,
+// which happens when the MTU of the network shrank below the tun MTU.
+type MtuListener interface {
+	OnMtuMismatch(failedSize int32, suggestedMtu int32, message string)
+}
+
+// mtuWatch tracks the writes to the device to tell size related failures
+// apart from others.
+type mtuWatch struct {
+	largestWritten int32
+	// failures is only changed under access, but loaded without it so
+	// writes skip the lock while none failed.
+	failures int32
+
+	access       sync.Mutex
+	smallestFail int
+	reported     bool
+}
+
+// SetMtuListener sets the listener for device writes failing for their
+// size, nil disables it. Writes are considered failing for their size when
+// they fail with EMSGSIZE, or when packets larger than any written so far
+// fail while smaller ones pass, repeatedly. The suggested MTU is the size
+// of the largest packet written, the app can set it as the path MTU with
+// SetPathMtu or restart the tun with it. It is reported once until a
+// packet of the failing size passes again. Failures are logged and
+// counted in the metrics either way.
+func (t *Tun2socks) SetMtuListener(listener MtuListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.mtuListener = listener
+}
+
+func (t *Tun2socks) onDeviceWritten(size int) {
+	w := &t.mtuWatch
+	for {
+		largest := atomic.LoadInt32(&w.largestWritten)
+		if int32(size) <= largest || atomic.CompareAndSwapInt32(&w.largestWritten, largest, int32(size)) {
+			break
+		}
+	}
+
+	if atomic.LoadInt32(&w.failures) == 0 {
+		return
+	}
+	w.access.Lock()
+	if w.failures > 0 && size >= w.smallestFail {
+		atomic.StoreInt32(&w.failures, 0)
+		w.smallestFail, w.reported = 0, false
+	}
+	w.access.Unlock()
+}
+
+func (t *Tun2socks) onDeviceWriteFailed(size int, err error) {
+	w := &t.mtuWatch
+	largest := int(atomic.LoadInt32(&w.largestWritten))
+	if !errors.Is(err, syscall.EMSGSIZE) && (largest == 0 || size <= largest) {
+		return
+	}
+	atomic.AddUint32(&t.mtuWriteFailures, 1)
+
+	w.access.Lock()
+	failures := atomic.AddInt32(&w.failures, 1)
+	if w.smallestFail == 0 || size < w.smallestFail {
+		w.smallestFail = size
+	}
+	report := failures >= mtuMismatchFailures && !w.reported
+	if report {
+		w.reported = true
+	}
+	w.access.Unlock()
+	if !report {
+		return
+	}
+
+	message := fmt.Sprintf("device rejects packets of %d bytes: %s, the tun MTU %d may exceed the network one", size, err.Error(), atomic.LoadInt32(&tunMtu))
+	log.Warnf("[TUN] %s", message)
+
+	t.access.Lock()
+	listener := t.mtuListener
+	t.access.Unlock()
+
+	if listener != nil {
+		listener.OnMtuMismatch(int32(size), int32(largest), message)
+	}
+}
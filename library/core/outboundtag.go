@@ -0,0 +1,37 @@
+package libcore
+
+import (
+	"context"
+	v2rayLog "github.com/xtls/xray-core/common/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"strings"
+)
+
+// withAccessMessage attaches an access message to ctx, which the dispatcher
+// fills with the detour it picked before handing the connection to the
+// outbound, and logs to the access log if one is configured.
+func withAccessMessage(ctx context.Context, src v2rayNet.Destination, dest v2rayNet.Destination, email string) (context.Context, *v2rayLog.AccessMessage) {
+	message := &v2rayLog.AccessMessage{
+		From:   src,
+		To:     dest,
+		Status: v2rayLog.AccessAccepted,
+		Reason: "",
+		Email:  email,
+	}
+	return v2rayLog.ContextWithAccessMessage(ctx, message), message
+}
+
+// recordOutbound stores the outbound tag of the detour in message. It must
+// only be called once the outbound responded, which orders it after the
+// dispatcher wrote the detour.
+func (e *connEntry) recordOutbound(message *v2rayLog.AccessMessage) {
+	detour := message.Detour
+	if index := strings.LastIndex(detour, " -> "); index >= 0 {
+		detour = detour[index+4:]
+	} else if index = strings.LastIndex(detour, " >> "); index >= 0 {
+		detour = detour[index+4:]
+	}
+	if detour != "" {
+		e.outbound.Store(detour)
+	}
+}
@@ -0,0 +1,137 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	ipv4MinMtu = 576
+	ipv6MinMtu = 1280
+)
+
+var pathMtu int32
+
+// SetPathMtu sets the MTU of the path behind the proxy, for when it is
+// smaller than the tun MTU. UDP packets that do not fit and must not be
+// fragmented, IPv4 with DF set and all IPv6, are dropped and answered with
+// ICMP fragmentation needed or packet too big, so apps doing path MTU
+// discovery such as QUIC shrink their packets instead of being blackholed.
+// TCP is covered by the MSS clamp, which is derived from this value when it
+// is not set explicitly. Zero disables it.
+func SetPathMtu(mtu int32) {
+	atomic.StoreInt32(&pathMtu, mtu)
+}
+
+// effectiveMtu is the smaller of the tun and path MTU, zero if neither is
+// known.
+func effectiveMtu() int32 {
+	mtu := atomic.LoadInt32(&tunMtu)
+	if path := atomic.LoadInt32(&pathMtu); path > 0 && (mtu <= 0 || path < mtu) {
+		mtu = path
+	}
+	return mtu
+}
+
+// pathMtuReply returns the ICMP error to send back for packet if it exceeds
+// the path MTU and can not be fragmented, or nil if it may pass.
+func (t *Tun2socks) pathMtuReply(packet []byte) []byte {
+	mtu := int(atomic.LoadInt32(&pathMtu))
+	if mtu <= 0 || len(packet) <= mtu {
+		return nil
+	}
+	var reply []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 || packet[9] != 17 || packet[6]&0x40 == 0 {
+			return nil
+		}
+		if mtu < ipv4MinMtu {
+			mtu = ipv4MinMtu
+		}
+		reply = icmpv4FragmentationNeeded(packet, mtu)
+	case 6:
+		if len(packet) < 40 || packet[6] != 17 {
+			return nil
+		}
+		if mtu < ipv6MinMtu {
+			mtu = ipv6MinMtu
+		}
+		reply = icmpv6PacketTooBig(packet, mtu)
+	}
+	if reply != nil && len(packet) > mtu {
+		atomic.AddUint32(&t.pmtuRejected, 1)
+		return reply
+	}
+	return nil
+}
+
+func icmpv4FragmentationNeeded(packet []byte, mtu int) []byte {
+	quoted := int(packet[0]&0x0f)*4 + 8
+	if quoted > len(packet) {
+		quoted = len(packet)
+	}
+	reply := make([]byte, 28+quoted)
+	reply[0] = 0x45
+	binary.BigEndian.PutUint16(reply[2:], uint16(len(reply)))
+	reply[8] = 64
+	reply[9] = 1
+	copy(reply[12:16], packet[16:20])
+	copy(reply[16:20], packet[12:16])
+	binary.BigEndian.PutUint16(reply[10:], checksum(reply[:20], 0))
+
+	icmp := reply[20:]
+	icmp[0] = 3
+	icmp[1] = 4
+	binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+	copy(icmp[8:], packet[:quoted])
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+	return reply
+}
+
+func icmpv6PacketTooBig(packet []byte, mtu int) []byte {
+	quoted := len(packet)
+	if quoted > ipv6MinMtu-48 {
+		quoted = ipv6MinMtu - 48
+	}
+	reply := make([]byte, 48+quoted)
+	reply[0] = 0x60
+	binary.BigEndian.PutUint16(reply[4:], uint16(8+quoted))
+	reply[6] = 58
+	reply[7] = 64
+	copy(reply[8:24], packet[24:40])
+	copy(reply[24:40], packet[8:24])
+
+	icmp := reply[40:]
+	icmp[0] = 2
+	binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+	copy(icmp[8:], packet[:quoted])
+
+	pseudo := make([]byte, 40)
+	copy(pseudo, reply[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(icmp)))
+	pseudo[39] = 58
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, sum(pseudo)))
+	return reply
+}
+
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum is the internet checksum of b, starting from the partial sum
+// initial of a pseudo header.
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
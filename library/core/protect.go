@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/xjasonlyu/tun2socks/log"
 	"github.com/xtls/xray-core/common/net"
 	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
 	"github.com/xtls/xray-core/transport/internet"
 	"golang.org/x/sys/unix"
 	"os"
@@ -29,6 +31,10 @@ type protectedDialer struct {
 }
 
 func (dialer protectedDialer) Dial(ctx context.Context, source net.Address, destination net.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
+	family := addressFamilyFromContext(ctx)
+	tos := tosFromContext(ctx)
+	ttl := ttlFromContext(ctx, destination)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -53,10 +59,12 @@ func (dialer protectedDialer) Dial(ctx context.Context, source net.Address, dest
 	var destIp *net.IP
 	if ipv6Mode == 3 {
 		// ipv6 only
-
+		family = AddressFamilyIPv6
+	}
+	if family != AddressFamilyAuto {
 		for _, addr := range addresses {
 			v2Addr := v2rayNet.ParseAddress(addr.String())
-			if v2Addr.Family().IsIPv6() {
+			if v2Addr.Family().IsIPv6() == (family == AddressFamilyIPv6) {
 				destIp = &addr.IP
 				break
 			}
@@ -75,6 +83,32 @@ func (dialer protectedDialer) Dial(ctx context.Context, source net.Address, dest
 		return nil, errors.New("protect failed")
 	}
 
+	if tos != 0 {
+		_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos)
+		_ = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	if ttl != 0 {
+		_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+		_ = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+	}
+	if destination.Network == net.Network_UDP && udpReuseAddr {
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}
+	if destination.Network == net.Network_TCP {
+		if mss := clampedMSS(); mss > 0 {
+			_ = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG, mss)
+		}
+	}
+
+	if local := sendThrough; local != nil && (local.To4() == nil) == (destIp.To4() == nil) {
+		bindAddress := &unix.SockaddrInet6{}
+		copy(bindAddress.Addr[:], local.To16())
+		if err := unix.Bind(fd, bindAddress); err != nil {
+			log.Warnf("bind to send through address %s failed: %s", local, err.Error())
+		}
+	}
+
 	socketAddress := &unix.SockaddrInet6{
 		Port: portNum,
 	}
@@ -96,9 +130,45 @@ func (dialer protectedDialer) Dial(ctx context.Context, source net.Address, dest
 	}
 
 	_ = file.Close()
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetNoDelay(tcpNoDelay)
+	}
+
 	return conn, nil
 }
 
+const (
+	AddressFamilyAuto = iota
+	AddressFamilyIPv4
+	AddressFamilyIPv6
+)
+
+const addressFamilyAttribute = "libcore-address-family"
+
+func addressFamilyFromContext(ctx context.Context) int {
+	content := session.ContentFromContext(ctx)
+	if content == nil {
+		return AddressFamilyAuto
+	}
+	switch content.Attribute(addressFamilyAttribute) {
+	case "ipv4":
+		return AddressFamilyIPv4
+	case "ipv6":
+		return AddressFamilyIPv6
+	}
+	return AddressFamilyAuto
+}
+
+func setAddressFamily(content *session.Content, family int32) {
+	switch family {
+	case AddressFamilyIPv4:
+		content.SetAttribute(addressFamilyAttribute, "ipv4")
+	case AddressFamilyIPv6:
+		content.SetAttribute(addressFamilyAttribute, "ipv6")
+	}
+}
+
 func getFd(network net.Network) (fd int, err error) {
 	switch network {
 	case net.Network_TCP:
@@ -0,0 +1,60 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"github.com/xtls/xray-core/common/protocol/bittorrent"
+	"github.com/xtls/xray-core/common/protocol/http"
+	"github.com/xtls/xray-core/common/protocol/tls"
+	"sync/atomic"
+)
+
+const (
+	protocolTls = iota
+	protocolHttp
+	protocolQuic
+	protocolBittorrent
+	protocolUnknown
+	protocolCount
+)
+
+var protocolNames = [protocolCount]string{"tls", "http", "quic", "bittorrent", "unknown"}
+
+// sniffProtocol classifies the first payload a connection sent.
+func sniffProtocol(udp bool, payload []byte) int {
+	if udp {
+		if isQuicInitial(payload) {
+			return protocolQuic
+		}
+		return protocolUnknown
+	}
+	if _, err := tls.SniffTLS(payload); err == nil {
+		return protocolTls
+	}
+	if _, err := http.SniffHTTP(payload); err == nil {
+		return protocolHttp
+	}
+	if _, err := bittorrent.SniffBittorrent(payload); err == nil {
+		return protocolBittorrent
+	}
+	return protocolUnknown
+}
+
+// isQuicInitial reports whether payload is a QUIC long header packet of a
+// known version, which is how every QUIC connection starts.
+func isQuicInitial(payload []byte) bool {
+	if len(payload) < 5 || payload[0]&0xc0 != 0xc0 {
+		return false
+	}
+	switch version := binary.BigEndian.Uint32(payload[1:]); {
+	case version == 0x00000001, version == 0x6b3343cf:
+		return true
+	case version&0xffffff00 == 0xff000000:
+		return true
+	}
+	return false
+}
+
+// countProtocol counts a connection by the protocol of its first payload.
+func (t *Tun2socks) countProtocol(udp bool, payload []byte) {
+	atomic.AddUint32(&t.protocols[sniffProtocol(udp, payload)], 1)
+}
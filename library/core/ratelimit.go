@@ -0,0 +1,127 @@
+package libcore
+
+import (
+	"context"
+	"github.com/Dreamacro/clash/common/pool"
+	"golang.org/x/time/rate"
+	"net"
+	"sync"
+	"time"
+)
+
+const rateLimitBurst = pool.RelayBufferSize
+
+// SetGlobalRateLimit caps the total throughput of all relayed connections
+// in bytes per second for each direction, zero means unlimited.
+func (t *Tun2socks) SetGlobalRateLimit(uplink int64, downlink int64) {
+	setRateLimit(t.uplinkLimiter, uplink)
+	setRateLimit(t.downlinkLimiter, downlink)
+}
+
+// rateLimiter wakes its waiters when the limit changes, so lifting it does
+// not leave them waiting by the old one.
+type rateLimiter struct {
+	*rate.Limiter
+	access  sync.Mutex
+	changed chan struct{}
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		Limiter: rate.NewLimiter(rate.Inf, rateLimitBurst),
+		changed: make(chan struct{}),
+	}
+}
+
+func setRateLimit(limiter *rateLimiter, bytesPerSec int64) {
+	limiter.access.Lock()
+	defer limiter.access.Unlock()
+
+	if bytesPerSec <= 0 {
+		limiter.SetLimit(rate.Inf)
+	} else {
+		limiter.SetLimit(rate.Limit(bytesPerSec))
+	}
+	close(limiter.changed)
+	limiter.changed = make(chan struct{})
+}
+
+func (l *rateLimiter) changes() <-chan struct{} {
+	l.access.Lock()
+	defer l.access.Unlock()
+
+	return l.changed
+}
+
+// waitRateLimit waits until n bytes may pass, it gives up with the error
+// of ctx once the relay ended.
+func waitRateLimit(ctx context.Context, limiter *rateLimiter, n int) error {
+	for n > 0 {
+		chunk := n
+		if chunk > rateLimitBurst {
+			chunk = rateLimitBurst
+		}
+		changed := limiter.changes()
+		reservation := limiter.ReserveN(time.Now(), chunk)
+		if delay := reservation.Delay(); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-changed:
+				timer.Stop()
+				reservation.Cancel()
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				reservation.Cancel()
+				return ctx.Err()
+			}
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+type rateLimitedConn struct {
+	net.Conn
+	ctx      context.Context
+	uplink   *rateLimiter
+	downlink *rateLimiter
+}
+
+func (c *rateLimitedConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if waitErr := waitRateLimit(c.ctx, c.downlink, n); err == nil {
+		err = waitErr
+	}
+	return
+}
+
+func (c *rateLimitedConn) Write(b []byte) (n int, err error) {
+	if err = waitRateLimit(c.ctx, c.uplink, len(b)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+type rateLimitedPacketConn struct {
+	net.PacketConn
+	ctx      context.Context
+	uplink   *rateLimiter
+	downlink *rateLimiter
+}
+
+func (c *rateLimitedPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if waitErr := waitRateLimit(c.ctx, c.downlink, n); err == nil {
+		err = waitErr
+	}
+	return
+}
+
+func (c *rateLimitedPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if err = waitRateLimit(c.ctx, c.uplink, len(p)); err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
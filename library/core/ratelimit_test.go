@@ -0,0 +1,80 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// drainedLimiter returns a limiter allowing one byte per second with its
+// burst already used up.
+func drainedLimiter(t *testing.T) *rateLimiter {
+	t.Helper()
+	limiter := newRateLimiter()
+	setRateLimit(limiter, 1)
+	if err := waitRateLimit(context.Background(), limiter, rateLimitBurst); err != nil {
+		t.Fatal(err)
+	}
+	return limiter
+}
+
+func waitRateLimitResult(ctx context.Context, limiter *rateLimiter) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- waitRateLimit(ctx, limiter, rateLimitBurst)
+	}()
+	return result
+}
+
+func TestRateLimitWaitCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := waitRateLimitResult(ctx, drainedLimiter(t))
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait not canceled")
+	}
+}
+
+func TestRateLimitWaitLifted(t *testing.T) {
+	limiter := drainedLimiter(t)
+	result := waitRateLimitResult(context.Background(), limiter)
+	time.Sleep(10 * time.Millisecond)
+	setRateLimit(limiter, 0)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("error %v after the limit was lifted", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after the limit was lifted")
+	}
+}
+
+// A relay canceled for idleness ends even while its uplink waits for the
+// rate limit.
+func TestRelayRateLimitedIdle(t *testing.T) {
+	tun, accepted, _ := startRelayTest(t)
+	tun.SetIdleTimeout(1)
+	tun.SetGlobalRateLimit(1, 0)
+
+	app, peer := net.Pipe()
+	defer peer.Close()
+	go func() {
+		_, _ = peer.Write(make([]byte, 2*rateLimitBurst))
+	}()
+	go func() {
+		select {
+		case origin := <-accepted:
+			defer origin.Close()
+			time.Sleep(5 * time.Second)
+		case <-time.After(5 * time.Second):
+		}
+	}()
+	relay(t, tun, app)
+}
@@ -0,0 +1,52 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var startupGrace int32
+
+// SetStartupGrace makes tuns created afterwards hold new connections until
+// timeout milliseconds after the tun was created, so the ones opened while
+// the core is still starting wait for it instead of failing. Calling
+// SetReady ends the grace early, without it connections go through once it
+// passed. Zero disables it, tuns are then ready right away.
+func SetStartupGrace(timeout int32) {
+	atomic.StoreInt32(&startupGrace, timeout)
+}
+
+// SetReady releases the connections held by the startup grace and lets new
+// ones through, it has no effect if the tun is already ready.
+func (t *Tun2socks) SetReady() {
+	if t.ready != nil {
+		t.readyOnce.Do(func() {
+			close(t.ready)
+		})
+	}
+}
+
+// waitReady blocks until the tun is ready or its startup grace passed.
+func (t *Tun2socks) waitReady() {
+	if t.ready == nil {
+		return
+	}
+	select {
+	case <-t.ready:
+		return
+	default:
+	}
+	wait := time.Until(t.readyAt)
+	if wait <= 0 {
+		t.SetReady()
+		return
+	}
+	atomic.AddUint32(&t.startupHeld, 1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-t.ready:
+	case <-timer.C:
+		t.SetReady()
+	}
+}
@@ -0,0 +1,60 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newGraceTun(grace time.Duration) *Tun2socks {
+	now := time.Now()
+	return &Tun2socks{startedAt: now, ready: make(chan struct{}), readyAt: now.Add(grace)}
+}
+
+func waitReadyWithin(t *testing.T, tun *Tun2socks, timeout time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		tun.waitReady()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("connection still held")
+	}
+	return time.Since(start)
+}
+
+// The grace is measured from the creation of the tun, connections arriving
+// late in it are only held for what is left.
+func TestStartupGraceFromCreation(t *testing.T) {
+	tun := newGraceTun(200 * time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	if held := waitReadyWithin(t, tun, time.Second); held > 150*time.Millisecond {
+		t.Errorf("held for %s, past the grace", held)
+	}
+	if held := atomic.LoadUint32(&tun.startupHeld); held != 1 {
+		t.Errorf("%d connections counted as held, want 1", held)
+	}
+}
+
+// Without SetReady connections go through once the grace passed.
+func TestStartupGracePassed(t *testing.T) {
+	tun := newGraceTun(50 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if held := waitReadyWithin(t, tun, time.Second); held > 20*time.Millisecond {
+		t.Errorf("held for %s after the grace passed", held)
+	}
+	if held := atomic.LoadUint32(&tun.startupHeld); held != 0 {
+		t.Errorf("%d connections counted as held, want 0", held)
+	}
+}
+
+func TestStartupGraceSetReady(t *testing.T) {
+	tun := newGraceTun(time.Minute)
+	time.AfterFunc(50*time.Millisecond, tun.SetReady)
+	waitReadyWithin(t, tun, time.Second)
+	waitReadyWithin(t, tun, 10*time.Millisecond)
+}
@@ -0,0 +1,104 @@
+package libcore
+
+import (
+	"github.com/xtls/xray-core/common/signal"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SetIdleTimeout cancels relayed TCP connections after no bytes flowed in
+// either direction for timeout seconds, zero disables it.
+func (t *Tun2socks) SetIdleTimeout(timeout int32) {
+	atomic.StoreInt32(&t.idleTimeout, timeout)
+}
+
+func (t *Tun2socks) getIdleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt32(&t.idleTimeout)) * time.Second
+}
+
+// SetMaxConnLifetime closes relayed TCP connections once they have been
+// open for lifetime seconds regardless of activity, so long lived ones are
+// periodically established again, zero disables it.
+func (t *Tun2socks) SetMaxConnLifetime(lifetime int32) {
+	atomic.StoreInt32(&t.maxLifetime, lifetime)
+}
+
+func (t *Tun2socks) getMaxConnLifetime() time.Duration {
+	return time.Duration(atomic.LoadInt32(&t.maxLifetime)) * time.Second
+}
+
+// activityConn reports every successful read and write to the relay timer.
+type activityConn struct {
+	net.Conn
+	timer signal.ActivityUpdater
+}
+
+func (c *activityConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.timer.Update()
+	}
+	return
+}
+
+func (c *activityConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.timer.Update()
+	}
+	return
+}
+
+// activityPacketConn reports every datagram passed to the relay timer,
+// zero-length ones included since apps send them as keepalives. The core
+// drops empty datagrams on its pipes, so they only reach the peer of
+// direct sessions.
+type activityPacketConn struct {
+	net.PacketConn
+	timer signal.ActivityUpdater
+}
+
+func (c *activityPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.timer.Update()
+	}
+	return
+}
+
+func (c *activityPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		c.timer.Update()
+	}
+	return
+}
+
+// maxEmptyReads is how many reads in a row may return neither data nor an
+// error before a relay gives up, so a conn left in an odd state by the
+// stack can not keep io.Copy spinning. Giving up is counted as a read
+// error of the side, local tells the app side.
+const maxEmptyReads = 100
+
+type progressConn struct {
+	net.Conn
+	entry *connEntry
+	local bool
+	empty int
+}
+
+func (c *progressConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 || err != nil || len(b) == 0 {
+		c.empty = 0
+		return
+	}
+	c.empty++
+	if c.empty >= maxEmptyReads {
+		err = io.ErrNoProgress
+		c.entry.countError(err, false, c.local)
+	}
+	return
+}
@@ -0,0 +1,273 @@
+package libcore
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type closedConns struct {
+	access sync.Mutex
+	conns  []*Connection
+}
+
+func (c *closedConns) OnConnClosed(conn *Connection) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.conns = append(c.conns, conn)
+}
+
+func (c *closedConns) only(t *testing.T) *Connection {
+	t.Helper()
+	c.access.Lock()
+	defer c.access.Unlock()
+	if len(c.conns) != 1 {
+		t.Fatalf("%d connections closed, want 1", len(c.conns))
+	}
+	return c.conns[0]
+}
+
+// startRelayTest runs a tun relaying to a loopback origin and returns it
+// along with the origin's accepted connections and the closed relays.
+func startRelayTest(t *testing.T) (*Tun2socks, <-chan net.Conn, *closedConns) {
+	t.Helper()
+	origin, accepted := startTestOrigin(t)
+	tun := startTestTun(t, startTestCore(t, domainRoutingConfig(origin.Addr(), "blocked")))
+	closed := &closedConns{}
+	tun.SetConnectionCloseListener(closed)
+	return tun, accepted, closed
+}
+
+// relay runs Add for conn and fails unless it returns within a few seconds.
+func relay(t *testing.T, tun *Tun2socks, conn net.Conn) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		tun.Add(newTestTCPConn(conn, "10.0.0.2:40000", "198.51.100.1:80"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not end")
+	}
+}
+
+func checkRelayStats(t *testing.T, tun *Tun2socks, uplink uint64, downlink uint64) {
+	t.Helper()
+	if entries := tun.conns.list(); len(entries) != 0 {
+		t.Errorf("%d connections still registered", len(entries))
+	}
+	stats := tun.getAppStats(testUid)
+	if conns := stats.tcpConn; conns != 0 {
+		t.Errorf("tcpConn = %d, want 0", conns)
+	}
+	if total := stats.tcpConnTotal; total != 1 {
+		t.Errorf("tcpConnTotal = %d, want 1", total)
+	}
+	if stats.deactivateAt == 0 {
+		t.Error("app not deactivated")
+	}
+	if stats.tcpUplink != uplink || stats.tcpDownlink != downlink {
+		t.Errorf("traffic = %d/%d, want %d/%d", stats.tcpUplink, stats.tcpDownlink, uplink, downlink)
+	}
+}
+
+func TestRelayAppClosesImmediately(t *testing.T) {
+	tun, _, closed := startRelayTest(t)
+
+	app, peer := net.Pipe()
+	_ = peer.Close()
+	relay(t, tun, app)
+
+	conn := closed.only(t)
+	if conn.CloseReason != CloseReasonClientClosed {
+		t.Errorf("close reason = %q, want %q", conn.CloseReason, CloseReasonClientClosed)
+	}
+	if conn.LocalErrors != 0 || conn.ReadErrors != 0 || conn.WriteErrors != 0 || conn.Resets != 0 {
+		t.Errorf("errors counted for a clean close: %+v", conn)
+	}
+	checkRelayStats(t, tun, 0, 0)
+}
+
+// resetConn fails reads with a reset once the peer closed.
+type resetConn struct {
+	net.Conn
+}
+
+func (c *resetConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		err = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	return n, err
+}
+
+func TestRelayAppResets(t *testing.T) {
+	tun, accepted, closed := startRelayTest(t)
+
+	app, peer := net.Pipe()
+	go func() {
+		_, _ = peer.Write([]byte("hello"))
+		_ = peer.Close()
+	}()
+	relay(t, tun, &resetConn{app})
+
+	conn := closed.only(t)
+	if conn.CloseReason != CloseReasonReset {
+		t.Errorf("close reason = %q, want %q", conn.CloseReason, CloseReasonReset)
+	}
+	if conn.LocalErrors != 1 || conn.Resets != 0 {
+		t.Errorf("local errors = %d, resets = %d, want 1 and 0", conn.LocalErrors, conn.Resets)
+	}
+	checkRelayStats(t, tun, 5, 0)
+
+	select {
+	case origin := <-accepted:
+		_ = origin.Close()
+	case <-time.After(time.Second):
+	}
+}
+
+func TestRelayRemoteCloses(t *testing.T) {
+	tun, accepted, closed := startRelayTest(t)
+
+	app, peer := net.Pipe()
+	go func() {
+		_, _ = peer.Write([]byte("hello"))
+		response, _ := io.ReadAll(peer)
+		if string(response) != "world" {
+			t.Errorf("app received %q, want %q", response, "world")
+		}
+		_ = peer.Close()
+	}()
+	go func() {
+		select {
+		case origin := <-accepted:
+			request := make([]byte, 5)
+			_, _ = io.ReadFull(origin, request)
+			_, _ = origin.Write([]byte("world"))
+			_ = origin.Close()
+		case <-time.After(5 * time.Second):
+		}
+	}()
+	relay(t, tun, app)
+
+	conn := closed.only(t)
+	if conn.CloseReason != CloseReasonRemoteClosed {
+		t.Errorf("close reason = %q, want %q", conn.CloseReason, CloseReasonRemoteClosed)
+	}
+	checkRelayStats(t, tun, 5, 5)
+}
+
+// stalledConn returns neither data nor an error until it is closed.
+type stalledConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *stalledConn) Read([]byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+		return 0, nil
+	}
+}
+
+func (c *stalledConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+func TestRelayAppStalls(t *testing.T) {
+	tun, _, closed := startRelayTest(t)
+
+	app, peer := net.Pipe()
+	defer peer.Close()
+	relay(t, tun, &stalledConn{Conn: app, closed: make(chan struct{})})
+
+	conn := closed.only(t)
+	if conn.LocalErrors != 1 {
+		t.Errorf("local errors = %d, want 1", conn.LocalErrors)
+	}
+	checkRelayStats(t, tun, 0, 0)
+}
+
+// startUdpEcho answers every datagram, empty ones included, with a copy.
+func startUdpEcho(t *testing.T) net.PacketConn {
+	t.Helper()
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = echo.Close()
+	})
+	return echo
+}
+
+type identityTransformer struct{}
+
+func (identityTransformer) Transform(_ bool, _ string, _ string, payload []byte) []byte {
+	return payload
+}
+
+// Apps send empty datagrams as keepalives, direct sessions relay them both
+// ways, through the transformer too, even as the first of a flow.
+func TestRelayForwardsEmptyDatagrams(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		transformer UdpTransformer
+		payloads    []string
+	}{
+		{"plain", nil, []string{"hello", "", "world"}},
+		{"transformed", identityTransformer{}, []string{"hello", "", "world"}},
+		{"empty first", nil, []string{"", "hello"}},
+		{"empty first transformed", identityTransformer{}, []string{"", "hello"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			echo := startUdpEcho(t)
+			tun, _, _ := startRelayTest(t)
+			if err := tun.SetBypassDestinations("127.0.0.1/32", LanPolicyDirect); err != nil {
+				t.Fatal(err)
+			}
+			tun.SetUdpTransformer(test.transformer)
+
+			// replies are written back through the packet that opened the
+			// session
+			var first *testUDPPacket
+			for _, payload := range test.payloads {
+				packet := newTestUDPPacket([]byte(payload), "10.0.0.2:40000", echo.LocalAddr().String())
+				if first == nil {
+					first = packet
+				}
+				tun.AddPacket(packet)
+				select {
+				case reply := <-first.written:
+					if string(reply) != payload {
+						t.Fatalf("reply %q, want %q", reply, payload)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("no reply to %q", payload)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+//go:build tunreplay
+// +build tunreplay
+
+package libcore
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// This file is only built with the tunreplay tag, it lets integration tests
+// drive Add and addPacket end to end without a tun device. The core is a
+// regular V2RayInstance, loading a config whose outbound is freedom or a
+// local socks server stands in for the proxy.
+
+const replayQueueSize = 64
+
+// replayDevice stands in for the tun, packets are fed to the stack with
+// inject and the ones it writes back are taken with next.
+type replayDevice struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newReplayDevice() *replayDevice {
+	return &replayDevice{
+		in:     make(chan []byte, replayQueueSize),
+		out:    make(chan []byte, replayQueueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *replayDevice) Read(p []byte) (int, error) {
+	select {
+	case packet := <-d.in:
+		return copy(p, packet), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+func (d *replayDevice) Write(p []byte) (int, error) {
+	packet := make([]byte, len(p))
+	copy(packet, p)
+	select {
+	case d.out <- packet:
+		return len(p), nil
+	case <-d.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// inject feeds packet to the stack as if the app had sent it.
+func (d *replayDevice) inject(packet []byte) error {
+	select {
+	case d.in <- packet:
+		return nil
+	case <-d.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// next returns the next packet written back to the app, waiting up to
+// timeout for it.
+func (d *replayDevice) next(timeout time.Duration) ([]byte, error) {
+	select {
+	case packet := <-d.out:
+		return packet, nil
+	case <-time.After(timeout):
+		return nil, errors.New("no packet written back")
+	case <-d.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+func (d *replayDevice) close() {
+	d.once.Do(func() {
+		close(d.closed)
+	})
+}
+
+// newReplayCore starts a core that sends every connection and datagram
+// to origin whatever its destination, standing in for the proxy.
+func newReplayCore(origin string) (*V2RayInstance, error) {
+	instance := NewV2rayInstance()
+	err := instance.LoadConfig(`{
+  "log": {"loglevel": "none"},
+  "outbounds": [{"protocol": "freedom", "settings": {"redirect": "`+origin+`"}}]
+}`, false)
+	if err == nil {
+		err = instance.Start()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// newReplayTun runs a tun on a replay device, with DNS hijacked to the
+// router address the app uses. Uid lookups and traffic stats are disabled,
+// no uid dumper is installed outside of Android.
+func newReplayTun(v2ray *V2RayInstance, sniffing bool, fakedns bool) (*Tun2socks, *replayDevice, error) {
+	device := newReplayDevice()
+	tun, err := newTun2socks(device, 1500, v2ray, "172.19.0.2", true, sniffing, fakedns, true, false, false, nil)
+	if err != nil {
+		device.close()
+		return nil, nil, err
+	}
+	return tun, device, nil
+}
+
+// udp4Packet builds an IPv4 UDP packet from src to dst.
+func udp4Packet(src, dst *net.UDPAddr, payload []byte) []byte {
+	packet := make([]byte, 28+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], src.IP.To4())
+	copy(packet[16:20], dst.IP.To4())
+	binary.BigEndian.PutUint16(packet[10:], checksum(packet[:20], 0))
+
+	udp := packet[20:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+
+	pseudo := make([]byte, 12)
+	copy(pseudo, packet[12:20])
+	pseudo[9] = 17
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(udp)))
+	binary.BigEndian.PutUint16(udp[6:], checksum(udp, sum(pseudo)))
+	return packet
+}
+
+// parseUdp4 is the reverse of udp4Packet, ok is false for anything but an
+// IPv4 UDP packet.
+func parseUdp4(packet []byte) (src, dst *net.UDPAddr, payload []byte, ok bool) {
+	if len(packet) < 28 || packet[0]>>4 != 4 || packet[9] != 17 {
+		return nil, nil, nil, false
+	}
+	udp := packet[int(packet[0]&0x0f)*4:]
+	if len(udp) < 8 {
+		return nil, nil, nil, false
+	}
+	src = &net.UDPAddr{IP: net.IP(packet[12:16]), Port: int(binary.BigEndian.Uint16(udp[0:]))}
+	dst = &net.UDPAddr{IP: net.IP(packet[16:20]), Port: int(binary.BigEndian.Uint16(udp[2:]))}
+	return src, dst, udp[8:], true
+}
@@ -0,0 +1,63 @@
+//go:build tunreplay
+// +build tunreplay
+
+package libcore
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplayUdpEcho(t *testing.T) {
+	origin, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := origin.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = origin.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	instance, err := newReplayCore(origin.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+	tun, device, err := newReplayTun(instance, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.close()
+	defer tun.Close()
+
+	app := &net.UDPAddr{IP: net.IPv4(172, 19, 0, 1), Port: 40000}
+	dest := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 9999}
+	payload := []byte("ping")
+	if err := device.inject(udp4Packet(app, dest, payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := device.next(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, dst, reply, ok := parseUdp4(packet)
+	if !ok {
+		t.Fatalf("unexpected packet % x", packet)
+	}
+	if !bytes.Equal(reply, payload) {
+		t.Errorf("reply %q, want %q", reply, payload)
+	}
+	if src.String() != dest.String() || dst.String() != app.String() {
+		t.Errorf("reply %s ==> %s, want %s ==> %s", src, dst, dest, app)
+	}
+}
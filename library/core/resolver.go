@@ -0,0 +1,98 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	ResolverRestoreSystem = iota
+	ResolverKeepSafe
+	ResolverBlock
+)
+
+var (
+	resolverAccess sync.Mutex
+	resolverOwner  *Tun2socks
+	resolverMode   int32
+	resolverSafe   string
+)
+
+var errResolverBlocked = errors.New("dns blocked after the tun was closed")
+
+// SetResolverAfterClose sets what the Go resolver of this process, which
+// a tun points at the core while it runs, uses once the tun is closed.
+// ResolverRestoreSystem, the default, goes back to the system DNS of the
+// network, which may leak names resolved by the process after a
+// disconnect. ResolverKeepSafe sends them to server, the ip:port of a
+// trusted resolver dialed directly, and ResolverBlock fails them. It takes
+// effect right away if no tun is running. A tun closed after another one
+// was created leaves the resolver of the new one in place either way.
+func SetResolverAfterClose(mode int32, server string) error {
+	switch mode {
+	case ResolverRestoreSystem, ResolverBlock:
+		server = ""
+	case ResolverKeepSafe:
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return err
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid dns server %s", server)
+		}
+	default:
+		return fmt.Errorf("unknown resolver mode %d", mode)
+	}
+
+	resolverAccess.Lock()
+	defer resolverAccess.Unlock()
+
+	resolverMode, resolverSafe = mode, server
+	if resolverOwner == nil {
+		installClosedResolver()
+	}
+	return nil
+}
+
+// installResolver points the Go resolver at the core of t.
+func installResolver(t *Tun2socks) {
+	resolverAccess.Lock()
+	defer resolverAccess.Unlock()
+
+	resolverOwner = t
+	net.DefaultResolver.Dial = t.dialDNS
+}
+
+// releaseResolver switches the Go resolver to the after close mode, unless
+// a newer tun has taken it over.
+func releaseResolver(t *Tun2socks) {
+	resolverAccess.Lock()
+	defer resolverAccess.Unlock()
+
+	if resolverOwner != t {
+		return
+	}
+	resolverOwner = nil
+	installClosedResolver()
+}
+
+// installClosedResolver must be called with resolverAccess held.
+func installClosedResolver() {
+	switch resolverMode {
+	case ResolverKeepSafe:
+		server := resolverSafe
+		net.DefaultResolver.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		}
+	case ResolverBlock:
+		net.DefaultResolver.Dial = func(context.Context, string, string) (net.Conn, error) {
+			return nil, errResolverBlocked
+		}
+	default:
+		net.DefaultResolver.Dial = nil
+	}
+}
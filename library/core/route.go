@@ -0,0 +1,97 @@
+package libcore
+
+import (
+	"context"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+	routingSession "github.com/xtls/xray-core/features/routing/session"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TestRoute reports the tag of the outbound the core would route a
+// connection to, without dialing anything, so routing rules can be checked
+// from the app. network is "tcp" or "udp", dest a host:port and srcUid the
+// uid of the app making the connection, 0 for unknown. sniffedDomain, if
+// not empty, stands for the domain sniffing would find, the target is then
+// routed by it as with destination override. Rules depending on the source
+// address or on the sniffed protocol are not matched. Returns "" if the
+// destination is invalid or the core is not running.
+func (t *Tun2socks) TestRoute(network string, srcUid int32, dest string, sniffedDomain string) string {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return ""
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return ""
+	}
+	address := v2rayNet.ParseAddress(host)
+	if sniffedDomain != "" {
+		address = v2rayNet.DomainAddress(strings.TrimSuffix(sniffedDomain, "."))
+	}
+	var destination v2rayNet.Destination
+	switch network {
+	case "tcp":
+		destination = v2rayNet.TCPDestination(address, v2rayNet.Port(port))
+	case "udp":
+		destination = v2rayNet.UDPDestination(address, v2rayNet.Port(port))
+	default:
+		return ""
+	}
+
+	inbound := &session.Inbound{
+		Tag:  "socks",
+		User: t.getInboundUser(),
+	}
+	if srcUid > 0 {
+		uid := uint16(srcUid)
+		if uid < 10000 {
+			uid = 1000
+		}
+		inbound.Uid = uint32(uid)
+		inbound.AppStatus = append(inbound.AppStatus, appStatus(uid)...)
+		if tag := t.uidTag(uid); tag != "" {
+			inbound.Tag = tag
+		}
+	}
+	inbound.AppStatus = append(inbound.AppStatus, networkStatus())
+
+	handler := t.pickOutbound(session.ContextWithInbound(context.Background(), inbound), destination)
+	if handler == nil {
+		return ""
+	}
+	return handler.Tag()
+}
+
+// pickOutbound returns the outbound handler the core would route dest to,
+// or nil if the core is not running.
+func (t *Tun2socks) pickOutbound(ctx context.Context, dest v2rayNet.Destination) outbound.Handler {
+	v2ray := t.getV2Ray()
+	if v2ray == nil {
+		return nil
+	}
+	instance := v2ray.runningCore()
+	if instance == nil {
+		return nil
+	}
+	manager, ok := instance.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	if !ok {
+		return nil
+	}
+
+	var handler outbound.Handler
+	if router, ok := instance.GetFeature(routing.RouterType()).(routing.Router); ok {
+		ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: dest})
+		if route, err := router.PickRoute(routingSession.AsRoutingContext(ctx)); err == nil {
+			handler = manager.GetHandler(route.GetOutboundTag())
+		}
+	}
+	if handler == nil {
+		handler = manager.GetDefaultHandler()
+	}
+	return handler
+}
@@ -0,0 +1,33 @@
+package libcore
+
+import (
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"sync/atomic"
+)
+
+const (
+	RouterTrafficDns = iota
+	RouterTrafficBlock
+)
+
+// SetRouterTraffic sets how traffic to the router address on ports other
+// than 53 is handled. RouterTrafficDns, the default, hands it to the DNS
+// inbound of the core like queries on port 53. RouterTrafficBlock blocks it
+// before any uid lookup or dial, for a router address that is only a DNS
+// sink: TCP connections as set by SetBlockAction, UDP packets are dropped.
+func (t *Tun2socks) SetRouterTraffic(mode int32) {
+	atomic.StoreInt32(&t.routerTraffic, mode)
+}
+
+// routerBlocked reports whether traffic to dest is blocked by the router
+// traffic mode, counting it if so.
+func (t *Tun2socks) routerBlocked(dest v2rayNet.Destination) bool {
+	if dest.Port == 53 || atomic.LoadInt32(&t.routerTraffic) != RouterTrafficBlock {
+		return false
+	}
+	if dest.Address.String() != t.router {
+		return false
+	}
+	atomic.AddUint32(&t.routerBlockedCount, 1)
+	return true
+}
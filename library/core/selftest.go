@@ -0,0 +1,135 @@
+package libcore
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	v2rayCore "github.com/xtls/xray-core/core"
+	"net"
+	"time"
+)
+
+const (
+	selfTestTimeout = 5 * time.Second
+	selfTestDomain  = "www.google.com"
+	selfTestLink    = "http://cp.cloudflare.com/"
+	selfTestDns     = "8.8.8.8:53"
+)
+
+type SelfTestStep struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Latency int64  `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SelfTest resolves a domain through the DNS inbound, then requests a page
+// over TCP and sends a DNS query over UDP through the proxy, and returns the
+// outcome and latency in milliseconds of each step as a JSON array. Every
+// step uses its own sessions and times out on its own.
+func (t *Tun2socks) SelfTest() []byte {
+	steps := []SelfTestStep{
+		runSelfTest("dns", t.selfTestDns),
+		runSelfTest("tcp", t.selfTestTcp),
+		runSelfTest("udp", t.selfTestUdp),
+	}
+	content, _ := json.Marshal(steps)
+	return content
+}
+
+func runSelfTest(name string, test func(ctx context.Context) error) SelfTestStep {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	step := SelfTestStep{Name: name}
+	start := time.Now()
+	err := test(ctx)
+	step.Latency = time.Since(start).Milliseconds()
+	if err != nil {
+		step.Error = err.Error()
+	} else {
+		step.Success = true
+	}
+	return step
+}
+
+func (t *Tun2socks) selfTestDns(ctx context.Context) error {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial:     t.dialDNS,
+	}
+	addresses, err := resolver.LookupIPAddr(ctx, selfTestDomain)
+	if err == nil && len(addresses) == 0 {
+		err = errors.New("no address")
+	}
+	return err
+}
+
+func (t *Tun2socks) selfTestTcp(ctx context.Context) error {
+	_, err := urlTest(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dest, err := v2rayNet.ParseDestination(network + ":" + addr)
+		if err != nil {
+			return nil, err
+		}
+		instance, err := t.runningCore()
+		if err != nil {
+			return nil, err
+		}
+		ctx = session.ContextWithInbound(ctx, &session.Inbound{Tag: "socks"})
+		return v2rayCore.Dial(ctx, instance, dest)
+	}, selfTestLink, int32(selfTestTimeout.Milliseconds()))
+	return err
+}
+
+func (t *Tun2socks) selfTestUdp(ctx context.Context) error {
+	dest, err := net.ResolveUDPAddr("udp", selfTestDns)
+	if err != nil {
+		return err
+	}
+	instance, err := t.runningCore()
+	if err != nil {
+		return err
+	}
+	conn, err := v2rayCore.DialUDP(session.ContextWithInbound(ctx, &session.Inbound{Tag: "socks"}), instance)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the connections of the core ignore deadlines
+	deadline, _ := ctx.Deadline()
+	timeout := time.Until(deadline)
+	timer := time.AfterFunc(timeout, func() {
+		_ = conn.Close()
+	})
+	defer timer.Stop()
+
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(selfTestDomain), dns.TypeA)
+	message, err := query.Pack()
+	if err != nil {
+		return err
+	}
+	if _, err = conn.WriteTo(message, dest); err != nil {
+		return err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		if !timer.Stop() {
+			return errors.Errorf("no reply within %dms", timeout.Milliseconds())
+		}
+		return err
+	}
+	response := new(dns.Msg)
+	if err = response.Unpack(buf[:n]); err != nil {
+		return err
+	}
+	if response.Id != query.Id {
+		return errors.New("unexpected response")
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package libcore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// The connections of the core ignore deadlines, a destination that never
+// replies must still end a step once its context expires.
+func checkSelfTestTimesOut(t *testing.T, step func(ctx context.Context) error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- step(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("step succeeded without a reply")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("step did not time out")
+	}
+}
+
+func TestSelfTestDnsTimesOut(t *testing.T) {
+	origin, _ := startTestOrigin(t)
+	tun := &Tun2socks{v2ray: startTestCore(t, domainRoutingConfig(origin.Addr(), "blocked"))}
+	checkSelfTestTimesOut(t, tun.selfTestDns)
+}
+
+func TestSelfTestUdpTimesOut(t *testing.T) {
+	tun := &Tun2socks{v2ray: startTestCore(t, `{
+  "log": {"loglevel": "none"},
+  "outbounds": [{"protocol": "blackhole", "tag": "block"}]
+}`)}
+	checkSelfTestTimesOut(t, tun.selfTestUdp)
+}
@@ -0,0 +1,35 @@
+package libcore
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+type TunSessionInfo struct {
+	StartedAt int64 `json:"started_at"`
+	Uptime    int64 `json:"uptime"`
+
+	TcpConnections   uint32 `json:"tcp_connections"`
+	UdpConnections   uint32 `json:"udp_connections"`
+	TotalConnections uint32 `json:"total_connections"`
+}
+
+// SessionInfo summarizes the tun for the status UI as a JSON object: the
+// unix time it started at, its uptime in seconds and the connections it
+// handled since. Hijacked DNS queries count as UDP connections whether the
+// cache, the workers or any other upstream answered them. Unlike the app
+// stats the counts are kept with traffic statistics off and are not reset
+// by ResetAppTraffics.
+func (t *Tun2socks) SessionInfo() []byte {
+	info := TunSessionInfo{
+		StartedAt:      t.startedAt.Unix(),
+		Uptime:         int64(time.Since(t.startedAt).Seconds()),
+		TcpConnections: atomic.LoadUint32(&t.tcpHandled),
+		UdpConnections: atomic.LoadUint32(&t.udpHandled),
+	}
+	info.TotalConnections = info.TcpConnections + info.UdpConnections
+
+	content, _ := json.Marshal(info)
+	return content
+}
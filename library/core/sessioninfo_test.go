@@ -0,0 +1,42 @@
+package libcore
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// Queries answered from the cache never reach a session, they must be
+// counted all the same.
+func TestSessionInfoCountsCachedDns(t *testing.T) {
+	origin, _ := startTestOrigin(t)
+	tun := startTestTun(t, startTestCore(t, domainRoutingConfig(origin.Addr(), "blocked")))
+	tun.hijackDns = true
+	tun.SetDnsCache(true)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+	tun.dnsCache.store(packResponse(t, response))
+
+	for i := 0; i < 2; i++ {
+		packet := newTestUDPPacket(packResponse(t, query), "10.0.0.2:40000", "8.8.8.8:53")
+		tun.addPacket(packet)
+		select {
+		case <-packet.written:
+		case <-time.After(time.Second):
+			t.Fatal("query not answered from the cache")
+		}
+	}
+
+	var info TunSessionInfo
+	if err := json.Unmarshal(tun.SessionInfo(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.UdpConnections != 2 || info.TotalConnections != 2 {
+		t.Errorf("udp/total connections = %d/%d, want 2/2", info.UdpConnections, info.TotalConnections)
+	}
+}
@@ -0,0 +1,163 @@
+package libcore
+
+import (
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol/http"
+	"github.com/xtls/xray-core/common/protocol/tls"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/dns"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sniffConn peeks the first payload read from the app side of a relay. A
+// ClientHello split across segments is read whole first if wait is set.
+type sniffConn struct {
+	net.Conn
+	once    sync.Once
+	onSniff func(payload []byte)
+	wait    time.Duration
+
+	pending []byte
+	err     error
+}
+
+func (c *sniffConn) Read(b []byte) (n int, err error) {
+	if len(c.pending) > 0 {
+		n = copy(b, c.pending)
+		c.pending = c.pending[n:]
+		if len(c.pending) == 0 {
+			err, c.err = c.err, nil
+		}
+		return
+	}
+	if c.err != nil {
+		err, c.err = c.err, nil
+		return
+	}
+
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() {
+			payload := b[:n]
+			if c.wait > 0 && err == nil && tlsHelloIncomplete(payload) {
+				payload, c.err = c.readHello(append([]byte(nil), payload...))
+				extra := copy(b[n:], payload[n:])
+				c.pending = payload[n+extra:]
+				n += extra
+				if len(c.pending) == 0 {
+					err, c.err = c.err, nil
+				}
+			}
+			c.onSniff(payload)
+		})
+	}
+	return
+}
+
+const (
+	SniffingModeFull = iota
+	SniffingModeAuto
+	SniffingModeMetadataOnly
+)
+
+// SetSniffingMode sets which sniffers the core runs on flows when sniffing
+// is enabled. The metadata sniffer only recovers the domain of fakedns
+// addresses, while full sniffing, the default, also reads the TLS SNI or
+// HTTP Host of the first payload, which delays routing until the app sends
+// it. Auto uses metadata only for flows to a fake address, the domain is
+// known right away then, and full sniffing for the others so SNI routing
+// keeps working. Forcing metadata only routes flows to real addresses by
+// IP.
+func (t *Tun2socks) SetSniffingMode(mode int32) {
+	atomic.StoreInt32(&t.sniffingMode, mode)
+}
+
+// sniffingContent asks the dispatcher to route dest by the sniffed domain.
+// The payload sniffers always override the destination, so domain rules
+// also match without fakedns, in which case fakedns is left out of the list
+// to not rewrite destinations that happen to fall in a stale fake ip range.
+// Entries are matched as prefixes of the sniffed protocol, so "http" covers
+// the "http1" Host header of plaintext requests as well as "http2".
+func (t *Tun2socks) sniffingContent(dest v2rayNet.Destination) *session.Content {
+	req := session.SniffingRequest{
+		Enabled:      true,
+		MetadataOnly: false,
+	}
+	switch atomic.LoadInt32(&t.sniffingMode) {
+	case SniffingModeMetadataOnly:
+		req.MetadataOnly = true
+	case SniffingModeAuto:
+		req.MetadataOnly = t.fakeDomain(dest) != ""
+	}
+	if !t.fakedns {
+		req.OverrideDestinationForProtocol = []string{"http", "tls"}
+	} else {
+		req.OverrideDestinationForProtocol = []string{"fakedns", "http", "tls"}
+	}
+	content := &session.Content{
+		SniffingRequest: req,
+	}
+	setAddressFamily(content, atomic.LoadInt32(&t.domainFamily))
+	return content
+}
+
+func sniffDomain(payload []byte) string {
+	if header, err := tls.SniffTLS(payload); err == nil {
+		return header.Domain()
+	}
+	if header, err := http.SniffHTTP(payload); err == nil {
+		return header.Domain()
+	}
+	return ""
+}
+
+func (t *Tun2socks) fakeDomain(dest v2rayNet.Destination) string {
+	if !t.fakedns || !dest.Address.Family().IsIP() {
+		return ""
+	}
+	v2ray := t.getV2Ray()
+	if v2ray == nil || v2ray.core == nil {
+		return ""
+	}
+	engine, ok := v2ray.core.GetFeature((*dns.FakeDNSEngine)(nil)).(dns.FakeDNSEngine)
+	if !ok {
+		return ""
+	}
+	return engine.GetDomainFromFakeDNS(dest.Address)
+}
+
+// sniffedDestination returns the domain destination the core will route
+// dest to, or an empty string if sniffing does not rewrite it. fake reports
+// whether the domain was recovered from fakedns rather than the payload,
+// which is the only way for UDP flows such as QUIC.
+func (t *Tun2socks) sniffedDestination(dest v2rayNet.Destination, payload []byte) (sniffed string, fake bool) {
+	domain := t.fakeDomain(dest)
+	fake = domain != ""
+	if domain == "" && payload != nil {
+		domain = sniffDomain(payload)
+	}
+	if domain == "" || domain == dest.Address.String() {
+		return "", false
+	}
+	return net.JoinHostPort(domain, dest.Port.String()), fake
+}
+
+func (t *Tun2socks) onSniffed(tag string, entry *connEntry, dest v2rayNet.Destination, payload []byte) {
+	sniffed, fake := t.sniffedDestination(dest, payload)
+	if sniffed == "" {
+		return
+	}
+	entry.setSniffed(sniffed)
+	t.applyDomainLimit(entry, sniffed)
+	if t.debug {
+		if fake {
+			log.Infof("[%s] fakedns %s -> %s", tag, dest.NetAddr(), sniffed)
+		} else {
+			log.Infof("[%s] sniffed %s -> %s", tag, dest.NetAddr(), sniffed)
+		}
+	}
+}
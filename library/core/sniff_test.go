@@ -0,0 +1,175 @@
+package libcore
+
+import (
+	"context"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	v2rayCore "github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffingContentWithoutFakedns(t *testing.T) {
+	tun := &Tun2socks{sniffing: true}
+	content := tun.sniffingContent(v2rayNet.TCPDestination(v2rayNet.ParseAddress("203.0.113.1"), 443))
+	req := content.SniffingRequest
+	if !req.Enabled || req.MetadataOnly {
+		t.Fatalf("sniffing request %+v, want payload sniffing", req)
+	}
+	if strings.Join(req.OverrideDestinationForProtocol, ",") != "http,tls" {
+		t.Fatalf("override list %v, want http and tls only", req.OverrideDestinationForProtocol)
+	}
+}
+
+func TestSniffingModes(t *testing.T) {
+	instance := startTestCore(t, `{
+  "log": {"loglevel": "none"},
+  "fakedns": {"ipPool": "198.18.0.0/15", "poolSize": 64},
+  "outbounds": [{"protocol": "freedom"}]
+}`)
+	engine := instance.core.GetFeature((*dns.FakeDNSEngine)(nil)).(dns.FakeDNSEngine)
+	fake := v2rayNet.TCPDestination(engine.GetFakeIPForDomain("example.com")[0], 443)
+	public := v2rayNet.TCPDestination(v2rayNet.ParseAddress("203.0.113.1"), 443)
+
+	tun := &Tun2socks{sniffing: true, fakedns: true, v2ray: instance}
+	for _, test := range []struct {
+		name     string
+		mode     int32
+		fake     bool
+		public   bool
+		defaults bool
+	}{
+		{"full by default", SniffingModeFull, false, false, true},
+		{"auto", SniffingModeAuto, true, false, false},
+		{"metadata only", SniffingModeMetadataOnly, true, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if !test.defaults {
+				tun.SetSniffingMode(test.mode)
+			}
+			if metadataOnly := tun.sniffingContent(fake).SniffingRequest.MetadataOnly; metadataOnly != test.fake {
+				t.Errorf("metadata only for a fake address = %v, want %v", metadataOnly, test.fake)
+			}
+			if metadataOnly := tun.sniffingContent(public).SniffingRequest.MetadataOnly; metadataOnly != test.public {
+				t.Errorf("metadata only for a real address = %v, want %v", metadataOnly, test.public)
+			}
+		})
+	}
+}
+
+// TestSniffingRoutesByDomainWithoutFakedns dials a real address through a
+// core whose only domain rule blackholes blocked.example, so an HTTP
+// request only gets blocked if the sniffed Host replaced the destination.
+func TestSniffingRoutesByDomainWithoutFakedns(t *testing.T) {
+	origin, accepted := startTestOrigin(t)
+	instance := startTestCore(t, domainRoutingConfig(origin.Addr(), "blocked.example"))
+	tun := &Tun2socks{sniffing: true, v2ray: instance}
+	dest := v2rayNet.TCPDestination(v2rayNet.ParseAddress("127.0.0.1"), v2rayNet.Port(originPort(t, origin.Addr())))
+
+	for _, test := range []struct {
+		host    string
+		blocked bool
+	}{
+		{"blocked.example", true},
+		{"allowed.example", false},
+	} {
+		t.Run(test.host, func(t *testing.T) {
+			ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "socks"})
+			ctx = session.ContextWithContent(ctx, tun.sniffingContent(dest))
+			conn, err := v2rayCore.Dial(ctx, instance.core, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			request := "GET / HTTP/1.1\r\nHost: " + test.host + "\r\n\r\n"
+			if _, err := conn.Write([]byte(request)); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case relayed := <-accepted:
+				defer relayed.Close()
+				if test.blocked {
+					t.Fatal("request to the blocked domain reached the origin")
+				}
+				_ = relayed.SetReadDeadline(time.Now().Add(5 * time.Second))
+				received := make([]byte, len(request))
+				if _, err := io.ReadFull(relayed, received); err != nil {
+					t.Fatal(err)
+				}
+				if string(received) != request {
+					t.Fatalf("origin received %q, want %q", received, request)
+				}
+			case <-time.After(time.Second):
+				if !test.blocked {
+					t.Fatal("request never reached the origin")
+				}
+			}
+		})
+	}
+}
+
+// TestRelayRoutesHttpByHost sends a plaintext HTTP request through Add, so
+// the Host header must be sniffed on the relayed connection for the
+// request to blocked.example to be blackholed.
+func TestRelayRoutesHttpByHost(t *testing.T) {
+	tun, accepted, closed := startRelayTest(t)
+	tun.sniffing = true
+
+	for _, test := range []struct {
+		host    string
+		blocked bool
+	}{
+		{"blocked", true},
+		{"allowed.example", false},
+	} {
+		t.Run(test.host, func(t *testing.T) {
+			request := "GET / HTTP/1.1\r\nHost: " + test.host + "\r\n\r\n"
+			received := make(chan string, 1)
+			if !test.blocked {
+				go func() {
+					select {
+					case relayed := <-accepted:
+						buf := make([]byte, len(request))
+						_ = relayed.SetReadDeadline(time.Now().Add(5 * time.Second))
+						_, _ = io.ReadFull(relayed, buf)
+						received <- string(buf)
+						_ = relayed.Close()
+					case <-time.After(5 * time.Second):
+						received <- ""
+					}
+				}()
+			}
+
+			app, peer := net.Pipe()
+			go func() {
+				_, _ = peer.Write([]byte(request))
+				_, _ = io.Copy(io.Discard, peer)
+			}()
+			relay(t, tun, app)
+
+			if test.blocked {
+				select {
+				case relayed := <-accepted:
+					_ = relayed.Close()
+					t.Fatal("request to the blocked domain reached the origin")
+				case <-time.After(200 * time.Millisecond):
+				}
+			} else if relayed := <-received; relayed != request {
+				t.Fatalf("origin received %q, want %q", relayed, request)
+			}
+
+			closed.access.Lock()
+			conn := closed.conns[len(closed.conns)-1]
+			closed.access.Unlock()
+			if conn.SniffedDestination != test.host+":80" {
+				t.Errorf("sniffed destination %q, want %q", conn.SniffedDestination, test.host+":80")
+			}
+		})
+	}
+}
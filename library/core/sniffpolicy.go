@@ -0,0 +1,34 @@
+package libcore
+
+// SniffPolicy decides per connection whether it is sniffed.
+type SniffPolicy interface {
+	ShouldSniff(destination string, uid int32) bool
+}
+
+// SetSniffPolicy lets policy decide for each new connection whether the
+// core sniffs it, overriding the sniffing flag of the tun, which applies
+// again once it is set to nil. destination is the ip:port the app
+// connects to and uid its uid, 0 if unknown. Skipping sniffing for
+// destinations that do not need domain routing, such as trusted or LAN
+// ones, saves the wait for the first payload before the core routes and
+// dials, which is most noticeable for protocols where the server speaks
+// first. Connections the policy sniffs while the flag is off are not
+// served from the warm pool, and blocked outbound detection follows the
+// flag.
+func (t *Tun2socks) SetSniffPolicy(policy SniffPolicy) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.sniffPolicy = policy
+}
+
+func (t *Tun2socks) shouldSniff(destination string, uid uint16) bool {
+	t.access.Lock()
+	policy := t.sniffPolicy
+	t.access.Unlock()
+
+	if policy == nil {
+		return t.sniffing
+	}
+	return policy.ShouldSniff(destination, int32(uid))
+}
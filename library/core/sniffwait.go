@@ -0,0 +1,86 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSniffHelloWait = 300
+
+	// sniffHelloMaxSize bounds what is buffered waiting for a ClientHello,
+	// a record can not be larger.
+	sniffHelloMaxSize = 5 + 1<<14
+)
+
+// SetSniffHelloWait sets how long in milliseconds the first read of a
+// relayed TCP connection waits for the rest of a TLS ClientHello split
+// across several segments, as the large ones of post-quantum key shares
+// are, so the sniffer and the TLS metadata see it whole. Whatever arrived
+// when it expires is relayed as is, and the core then routes by IP if the
+// SNI can not be read. Other payloads are never held. The default is
+// 300ms, zero disables it.
+func (t *Tun2socks) SetSniffHelloWait(timeout int32) {
+	atomic.StoreInt32(&t.sniffHelloWait, timeout)
+}
+
+func (t *Tun2socks) getSniffHelloWait() time.Duration {
+	return time.Duration(atomic.LoadInt32(&t.sniffHelloWait)) * time.Millisecond
+}
+
+// tlsHelloIncomplete reports whether payload starts with a TLS handshake
+// whose first message is not complete yet.
+func tlsHelloIncomplete(payload []byte) bool {
+	if len(payload) < 1 || payload[0] != 0x16 {
+		return false
+	}
+	if len(payload) < 5+4 {
+		return true
+	}
+	if payload[5] != 0x01 {
+		return false
+	}
+	message := 4 + (int(payload[6])<<16 | int(payload[7])<<8 | int(payload[8]))
+
+	// the message may span several records
+	var handshake int
+	for offset := 0; offset+5 <= len(payload); {
+		if payload[offset] != 0x16 {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(payload[offset+3:]))
+		available := len(payload) - offset - 5
+		if available < length {
+			handshake += available
+			break
+		}
+		handshake += length
+		offset += 5 + length
+	}
+	return handshake < message
+}
+
+// readHello reads on into buffer until the ClientHello it starts is
+// complete, the wait expires or the read fails. A read error other than
+// the deadline is returned for after the buffered payload.
+func (c *sniffConn) readHello(buffer []byte) ([]byte, error) {
+	deadline := time.Now().Add(c.wait)
+	_ = c.Conn.SetReadDeadline(deadline)
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	chunk := make([]byte, sniffHelloMaxSize)
+	for tlsHelloIncomplete(buffer) && len(buffer) < sniffHelloMaxSize {
+		n, err := c.Conn.Read(chunk[:sniffHelloMaxSize-len(buffer)])
+		buffer = append(buffer, chunk[:n]...)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return buffer, nil
+			}
+			return buffer, err
+		}
+	}
+	return buffer, nil
+}
@@ -0,0 +1,99 @@
+package libcore
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tlsRecords builds a ClientHello with a body of size bytes, split into
+// handshake records of at most fragment bytes.
+func tlsRecords(size int, fragment int) []byte {
+	message := append([]byte{0x01, byte(size >> 16), byte(size >> 8), byte(size)}, bytes.Repeat([]byte{0xab}, size)...)
+	var records []byte
+	for len(message) > 0 {
+		n := fragment
+		if n > len(message) {
+			n = len(message)
+		}
+		records = append(records, 0x16, 0x03, 0x01, byte(n>>8), byte(n))
+		records = append(records, message[:n]...)
+		message = message[n:]
+	}
+	return records
+}
+
+func TestSniffHelloWait(t *testing.T) {
+	hello := tlsRecords(600, 1<<14)
+	multi := tlsRecords(600, 200)
+	for _, test := range []struct {
+		name    string
+		chunks  [][]byte
+		reset   bool
+		read    []byte
+		sniffed []byte
+		err     bool
+	}{
+		{"split hello", [][]byte{hello[:100], hello[100:]}, false, hello, hello, false},
+		{"multi record hello", [][]byte{multi[:205], multi[205:410], multi[410:]}, false, multi, multi, false},
+		{"short header", [][]byte{hello[:3], hello[3:7], hello[7:]}, false, hello, hello, false},
+		{"timeout passes partial hello", [][]byte{hello[:100]}, false, hello[:100], hello[:100], false},
+		{"error after buffered data", [][]byte{hello[:100], hello[100:200]}, true, hello[:200], hello[:200], true},
+		{"not tls", [][]byte{[]byte("GET / HTTP/1.1\r\n"), []byte("\r\n")}, false, []byte("GET / HTTP/1.1\r\n"), []byte("GET / HTTP/1.1\r\n"), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			app, peer := net.Pipe()
+			defer peer.Close()
+			go func(chunks [][]byte, reset bool) {
+				for _, chunk := range chunks {
+					if _, err := peer.Write(chunk); err != nil {
+						return
+					}
+				}
+				if reset {
+					_ = peer.Close()
+				}
+			}(test.chunks, test.reset)
+
+			var conn net.Conn = app
+			if test.reset {
+				conn = &resetConn{app}
+			}
+			var sniffed []byte
+			sniff := &sniffConn{Conn: conn, wait: 100 * time.Millisecond, onSniff: func(payload []byte) {
+				sniffed = append([]byte(nil), payload...)
+			}}
+
+			// read in small pieces, so buffered data and the error are
+			// handed out over several reads
+			var read []byte
+			var err error
+			buf := make([]byte, 64)
+			for len(read) < len(test.read) && err == nil {
+				var n int
+				n, err = sniff.Read(buf)
+				read = append(read, buf[:n]...)
+			}
+			if err == nil && test.err {
+				_, err = sniff.Read(buf)
+			}
+
+			if !bytes.Equal(read, test.read) {
+				t.Errorf("read %d bytes, want %d", len(read), len(test.read))
+			}
+			if !bytes.Equal(sniffed, test.sniffed) {
+				t.Errorf("sniffed %d bytes, want %d", len(sniffed), len(test.sniffed))
+			}
+			if test.err {
+				if !errors.Is(err, syscall.ECONNRESET) {
+					t.Errorf("read error %v, want a reset", err)
+				}
+			} else if err != nil {
+				t.Errorf("read error %v", err)
+			}
+		})
+	}
+}
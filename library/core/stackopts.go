@@ -0,0 +1,64 @@
+package libcore
+
+import (
+	"fmt"
+	"github.com/xjasonlyu/tun2socks/core/stack"
+)
+
+const (
+	stackMinBufferSize     = 4 << 10
+	stackDefaultBufferSize = 212 << 10
+	stackMaxBufferSize     = 4 << 20
+	stackBufferSizeLimit   = 64 << 20
+)
+
+// StackOptions tunes the netstack, zero values keep the stack defaults.
+// Larger buffers favor bulk transfers, smaller ones interactive traffic.
+type StackOptions struct {
+	// TcpBufferSize is the initial size of the TCP send and receive
+	// buffers in bytes, which also bounds the advertised receive window.
+	TcpBufferSize int32
+
+	// TcpMaxBufferSize caps the buffers grown by receive buffer auto-tuning.
+	TcpMaxBufferSize int32
+
+	// CongestionControl is either "reno" or "cubic".
+	CongestionControl string
+}
+
+func NewStackOptions() *StackOptions {
+	return &StackOptions{}
+}
+
+func (o *StackOptions) options() ([]stack.Option, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	var opts []stack.Option
+	if o.TcpBufferSize != 0 || o.TcpMaxBufferSize != 0 {
+		size := int(o.TcpBufferSize)
+		if size == 0 {
+			size = stackDefaultBufferSize
+		}
+		maxSize := int(o.TcpMaxBufferSize)
+		if maxSize == 0 {
+			maxSize = stackMaxBufferSize
+			if size > maxSize {
+				maxSize = size
+			}
+		}
+		if size < stackMinBufferSize || maxSize > stackBufferSizeLimit || size > maxSize {
+			return nil, fmt.Errorf("invalid tcp buffer size %d/%d", size, maxSize)
+		}
+		opts = append(opts, stack.WithTCPBufferSizeRange(stackMinBufferSize, size, maxSize))
+	}
+	switch o.CongestionControl {
+	case "":
+	case "reno", "cubic":
+		opts = append(opts, stack.WithTCPCongestionControl(o.CongestionControl))
+	default:
+		return nil, fmt.Errorf("unknown congestion control algorithm %s", o.CongestionControl)
+	}
+	return opts, nil
+}
@@ -2,7 +2,9 @@ package libcore
 
 import (
 	"net"
+	"sort"
 	"sync/atomic"
+	"time"
 )
 
 type AppStats struct {
@@ -18,6 +20,14 @@ type AppStats struct {
 	DownlinkTotal int64
 
 	DeactivateAt int32
+
+	TcpConnRejected int32
+	UdpConnRejected int32
+
+	TcpUplinkTotal   int64
+	TcpDownlinkTotal int64
+	UdpUplinkTotal   int64
+	UdpDownlinkTotal int64
 }
 
 type appStats struct {
@@ -32,12 +42,86 @@ type appStats struct {
 	downlinkTotal uint64
 
 	deactivateAt int64
+
+	tcpConnRejected uint32
+	udpConnRejected uint32
+
+	// per protocol counters are cumulative, unlike uplink and downlink
+	// they are not reset by ReadAppTraffics.
+	tcpUplink   uint64
+	tcpDownlink uint64
+	udpUplink   uint64
+	udpDownlink uint64
+
+	// lastUsed is when the entry was last handed to a relay in unix
+	// nanoseconds, or appStatsRemoved once it is dropped from the map.
+	lastUsed int64
 }
 
 type TrafficListener interface {
 	UpdateStats(t *AppStats)
 }
 
+// getAppStats returns the entry of uid, creating it on first use. Known
+// uids are served from appStatsIndex without taking the access lock, so
+// connection setup only contends on it for new apps and once per prune
+// interval.
+func (t *Tun2socks) getAppStats(uid uint16) *appStats {
+	if !t.trafficStats {
+		return nil
+	}
+	now := time.Now()
+	if now.UnixNano()-atomic.LoadInt64(&t.appStatsPrunedAt) < int64(appStatsPruneInterval) {
+		if value, ok := t.appStatsIndex.Load(uid); ok {
+			stats := value.(*appStats)
+			if stats.touch(now) {
+				return stats
+			}
+		}
+	}
+
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.pruneAppStats(now)
+	stats := t.appStats[uid]
+	if stats == nil {
+		if t.appStatsLimit > 0 && len(t.appStats) >= t.appStatsLimit {
+			t.evictAppStats(now)
+		}
+		stats = &appStats{}
+		t.appStats[uid] = stats
+		t.appStatsIndex.Store(uid, stats)
+	}
+	atomic.StoreInt64(&stats.lastUsed, now.UnixNano())
+	return stats
+}
+
+// touch marks stats as used at now, false if it was removed meanwhile.
+func (s *appStats) touch(now time.Time) bool {
+	for {
+		lastUsed := atomic.LoadInt64(&s.lastUsed)
+		if lastUsed == appStatsRemoved {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.lastUsed, lastUsed, now.UnixNano()) {
+			return true
+		}
+	}
+}
+
+// removeAppStats drops the entry of uid unless it was used since lastUsed
+// was read, must be called with access held. The entry is marked removed
+// so the lock free path of getAppStats does not hand it out any more.
+func (t *Tun2socks) removeAppStats(uid uint16, stats *appStats, lastUsed int64) bool {
+	if !atomic.CompareAndSwapInt64(&stats.lastUsed, lastUsed, appStatsRemoved) {
+		return false
+	}
+	delete(t.appStats, uid)
+	t.appStatsIndex.Delete(uid)
+	return true
+}
+
 func (t *Tun2socks) GetTrafficStatsEnabled() bool {
 	return t.trafficStats
 }
@@ -48,23 +132,29 @@ func (t *Tun2socks) ResetAppTraffics() {
 	}
 
 	t.access.Lock()
-	var toDel []uint16
 	for uid, stat := range t.appStats {
 		atomic.StoreUint64(&stat.uplink, 0)
 		atomic.StoreUint64(&stat.downlink, 0)
 		atomic.StoreUint64(&stat.uplinkTotal, 0)
 		atomic.StoreUint64(&stat.downlinkTotal, 0)
-		if stat.tcpConn+stat.udpConn == 0 {
-			toDel = append(toDel, uid)
+		atomic.StoreUint64(&stat.tcpUplink, 0)
+		atomic.StoreUint64(&stat.tcpDownlink, 0)
+		atomic.StoreUint64(&stat.udpUplink, 0)
+		atomic.StoreUint64(&stat.udpDownlink, 0)
+		if appStatsIdle(stat) {
+			t.removeAppStats(uid, stat, atomic.LoadInt64(&stat.lastUsed))
 		}
 	}
-	for _, uid := range toDel {
-		delete(t.appStats, uid)
-	}
 	t.access.Unlock()
 }
 
 func (t *Tun2socks) ReadAppTraffics(listener TrafficListener) error {
+	return t.readAppTraffics(listener, false)
+}
+
+// readAppTraffics reports the deltas of every app, or with changedOnly
+// only those of the apps that had traffic since the last call.
+func (t *Tun2socks) readAppTraffics(listener TrafficListener, changedOnly bool) error {
 	if !t.trafficStats {
 		return nil
 	}
@@ -79,6 +169,14 @@ func (t *Tun2socks) ReadAppTraffics(listener TrafficListener) error {
 			TcpConnTotal: int32(stat.tcpConnTotal),
 			UdpConnTotal: int32(stat.udpConnTotal),
 			DeactivateAt: int32(stat.deactivateAt),
+
+			TcpConnRejected: int32(atomic.LoadUint32(&stat.tcpConnRejected)),
+			UdpConnRejected: int32(atomic.LoadUint32(&stat.udpConnRejected)),
+
+			TcpUplinkTotal:   int64(atomic.LoadUint64(&stat.tcpUplink)),
+			TcpDownlinkTotal: int64(atomic.LoadUint64(&stat.tcpDownlink)),
+			UdpUplinkTotal:   int64(atomic.LoadUint64(&stat.udpUplink)),
+			UdpDownlinkTotal: int64(atomic.LoadUint64(&stat.udpDownlink)),
 		}
 
 		uplink := atomic.SwapUint64(&stat.uplink, 0)
@@ -91,6 +189,9 @@ func (t *Tun2socks) ReadAppTraffics(listener TrafficListener) error {
 		export.Downlink = int64(downlink)
 		export.DownlinkTotal = int64(downlinkTotal)
 
+		if changedOnly && uplink == 0 && downlink == 0 {
+			continue
+		}
 		stats = append(stats, export)
 	}
 	t.access.Unlock()
@@ -102,44 +203,181 @@ func (t *Tun2socks) ReadAppTraffics(listener TrafficListener) error {
 	return nil
 }
 
+const (
+	StatsSortUid = iota
+	StatsSortUplink
+	StatsSortDownlink
+)
+
+// QueryAllStats reports a page of the per-app stats to listener, ordered
+// by uid or by total traffic in descending order. Unlike ReadAppTraffics
+// it leaves the deltas untouched, a limit of zero returns all entries.
+func (t *Tun2socks) QueryAllStats(listener TrafficListener, sortBy int32, offset int32, limit int32) error {
+	if !t.trafficStats {
+		return nil
+	}
+
+	var stats []*AppStats
+	t.access.Lock()
+	for uid, stat := range t.appStats {
+		uplink := atomic.LoadUint64(&stat.uplink)
+		downlink := atomic.LoadUint64(&stat.downlink)
+		stats = append(stats, &AppStats{
+			Uid:          int32(uid),
+			TcpConn:      atomic.LoadInt32(&stat.tcpConn),
+			UdpConn:      atomic.LoadInt32(&stat.udpConn),
+			TcpConnTotal: int32(atomic.LoadUint32(&stat.tcpConnTotal)),
+			UdpConnTotal: int32(atomic.LoadUint32(&stat.udpConnTotal)),
+			DeactivateAt: int32(atomic.LoadInt64(&stat.deactivateAt)),
+
+			Uplink:        int64(uplink),
+			Downlink:      int64(downlink),
+			UplinkTotal:   int64(atomic.LoadUint64(&stat.uplinkTotal) + uplink),
+			DownlinkTotal: int64(atomic.LoadUint64(&stat.downlinkTotal) + downlink),
+
+			TcpConnRejected: int32(atomic.LoadUint32(&stat.tcpConnRejected)),
+			UdpConnRejected: int32(atomic.LoadUint32(&stat.udpConnRejected)),
+
+			TcpUplinkTotal:   int64(atomic.LoadUint64(&stat.tcpUplink)),
+			TcpDownlinkTotal: int64(atomic.LoadUint64(&stat.tcpDownlink)),
+			UdpUplinkTotal:   int64(atomic.LoadUint64(&stat.udpUplink)),
+			UdpDownlinkTotal: int64(atomic.LoadUint64(&stat.udpDownlink)),
+		})
+	}
+	t.access.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		switch sortBy {
+		case StatsSortUplink:
+			if stats[i].UplinkTotal != stats[j].UplinkTotal {
+				return stats[i].UplinkTotal > stats[j].UplinkTotal
+			}
+		case StatsSortDownlink:
+			if stats[i].DownlinkTotal != stats[j].DownlinkTotal {
+				return stats[i].DownlinkTotal > stats[j].DownlinkTotal
+			}
+		}
+		return stats[i].Uid < stats[j].Uid
+	})
+
+	if offset < 0 {
+		offset = 0
+	}
+	if int(offset) >= len(stats) {
+		return nil
+	}
+	stats = stats[offset:]
+	if limit > 0 && int(limit) < len(stats) {
+		stats = stats[:limit]
+	}
+
+	for _, stat := range stats {
+		listener.UpdateStats(stat)
+	}
+
+	return nil
+}
+
+// SetStatsListener pushes the same deltas as ReadAppTraffics to listener
+// every interval milliseconds, a nil listener stops the updates.
+func (t *Tun2socks) SetStatsListener(listener TrafficListener, interval int32) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.statsListener = listener
+	t.statsInterval = time.Duration(interval) * time.Millisecond
+	t.restartStatsLoop()
+}
+
+// restartStatsLoop starts the listener updates over with the current
+// settings, must be called with access held.
+func (t *Tun2socks) restartStatsLoop() {
+	if t.statsStop != nil {
+		close(t.statsStop)
+		t.statsStop = nil
+	}
+	if t.statsListener == nil || t.statsInterval <= 0 || !t.trafficStats {
+		return
+	}
+
+	interval := t.statsInterval
+	lowPower := atomic.LoadInt32(&t.lowPowerStats) == 1
+	if lowPower && t.lowPowerInterval > interval {
+		interval = t.lowPowerInterval
+	}
+	stop := make(chan struct{})
+	t.statsStop = stop
+	go t.statsLoop(t.statsListener, interval, lowPower, stop)
+}
+
+func (t *Tun2socks) statsLoop(listener TrafficListener, interval time.Duration, lowPower bool, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_ = t.readAppTraffics(listener, lowPower)
+		}
+	}
+}
+
 type statsConn struct {
 	net.Conn
-	uplink   *uint64
-	downlink *uint64
+	uplink   *statsCounter
+	downlink *statsCounter
 }
 
 func (c *statsConn) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
-	defer atomic.AddUint64(c.downlink, uint64(n))
+	c.downlink.add(n)
 	return
 }
 
+// Write counts what was written even when it failed part way, a reset
+// may cut a write short after some of it was sent.
 func (c *statsConn) Write(b []byte) (n int, err error) {
 	n, err = c.Conn.Write(b)
-	if err == nil {
-		atomic.AddUint64(c.uplink, uint64(n))
-	}
+	c.uplink.add(n)
 	return
 }
 
+func (c *statsConn) Close() error {
+	c.flush()
+	return c.Conn.Close()
+}
+
+func (c *statsConn) flush() {
+	c.uplink.flush()
+	c.downlink.flush()
+}
+
 type statsPacketConn struct {
 	net.PacketConn
-	uplink   *uint64
-	downlink *uint64
+	uplink   *statsCounter
+	downlink *statsCounter
 }
 
-func (c statsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+func (c *statsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	n, addr, err = c.PacketConn.ReadFrom(p)
 	if err == nil {
-		atomic.AddUint64(c.downlink, uint64(n))
+		c.downlink.add(n)
 	}
 	return
 }
 
-func (c statsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+func (c *statsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	n, err = c.PacketConn.WriteTo(p, addr)
 	if err == nil {
-		atomic.AddUint64(c.uplink, uint64(n))
+		c.uplink.add(n)
 	}
 	return
 }
+
+func (c *statsPacketConn) Close() error {
+	c.uplink.flush()
+	c.downlink.flush()
+	return c.PacketConn.Close()
+}
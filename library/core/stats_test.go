@@ -0,0 +1,111 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStatsTun() *Tun2socks {
+	return &Tun2socks{trafficStats: true, appStats: map[uint16]*appStats{}}
+}
+
+func BenchmarkGetAppStats(b *testing.B) {
+	tun := newStatsTun()
+	for uid := uint16(10000); uid < 10100; uid++ {
+		tun.getAppStats(uid)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		uid := uint16(10000)
+		for pb.Next() {
+			tun.getAppStats(uid)
+			uid++
+			if uid == 10100 {
+				uid = 10000
+			}
+		}
+	})
+}
+
+// ageAppStats moves the last use of the idle entries a prune interval back,
+// as if they had not been used since.
+func ageAppStats(tun *Tun2socks) {
+	tun.access.Lock()
+	defer tun.access.Unlock()
+
+	for _, stats := range tun.appStats {
+		lastUsed := atomic.LoadInt64(&stats.lastUsed)
+		if lastUsed != appStatsRemoved && appStatsIdle(stats) {
+			atomic.CompareAndSwapInt64(&stats.lastUsed, lastUsed, lastUsed-2*int64(appStatsPruneInterval))
+		}
+	}
+	atomic.StoreInt64(&tun.appStatsPrunedAt, 0)
+}
+
+// Lookups of the lock free path race with prunes removing the entries they
+// find, which must neither hand out removed entries to connections nor
+// leave the map and the index disagreeing. Run with -race.
+func TestGetAppStatsConcurrentPrune(t *testing.T) {
+	tun := newStatsTun()
+	tun.SetAppStatsLimit(8)
+
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				uid := uint16(10000 + (i*7+n)%16)
+				stats := tun.getAppStats(uid)
+				if !reserveConn(&stats.tcpConn, 0) {
+					t.Error("unlimited reservation refused")
+					return
+				}
+				if lastUsed := atomic.LoadInt64(&stats.lastUsed); lastUsed == appStatsRemoved {
+					// removed before the connection was counted, the
+					// next lookup creates a new entry
+					atomic.AddInt32(&stats.tcpConn, -1)
+					continue
+				}
+				atomic.AddUint64(&stats.uplink, 1)
+				atomic.AddInt32(&stats.tcpConn, -1)
+			}
+		}(i)
+	}
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		ageAppStats(tun)
+		tun.getAppStats(20000)
+	}
+	close(stop)
+	workers.Wait()
+
+	tun.access.Lock()
+	defer tun.access.Unlock()
+	for uid, stats := range tun.appStats {
+		if atomic.LoadInt64(&stats.lastUsed) == appStatsRemoved {
+			t.Errorf("removed entry of %d still in the map", uid)
+		}
+		if value, ok := tun.appStatsIndex.Load(uid); !ok || value.(*appStats) != stats {
+			t.Errorf("index entry of %d differs from the map", uid)
+		}
+		if conns := atomic.LoadInt32(&stats.tcpConn); conns != 0 {
+			t.Errorf("%d connections left open on %d", conns, uid)
+		}
+	}
+	tun.appStatsIndex.Range(func(key, value interface{}) bool {
+		if tun.appStats[key.(uint16)] != value.(*appStats) {
+			t.Errorf("index entry of %d not in the map", key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,79 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// appStatsPruneInterval is how often unused per-app stats are pruned, and
+// how long a new entry is kept before it may be.
+const appStatsPruneInterval = time.Minute
+
+// appStatsRemoved marks an appStats entry dropped from the map.
+const appStatsRemoved = -1
+
+// SetAppStatsLimit caps the number of apps the traffic stats are kept for.
+// Once reached, the entry of the app without open connections that was
+// least recently used is evicted to make room, its totals are lost unless
+// read before. Apps with open connections or used within the last minute
+// are never evicted, so the cap may be exceeded while they are all busy.
+// Independently of it, entries of apps without connections or traffic
+// since the last reset are pruned every minute. Zero means no cap.
+func (t *Tun2socks) SetAppStatsLimit(maxEntries int32) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.appStatsLimit = int(maxEntries)
+}
+
+// appStatsIdle tells whether stats has no open connections.
+func appStatsIdle(stats *appStats) bool {
+	return atomic.LoadInt32(&stats.tcpConn)+atomic.LoadInt32(&stats.udpConn) == 0
+}
+
+func appStatsEmpty(stats *appStats) bool {
+	return atomic.LoadUint64(&stats.uplink) == 0 &&
+		atomic.LoadUint64(&stats.downlink) == 0 &&
+		atomic.LoadUint64(&stats.uplinkTotal) == 0 &&
+		atomic.LoadUint64(&stats.downlinkTotal) == 0
+}
+
+// pruneAppStats drops the unused entries, must be called with access held.
+// Entries are only considered once they are older than the interval, so
+// one just handed out to a relay that has not opened its connection yet
+// is kept.
+func (t *Tun2socks) pruneAppStats(now time.Time) {
+	if now.UnixNano()-atomic.LoadInt64(&t.appStatsPrunedAt) < int64(appStatsPruneInterval) {
+		return
+	}
+	atomic.StoreInt64(&t.appStatsPrunedAt, now.UnixNano())
+
+	threshold := now.Add(-appStatsPruneInterval).UnixNano()
+	for uid, stats := range t.appStats {
+		lastUsed := atomic.LoadInt64(&stats.lastUsed)
+		if lastUsed < threshold && appStatsIdle(stats) && appStatsEmpty(stats) {
+			t.removeAppStats(uid, stats, lastUsed)
+		}
+	}
+}
+
+// evictAppStats drops the least recently used entry without open
+// connections, must be called with access held.
+func (t *Tun2socks) evictAppStats(now time.Time) {
+	threshold := now.Add(-appStatsPruneInterval).UnixNano()
+	var victim uint16
+	var victimUsed int64
+	found := false
+	for uid, stats := range t.appStats {
+		lastUsed := atomic.LoadInt64(&stats.lastUsed)
+		if lastUsed >= threshold || !appStatsIdle(stats) {
+			continue
+		}
+		if !found || lastUsed < victimUsed {
+			victim, victimUsed, found = uid, lastUsed, true
+		}
+	}
+	if found && t.removeAppStats(victim, t.appStats[victim], victimUsed) {
+		atomic.AddUint32(&t.appStatsEvicted, 1)
+	}
+}
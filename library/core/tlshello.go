@@ -0,0 +1,182 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// TlsHello is what the ClientHello opening a TLS connection tells in the
+// clear, read from the first payload without touching the connection.
+type TlsHello struct {
+	ConnectionId int64
+	Uid          int32
+	Source       string
+	Destination  string
+
+	ServerName string
+	// Alpn lists the offered application protocols, comma separated.
+	Alpn string
+	// Version is the highest version offered, such as "TLS 1.3".
+	Version string
+}
+
+// TlsHelloListener is told about every TLS connection opened through the
+// tun, for auditing what apps connect to.
+type TlsHelloListener interface {
+	OnTlsHello(hello *TlsHello)
+}
+
+// SetTlsHelloListener sets the listener for TLS connections, nil disables
+// it. The metadata is also reported with the connections either way. A
+// ClientHello split across TCP segments is put back together within the
+// wait set with SetSniffHelloWait, one split across TLS records and QUIC
+// hellos are not reported.
+func (t *Tun2socks) SetTlsHelloListener(listener TlsHelloListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.tlsListener = listener
+}
+
+func (t *Tun2socks) onTlsHello(entry *connEntry, payload []byte) {
+	hello, ok := parseClientHello(payload)
+	if !ok {
+		return
+	}
+	entry.tlsHello.Store(hello)
+
+	t.access.Lock()
+	listener := t.tlsListener
+	t.access.Unlock()
+
+	if listener != nil {
+		export := *hello
+		export.ConnectionId = entry.id
+		export.Uid = int32(entry.uid)
+		export.Source = entry.source
+		export.Destination = entry.destination
+		listener.OnTlsHello(&export)
+	}
+}
+
+var tlsVersionNames = map[uint16]string{
+	0x0300: "SSL 3.0",
+	0x0301: "TLS 1.0",
+	0x0302: "TLS 1.1",
+	0x0303: "TLS 1.2",
+	0x0304: "TLS 1.3",
+}
+
+const (
+	tlsExtensionServerName        = 0
+	tlsExtensionAlpn              = 16
+	tlsExtensionSupportedVersions = 43
+)
+
+// tlsReader reads the length prefixed fields of a handshake message, once
+// out of bounds every read fails.
+type tlsReader struct {
+	data []byte
+	ok   bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if !r.ok || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) uint8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *tlsReader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+func (r *tlsReader) vector8() *tlsReader {
+	return &tlsReader{data: r.bytes(r.uint8()), ok: r.ok}
+}
+
+func (r *tlsReader) vector16() *tlsReader {
+	return &tlsReader{data: r.bytes(r.uint16()), ok: r.ok}
+}
+
+// parseClientHello reads the server name, ALPN protocols and version out of
+// a TLS record holding a ClientHello.
+func parseClientHello(payload []byte) (*TlsHello, bool) {
+	record := &tlsReader{data: payload, ok: true}
+	if record.uint8() != 0x16 {
+		return nil, false
+	}
+	record.bytes(2)
+	message := record.vector16()
+	if message.uint8() != 0x01 {
+		return nil, false
+	}
+	length := message.bytes(3)
+	if !message.ok {
+		return nil, false
+	}
+	body := &tlsReader{data: message.bytes(int(length[0])<<16 | int(length[1])<<8 | int(length[2])), ok: message.ok}
+
+	version := uint16(body.uint16())
+	body.bytes(32)
+	body.vector8()
+	body.vector16()
+	body.vector8()
+	if !body.ok {
+		return nil, false
+	}
+
+	hello := &TlsHello{}
+	extensions := body.vector16()
+	for extensions.ok && len(extensions.data) > 0 {
+		extensionType := extensions.uint16()
+		extension := extensions.vector16()
+		switch extensionType {
+		case tlsExtensionServerName:
+			names := extension.vector16()
+			for names.ok && len(names.data) > 0 {
+				nameType := names.uint8()
+				name := names.vector16()
+				if nameType == 0 && name.ok {
+					hello.ServerName = string(name.data)
+				}
+			}
+		case tlsExtensionAlpn:
+			var protocols []string
+			list := extension.vector16()
+			for list.ok && len(list.data) > 0 {
+				if protocol := list.vector8(); protocol.ok {
+					protocols = append(protocols, string(protocol.data))
+				}
+			}
+			hello.Alpn = strings.Join(protocols, ",")
+		case tlsExtensionSupportedVersions:
+			versions := extension.vector8()
+			for versions.ok && len(versions.data) >= 2 {
+				offered := uint16(versions.uint16())
+				if offered&0x0f0f != 0x0a0a && offered > version {
+					version = offered
+				}
+			}
+		}
+	}
+	if name, ok := tlsVersionNames[version]; ok {
+		hello.Version = name
+	}
+	return hello, true
+}
@@ -0,0 +1,127 @@
+package libcore
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first record crypto/tls sends for config.
+func clientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, config).Handshake()
+		_ = client.Close()
+	}()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// withGreaseVersion offers a GREASE version first in the supported_versions
+// extension of hello, as browsers do.
+func withGreaseVersion(t *testing.T, hello []byte) []byte {
+	t.Helper()
+	grow := func(b []byte) {
+		binary.BigEndian.PutUint16(b, binary.BigEndian.Uint16(b)+2)
+	}
+	// record, handshake message, version, random, session id, cipher
+	// suites, compression methods
+	offset := 5 + 4 + 2 + 32
+	offset += 1 + int(hello[offset])
+	offset += 2 + int(binary.BigEndian.Uint16(hello[offset:]))
+	offset += 1 + int(hello[offset])
+	extensions := offset
+	for offset += 2; offset < len(hello); {
+		extensionType := binary.BigEndian.Uint16(hello[offset:])
+		length := int(binary.BigEndian.Uint16(hello[offset+2:]))
+		if extensionType != tlsExtensionSupportedVersions {
+			offset += 4 + length
+			continue
+		}
+		grown := append(append(append([]byte(nil), hello[:offset+5]...), 0xfa, 0xfa), hello[offset+5:]...)
+		grown[offset+4] += 2
+		grow(grown[offset+2:])
+		grow(grown[extensions:])
+		grow(grown[3:])
+		// the handshake length is 24 bits, following the message type
+		binary.BigEndian.PutUint32(grown[5:], binary.BigEndian.Uint32(grown[5:])+2)
+		return grown
+	}
+	t.Fatal("no supported_versions extension")
+	return nil
+}
+
+func TestParseClientHello(t *testing.T) {
+	tls13 := &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}}
+	for _, test := range []struct {
+		name  string
+		hello []byte
+		want  TlsHello
+	}{
+		{"tls 1.3", clientHello(t, tls13), TlsHello{ServerName: "example.com", Alpn: "h2,http/1.1", Version: "TLS 1.3"}},
+		{"grease", withGreaseVersion(t, clientHello(t, tls13)), TlsHello{ServerName: "example.com", Alpn: "h2,http/1.1", Version: "TLS 1.3"}},
+		{"tls 1.2", clientHello(t, &tls.Config{ServerName: "example.org", MaxVersion: tls.VersionTLS12}), TlsHello{ServerName: "example.org", Version: "TLS 1.2"}},
+		{"ip address", clientHello(t, &tls.Config{ServerName: "192.0.2.1", NextProtos: []string{"dot"}}), TlsHello{Alpn: "dot", Version: "TLS 1.3"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hello, ok := parseClientHello(test.hello)
+			if !ok {
+				t.Fatal("not parsed")
+			}
+			if *hello != test.want {
+				t.Errorf("parsed %+v, want %+v", *hello, test.want)
+			}
+		})
+	}
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	hello := clientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2"}})
+	for n := 0; n < len(hello); n++ {
+		if _, ok := parseClientHello(hello[:n]); ok {
+			t.Fatalf("parsed the first %d of %d bytes", n, len(hello))
+		}
+	}
+}
+
+func TestParseClientHelloGarbage(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		garbage := make([]byte, random.Intn(512))
+		random.Read(garbage)
+		if len(garbage) > 0 && i%2 == 0 {
+			// get past the record type check to reach the length parsing
+			garbage[0] = 0x16
+		}
+		_, _ = parseClientHello(garbage)
+	}
+
+	hello := clientHello(t, &tls.Config{ServerName: "example.com"})
+	serverHello := append([]byte(nil), hello...)
+	serverHello[5] = 0x02
+	applicationData := append([]byte(nil), hello...)
+	applicationData[0] = 0x17
+	for name, payload := range map[string][]byte{
+		"http":             []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		"server hello":     serverHello,
+		"application data": applicationData,
+	} {
+		if _, ok := parseClientHello(payload); ok {
+			t.Errorf("%s parsed as a ClientHello", name)
+		}
+	}
+}
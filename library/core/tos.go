@@ -0,0 +1,65 @@
+package libcore
+
+import (
+	"context"
+	"github.com/xtls/xray-core/common/session"
+	"strconv"
+	"sync/atomic"
+)
+
+const tosAttribute = "libcore-tos"
+
+// SetPreserveTos copies the DSCP/ECN byte of the first packet of a flow
+// to the outbound socket of its connection. It inspects every packet read
+// from the tun, so it is off by default.
+func (t *Tun2socks) SetPreserveTos(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&t.preserveTos, 1)
+	} else {
+		atomic.StoreInt32(&t.preserveTos, 0)
+	}
+}
+
+func (t *Tun2socks) inspectTos(packet []byte) {
+	if atomic.LoadInt32(&t.preserveTos) == 0 || len(packet) < 2 {
+		return
+	}
+	var tos byte
+	switch packet[0] >> 4 {
+	case 4:
+		tos = packet[1]
+	case 6:
+		tos = packet[0]<<4 | packet[1]>>4
+	}
+	if tos == 0 {
+		return
+	}
+	if network, src, ok := t.flowStart(packet); ok {
+		t.tosMarks.put(network+":"+src, tos)
+	}
+}
+
+// withTos marks the session so the protected dialer applies the byte the
+// flow from source was sent with, if any.
+func (t *Tun2socks) withTos(ctx context.Context, network string, source string) context.Context {
+	tos, ok := t.tosMarks.take(network + ":" + source)
+	if !ok {
+		return ctx
+	}
+	content := session.ContentFromContext(ctx)
+	if content == nil {
+		content = &session.Content{}
+		ctx = session.ContextWithContent(ctx, content)
+	}
+	content.SetAttribute(tosAttribute, strconv.Itoa(int(tos)))
+	return ctx
+}
+
+func tosFromContext(ctx context.Context) int {
+	content := session.ContentFromContext(ctx)
+	if content == nil {
+		return 0
+	}
+	tos, _ := strconv.Atoi(content.Attribute(tosAttribute))
+	return tos
+}
@@ -0,0 +1,69 @@
+package libcore
+
+import "net"
+
+// UdpTransformer rewrites the payloads of relayed UDP packets. Transform is
+// called for every packet of the sessions it applies to, with local the
+// address of the app and remote the address of the peer, and returns the
+// payload to pass on, the same slice if unchanged. An empty payload drops
+// the packet, so zero-length datagrams are passed on without calling it.
+// It runs on the relay goroutines and must not block.
+type UdpTransformer interface {
+	Transform(uplink bool, local string, remote string, payload []byte) []byte
+}
+
+// SetUdpTransformer sets the transformer applied to UDP sessions set up
+// from now on, nil disables it. Hijacked DNS queries are not passed to it.
+func (t *Tun2socks) SetUdpTransformer(transformer UdpTransformer) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.transformer = transformer
+}
+
+// transformedPacketConn wraps conn to pass its payloads to the transformer,
+// conn is returned as is if none is set.
+func (t *Tun2socks) transformedPacketConn(conn net.PacketConn, local string) net.PacketConn {
+	t.access.Lock()
+	transformer := t.transformer
+	t.access.Unlock()
+
+	if transformer == nil {
+		return conn
+	}
+	return &transformPacketConn{conn, transformer, local}
+}
+
+type transformPacketConn struct {
+	net.PacketConn
+	transformer UdpTransformer
+	local       string
+}
+
+func (c *transformPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || n == 0 {
+			return
+		}
+		payload := c.transformer.Transform(false, c.local, addr.String(), p[:n])
+		if len(payload) == 0 {
+			continue
+		}
+		return copy(p, payload), addr, nil
+	}
+}
+
+func (c *transformPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if len(p) == 0 {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	payload := c.transformer.Transform(true, c.local, addr.String(), p)
+	if len(payload) == 0 {
+		return len(p), nil
+	}
+	if _, err = c.PacketConn.WriteTo(payload, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,76 @@
+package libcore
+
+import (
+	"context"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"strconv"
+	"sync/atomic"
+)
+
+const ttlAttribute = "libcore-ttl"
+
+// SetPreserveTtl copies the TTL or hop limit of the first packet of a flow
+// to its outbound socket, so tools probing with a low TTL see it honoured.
+// This is best effort: it only applies when the core dials the destination
+// directly, a proxy server socket keeps the system default since a low TTL
+// there would never reach the server, and ICMP time exceeded replies are
+// not relayed back to the app. It inspects every packet read from the tun,
+// so it is off by default.
+func (t *Tun2socks) SetPreserveTtl(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&t.preserveTtl, 1)
+	} else {
+		atomic.StoreInt32(&t.preserveTtl, 0)
+	}
+}
+
+func (t *Tun2socks) inspectTtl(packet []byte) {
+	if atomic.LoadInt32(&t.preserveTtl) == 0 || len(packet) < 9 {
+		return
+	}
+	var ttl byte
+	switch packet[0] >> 4 {
+	case 4:
+		ttl = packet[8]
+	case 6:
+		ttl = packet[7]
+	}
+	if ttl == 0 {
+		return
+	}
+	if network, src, ok := t.flowStart(packet); ok {
+		t.ttlMarks.put(network+":"+src, ttl)
+	}
+}
+
+// withTtl marks the session so the protected dialer applies the TTL the
+// flow from source was sent with, if any.
+func (t *Tun2socks) withTtl(ctx context.Context, network string, source string) context.Context {
+	ttl, ok := t.ttlMarks.take(network + ":" + source)
+	if !ok {
+		return ctx
+	}
+	content := session.ContentFromContext(ctx)
+	if content == nil {
+		content = &session.Content{}
+		ctx = session.ContextWithContent(ctx, content)
+	}
+	content.SetAttribute(ttlAttribute, strconv.Itoa(int(ttl)))
+	return ctx
+}
+
+// ttlFromContext returns the TTL to dial destination with, zero unless the
+// session has one and destination is its own target.
+func ttlFromContext(ctx context.Context, destination v2rayNet.Destination) int {
+	content := session.ContentFromContext(ctx)
+	if content == nil {
+		return 0
+	}
+	outbound := session.OutboundFromContext(ctx)
+	if outbound == nil || outbound.Target.NetAddr() != destination.NetAddr() {
+		return 0
+	}
+	ttl, _ := strconv.Atoi(content.Attribute(ttlAttribute))
+	return ttl
+}
@@ -2,22 +2,23 @@ package libcore
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/Dreamacro/clash/common/pool"
-	"github.com/miekg/dns"
 	"github.com/xjasonlyu/tun2socks/core"
 	"github.com/xjasonlyu/tun2socks/core/device/rwbased"
 	"github.com/xjasonlyu/tun2socks/core/stack"
 	"github.com/xjasonlyu/tun2socks/log"
+	v2rayLog "github.com/xtls/xray-core/common/log"
 	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
 	"github.com/xtls/xray-core/common/task"
 	v2rayCore "github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/transport/internet"
 	"io"
 	"net"
 	"os"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,9 +39,160 @@ type Tun2socks struct {
 	dumpUid      bool
 	trafficStats bool
 	appStats     map[uint16]*appStats
-}
 
-var uidDumper UidDumper
+	statsStop    chan struct{}
+	domainFamily int32
+	idleTimeout  int32
+	blockAction  int32
+	lanPolicy    int32
+	preserveTos  int32
+	tosMarks     flowMarks
+	preserveTtl  int32
+	ttlMarks     flowMarks
+	dnsQueries   uint32
+	dialFailures uint32
+	dnsDropped   uint32
+	udpDropped   uint32
+	udpSetupTime int32
+	dnsLimit     dnsLimiter
+	dnsCache     dnsCache
+	dnsMinTTL    int32
+	dnsMaxTTL    int32
+	conns        connRegistry
+	dnsPool      *dnsPool
+
+	closeListener ConnectionCloseListener
+
+	uplinkLimiter   *rateLimiter
+	downlinkLimiter *rateLimiter
+
+	capture    atomic.Value
+	connLimits map[uint16]connLimit
+	loops      loopDetector
+
+	metricsPackage bool
+
+	appListener AppListener
+	seenApps    map[uint16]struct{}
+
+	writebackSize      int32
+	udpDownlinkDropped uint32
+
+	disableIPv6 int32
+	ipv6Action  int32
+
+	inboundUser *protocol.MemoryUser
+
+	fallbackTag string
+	fallbacks   uint32
+
+	dnsMaxUdpSize int32
+	dnsTruncated  uint32
+
+	uidTags map[uint16]string
+	latency *latencyHistogram
+
+	pmtuRejected uint32
+
+	maxLifetime     int32
+	lifetimeExpired uint32
+
+	udpLinger         int32
+	dnsSessionTimeout int32
+	udpSessionTimeout int32
+
+	bufferLow  int
+	bufferHigh int
+
+	filter       ConnectionFilter
+	udpSetupWait *latencyHistogram
+	dnsLog       dnsLog
+
+	dnsMirror     atomic.Value
+	dnsTls        atomic.Value
+	dnsMismatches uint32
+
+	bypassNetworks []*net.IPNet
+	bypassPolicy   int32
+
+	uidListener UidResolveListener
+	uidFailures uint32
+
+	file     *os.File
+	ownsFile bool
+
+	detectBlocked    int32
+	blockedOutbounds uint32
+
+	sniffingMode int32
+
+	dnsInflight         atomic.Value
+	dnsInflightRejected uint32
+
+	sticky       stickyTable
+	stickyWindow int32
+
+	dnsRoutes atomic.Value
+
+	protocols [protocolCount]uint32
+
+	appStatsLimit    int
+	appStatsPrunedAt int64
+	appStatsEvicted  uint32
+	appStatsIndex    sync.Map
+
+	transformer UdpTransformer
+
+	dnsMalformedAction int32
+	dnsMalformed       uint32
+
+	warm warmPool
+
+	connIdLogging int32
+
+	ready       chan struct{}
+	readyOnce   sync.Once
+	readyAt     time.Time
+	startupHeld uint32
+
+	domainLimits domainLimits
+	systemDns    atomic.Value
+
+	statsListener    TrafficListener
+	statsInterval    time.Duration
+	lowPowerStats    int32
+	lowPowerInterval time.Duration
+
+	dnsAdMode    int32
+	dnsRequestDo int32
+
+	tlsListener TlsHelloListener
+	logLimiter  logLimiter
+
+	v2raySwapped    chan struct{}
+	coreHoldTimeout int32
+	coreNotRunning  uint32
+
+	dnsConnSlots   atomic.Value
+	dnsConnQueued  uint32
+	dnsConnDropped uint32
+
+	mtuListener      MtuListener
+	mtuWatch         mtuWatch
+	mtuWriteFailures uint32
+
+	uidDns sync.Map
+
+	sniffHelloWait int32
+	sniffPolicy    SniffPolicy
+
+	startedAt  time.Time
+	tcpHandled uint32
+	udpHandled uint32
+
+	routerTraffic      int32
+	routerBlockedCount uint32
+}
 
 type UidInfo struct {
 	PackageName string
@@ -52,32 +204,79 @@ type UidDumper interface {
 	GetUidInfo(uid int32) (*UidInfo, error)
 }
 
+// SetUidDumper makes dumper the only one asked for uids, with nil every
+// lookup fails. AddUidDumper chains more of them.
 func SetUidDumper(dumper UidDumper) {
-	uidDumper = dumper
+	uidDumperAccess.Lock()
+	defer uidDumperAccess.Unlock()
+
+	var chain uidDumperChain
+	if dumper != nil {
+		chain = uidDumperChain{{dumper, 0}}
+	}
+	uidDumper.Store(chain)
 }
 
 var foregroundUid uint16
 
 func SetForegroundUid(uid int32) {
+	leaveForeground(foregroundUid, uint16(uid))
 	foregroundUid = uint16(uid)
 }
 
 var foregroundImeUid uint16
 
 func SetForegroundImeUid(uid int32) {
+	leaveForeground(foregroundImeUid, uint16(uid))
 	foregroundImeUid = uint16(uid)
 }
 
+var networkMetered int32
+
+// SetNetworkType records whether the underlying network is metered, new
+// connections carry "metered" or "unmetered" in their app status so routing
+// rules can pick an outbound for it.
+func SetNetworkType(metered bool) {
+	if metered {
+		atomic.StoreInt32(&networkMetered, 1)
+	} else {
+		atomic.StoreInt32(&networkMetered, 0)
+	}
+}
+
+func networkStatus() string {
+	if atomic.LoadInt32(&networkMetered) == 1 {
+		return appStatusMetered
+	}
+	return appStatusUnmetered
+}
+
 const (
 	appStatusForeground = "foreground"
 	appStatusBackground = "background"
+	appStatusMetered    = "metered"
+	appStatusUnmetered  = "unmetered"
 )
 
-func NewTun2socks(fd int32, mtu int32, v2ray *V2RayInstance, router string, hijackDns bool, sniffing bool, fakedns bool, debug bool, dumpUid bool, trafficStats bool) (*Tun2socks, error) {
-	file := os.NewFile(uintptr(fd), "")
-	if file == nil {
-		return nil, errors.New("failed to open TUN file descriptor")
+func NewTun2socks(fd int32, mtu int32, v2ray *V2RayInstance, router string, hijackDns bool, sniffing bool, fakedns bool, debug bool, dumpUid bool, trafficStats bool, stackOptions *StackOptions) (*Tun2socks, error) {
+	file, ownsFile, err := openTun(fd)
+	if err != nil {
+		return nil, err
+	}
+	tun, err := newTun2socks(file, mtu, v2ray, router, hijackDns, sniffing, fakedns, debug, dumpUid, trafficStats, stackOptions)
+	if err != nil {
+		if ownsFile {
+			_ = file.Close()
+		}
+		return nil, err
 	}
+	tun.file = file
+	tun.ownsFile = ownsFile
+	return tun, nil
+}
+
+// newTun2socks runs the stack on the packets read from and written to rw.
+func newTun2socks(rw io.ReadWriter, mtu int32, v2ray *V2RayInstance, router string, hijackDns bool, sniffing bool, fakedns bool, debug bool, dumpUid bool, trafficStats bool, stackOptions *StackOptions) (*Tun2socks, error) {
 	tun := &Tun2socks{
 		router:       router,
 		hijackDns:    hijackDns,
@@ -88,19 +287,45 @@ func NewTun2socks(fd int32, mtu int32, v2ray *V2RayInstance, router string, hija
 		debug:        debug,
 		dumpUid:      dumpUid,
 		trafficStats: trafficStats,
+
+		uplinkLimiter:   newRateLimiter(),
+		downlinkLimiter: newRateLimiter(),
+		latency:         newLatencyHistogram(latencyBuckets),
+		udpSetupWait:    newLatencyHistogram(udpSetupWaitBuckets),
+
+		dnsSessionTimeout: defaultDnsSessionTimeout,
+		udpSessionTimeout: defaultUdpSessionTimeout,
+		v2raySwapped:      make(chan struct{}),
+		sniffHelloWait:    defaultSniffHelloWait,
+		startedAt:         time.Now(),
 	}
 
 	if trafficStats {
 		tun.appStats = map[uint16]*appStats{}
 	}
 
-	d, err := rwbased.New(file, uint32(mtu))
+	if grace := atomic.LoadInt32(&startupGrace); grace > 0 {
+		tun.ready = make(chan struct{})
+		tun.readyAt = tun.startedAt.Add(time.Duration(grace) * time.Millisecond)
+	}
+
+	d, err := rwbased.New(&captureDevice{rw, tun}, uint32(mtu))
 	if err != nil {
 		return nil, err
 	}
 	tun.device = d
+	atomic.StoreInt32(&tunMtu, mtu)
 
-	s, err := stack.New(d, tun, stack.WithDefault())
+	opts, err := stackOptions.options()
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]stack.Option{stack.WithDefault(), stack.WithTCPDelay(!tcpNoDelay)}, opts...)
+
+	s, err := stack.New(d, tun, opts...)
+	if err != nil {
+		return nil, err
+	}
 	tun.stack = s
 
 	if debug {
@@ -109,64 +334,154 @@ func NewTun2socks(fd int32, mtu int32, v2ray *V2RayInstance, router string, hija
 		log.SetLevel(log.WarnLevel)
 	}
 
-	net.DefaultResolver.Dial = tun.dialDNS
+	installResolver(tun)
 	return tun, nil
 }
 
+// SetDomainAddressFamily sets the address family preferred by the protected
+// dialer when the core dials a sniffed domain, one of AddressFamilyAuto,
+// AddressFamilyIPv4 or AddressFamilyIPv6.
+func (t *Tun2socks) SetDomainAddressFamily(prefer int32) {
+	atomic.StoreInt32(&t.domainFamily, prefer)
+}
+
+// SetV2RayInstance swaps the core used for new connections, relays already
+// running keep using the previous instance. The tun never closes either
+// instance, the caller remains responsible for closing the old one once
+// it is no longer needed, which also tears down the relays still on it.
+// Connections held by SetCoreHoldTimeout go on with v2ray once started.
+func (t *Tun2socks) SetV2RayInstance(v2ray *V2RayInstance) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.v2ray = v2ray
+	close(t.v2raySwapped)
+	t.v2raySwapped = make(chan struct{})
+}
+
+func (t *Tun2socks) getV2Ray() *V2RayInstance {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	return t.v2ray
+}
+
+// SetInboundUser attaches user to new connections as the xray inbound user,
+// identified by its email. The core matches it against the "user" field of
+// routing rules and, when the policy enables user stats, counts traffic
+// under "user>>>name>>>traffic". It is local to the core and not sent to
+// the proxy server, which sees the account of the outbound. An empty user
+// clears it.
+func (t *Tun2socks) SetInboundUser(user string) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if user == "" {
+		t.inboundUser = nil
+	} else {
+		t.inboundUser = &protocol.MemoryUser{Email: user}
+	}
+}
+
+func (t *Tun2socks) getInboundUser() *protocol.MemoryUser {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	return t.inboundUser
+}
+
+const defaultUdpSetupTimeout = time.Second
+
+// SetUdpSetupTimeout sets how long in milliseconds packets of a new UDP
+// flow wait for its session to be set up before they are dropped.
+func (t *Tun2socks) SetUdpSetupTimeout(timeout int32) {
+	atomic.StoreInt32(&t.udpSetupTime, timeout)
+}
+
+func (t *Tun2socks) getUdpSetupTimeout() time.Duration {
+	if timeout := atomic.LoadInt32(&t.udpSetupTime); timeout > 0 {
+		return time.Duration(timeout) * time.Millisecond
+	}
+	return defaultUdpSetupTimeout
+}
+
 func (t *Tun2socks) Close() {
 	t.access.Lock()
 	defer t.access.Unlock()
 
-	net.DefaultResolver.Dial = nil
+	releaseResolver(t)
+	if t.statsStop != nil {
+		close(t.statsStop)
+		t.statsStop = nil
+	}
+	if t.dnsPool != nil {
+		t.dnsPool.close()
+		t.dnsPool = nil
+	}
 	t.stack.Close()
+	t.closeSticky()
+	t.SetWarmPool(0, 0)
+	t.closeFile()
+}
+
+// closeFile closes the tun file if it is a duplicate owned by the tun.
+func (t *Tun2socks) closeFile() {
+	if t.ownsFile {
+		_ = t.file.Close()
+	}
 }
 
 func (t *Tun2socks) Add(conn core.TCPConn) {
 	id := conn.ID()
 
-	la := fmt.Sprintf("tcp:%s", net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort))))
-	src, err := v2rayNet.ParseDestination(la)
+	src, err := endpointDestination(v2rayNet.Network_TCP, string(id.RemoteAddress), id.RemotePort)
 	if err != nil {
-		log.Errorf("[TCP] parse source address %s failed: %s", la, err.Error())
-		return
-	}
-	if src.Address.Family().IsDomain() {
-		log.Errorf("[TCP] conn with domain src %s received: %s", la, err.Error())
+		t.logLimited("[TCP] parse address failed", log.Errorf, "[TCP] parse source address %s failed: %s", id.RemoteAddress, err.Error())
 		return
 	}
-	da := fmt.Sprintf("tcp:%s", net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort))))
-	dest, err := v2rayNet.ParseDestination(da)
+	dest, err := endpointDestination(v2rayNet.Network_TCP, string(id.LocalAddress), id.LocalPort)
 	if err != nil {
-		log.Errorf("[TCP] parse destination address %s failed: %s", da, err.Error())
+		t.logLimited("[TCP] parse address failed", log.Errorf, "[TCP] parse destination address %s failed: %s", id.LocalAddress, err.Error())
 		return
 	}
-	if dest.Address.Family().IsDomain() {
-		log.Errorf("[TCP] conn with domain destination %s received: %s", da, err.Error())
+
+	t.waitReady()
+	if t.routerBlocked(dest) {
+		if t.debug {
+			log.Infof("[TCP] router port blocked: %s ==> %s", src.NetAddr(), dest.NetAddr())
+		}
+		t.blockTCP(conn)
 		return
 	}
 
 	inbound := &session.Inbound{
 		Source: src,
 		Tag:    "socks",
+		User:   t.getInboundUser(),
 	}
 
 	isDns := dest.Address.String() == t.router || dest.Port == 53
 	if isDns {
 		inbound.Tag = "dns-in"
+		atomic.AddUint32(&t.dnsQueries, 1)
 	}
 
 	var uid uint16
 	var self bool
 
 	if t.dumpUid || t.trafficStats {
-		u, err := uidDumper.DumpUid(dest.Address.Family().IsIPv6(), false, src.Address.IP().String(), int32(src.Port), dest.Address.IP().String(), int32(dest.Port))
+		dumper := loadUidDumper()
+		u, err := dumper.DumpUid(dest.Address.Family().IsIPv6(), false, src.Address.IP().String(), int32(src.Port), dest.Address.IP().String(), int32(dest.Port))
+		if err == nil {
+			err = t.injectFault(faultUidDump)
+		}
 		if err == nil {
 			uid = uint16(u)
 			var info *UidInfo
 			self = uid > 0 && int(uid) == os.Getuid()
 			if t.debug && !self && uid >= 10000 {
 				if err == nil {
-					info, _ = uidDumper.GetUidInfo(int32(uid))
+					info, _ = dumper.GetUidInfo(int32(uid))
 				}
 				if info == nil {
 					log.Infof("[TCP] %s ==> %s", src.NetAddr(), dest.NetAddr())
@@ -180,74 +495,242 @@ func (t *Tun2socks) Add(conn core.TCPConn) {
 			}
 
 			inbound.Uid = uint32(uid)
-
-			if uid == foregroundUid || uid == foregroundImeUid {
-				inbound.AppStatus = append(inbound.AppStatus, appStatusForeground)
-			} else {
-				inbound.AppStatus = append(inbound.AppStatus, appStatusBackground)
+			if !self {
+				t.markAppSeen(uid)
 			}
+
+			inbound.AppStatus = append(inbound.AppStatus, appStatus(uid)...)
+		} else {
+			t.uidResolveFailed("tcp", src.NetAddr(), dest.NetAddr(), err)
+		}
+	}
+	inbound.AppStatus = append(inbound.AppStatus, networkStatus())
+	if !isDns && uid > 0 {
+		if tag := t.uidTag(uid); tag != "" {
+			inbound.Tag = tag
 		}
 	}
 
+	atomic.AddUint32(&t.tcpHandled, 1)
+	entry := t.conns.add(&connEntry{
+		uid:         uid,
+		network:     "tcp",
+		source:      src.NetAddr(),
+		destination: dest.NetAddr(),
+	})
+	defer t.closeConn(entry)
+	logTag := t.logTag("TCP", entry)
+
+	if self && !isDns && t.loops.check(dest.NetAddr()) {
+		log.Errorf("[%s] relay loop detected: %s ==> %s, dropped", logTag, src.NetAddr(), dest.NetAddr())
+		entry.setCloseReason(CloseReasonBlocked)
+		t.blockTCP(conn)
+		return
+	}
+
+	if !self && !t.allowConn(entry) {
+		log.Infof("[%s] refused by filter: %s ==> %s", logTag, src.NetAddr(), dest.NetAddr())
+		entry.setCloseReason(CloseReasonBlocked)
+		t.blockTCP(conn)
+		return
+	}
+
+	if !isDns && t.ipv6Blocked(dest) {
+		if t.debug {
+			log.Infof("[%s] ipv6 disabled: %s ==> %s", logTag, src.NetAddr(), dest.NetAddr())
+		}
+		entry.setCloseReason(CloseReasonBlocked)
+		t.blockTCPWith(conn, atomic.LoadInt32(&t.ipv6Action))
+		return
+	}
+
+	policy := int32(LanPolicyProxy)
+	if !isDns {
+		policy = t.destinationPolicy(dest)
+	}
+	if policy == LanPolicyBlock {
+		log.Warnf("[%s] destination blocked by policy: %s ==> %s", logTag, src.NetAddr(), dest.NetAddr())
+		entry.setCloseReason(CloseReasonBlocked)
+		t.blockTCP(conn)
+		return
+	}
+
 	ctx := session.ContextWithInbound(context.Background(), inbound)
+	ctx = withConnectionId(ctx, entry)
 
-	if !isDns && t.sniffing {
-		req := session.SniffingRequest{
-			Enabled:      true,
-			MetadataOnly: false,
+	sniff := !isDns && t.shouldSniff(dest.NetAddr(), uid)
+	if sniff {
+		ctx = session.ContextWithContent(ctx, t.sniffingContent(dest))
+	}
+	ctx = t.withTos(ctx, "tcp", src.NetAddr())
+	ctx = t.withTtl(ctx, "tcp", src.NetAddr())
+	var access *v2rayLog.AccessMessage
+	if policy == LanPolicyProxy && !isDns {
+		var email string
+		if inbound.User != nil {
+			email = inbound.User.Email
 		}
-		if !t.fakedns {
-			req.OverrideDestinationForProtocol = []string{"http", "tls"}
-		} else {
-			req.OverrideDestinationForProtocol = []string{"fakedns", "http", "tls"}
+		ctx, access = withAccessMessage(ctx, src, dest, email)
+	}
+
+	if policy == LanPolicyProxy && !isDns {
+		if tag, blocked := t.blockedOutbound(ctx, dest); blocked {
+			log.Infof("[%s] blocked by outbound %s: %s ==> %s", logTag, tag, src.NetAddr(), dest.NetAddr())
+			entry.setCloseReason(CloseReasonBlocked)
+			t.blockTCP(conn)
+			return
 		}
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			SniffingRequest: req,
-		})
 	}
 
-	destConn, err := v2rayCore.Dial(ctx, t.v2ray.core, dest)
+	var stats *appStats
+	if t.trafficStats && !self && !isDns {
+		stats = t.getAppStats(uid)
+	}
 
-	if err != nil {
-		log.Errorf("[TCP] dial failed: %s", err.Error())
-		return
+	if stats != nil {
+		if limit := t.uidConnLimit(uid, false); !reserveConn(&stats.tcpConn, limit) {
+			atomic.AddUint32(&stats.tcpConnRejected, 1)
+			log.Warnf("[%s] connection limit (%d) reached for uid %d, rejected %s ==> %s", logTag, limit, uid, src.NetAddr(), dest.NetAddr())
+			entry.setCloseReason(CloseReasonBlocked)
+			t.blockTCP(conn)
+			return
+		}
+		atomic.StoreInt64(&stats.deactivateAt, 0)
+		defer func() {
+			if atomic.AddInt32(&stats.tcpConn, -1)+atomic.LoadInt32(&stats.udpConn) == 0 {
+				atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
+			}
+		}()
 	}
 
-	if t.trafficStats && !self && !isDns {
+	if isDns {
+		release, ok := t.acquireDnsConn()
+		if !ok {
+			log.Warnf("[%s] too many dns connections, dropped %s ==> %s", logTag, src.NetAddr(), dest.NetAddr())
+			entry.setCloseReason(CloseReasonBlocked)
+			t.blockTCP(conn)
+			return
+		}
+		defer release()
+	}
 
-		t.access.Lock()
-		if !t.trafficStats {
-			t.access.Unlock()
-		} else {
+	var warm *warmConn
+	var poolKey string
+	if policy == LanPolicyProxy && !isDns && !sniff {
+		poolKey = warmKey(uid, inbound, dest)
+		warm = t.takeWarm(poolKey)
+	}
 
-			stats := t.appStats[uid]
-			if stats == nil {
-				stats = &appStats{}
-				t.appStats[uid] = stats
+	var destConn net.Conn
+	if policy == LanPolicyDirect {
+		destConn, err = internet.DialSystem(ctx, dest, nil)
+	} else if warm != nil {
+		destConn, access = warm.conn, warm.access
+	} else if instance, coreErr := t.runningCore(); coreErr != nil {
+		err = coreErr
+	} else {
+		destConn, err = v2rayCore.Dial(ctx, instance, dest)
+		if err != nil && !isDns {
+			if fallbackCtx, ok := t.fallbackContext(ctx, logTag, inbound, err); ok {
+				destConn, err = v2rayCore.Dial(fallbackCtx, instance, dest)
 			}
-			t.access.Unlock()
-			atomic.AddInt32(&stats.tcpConn, 1)
-			atomic.AddUint32(&stats.tcpConnTotal, 1)
-			atomic.StoreInt64(&stats.deactivateAt, 0)
-			defer func() {
-				if atomic.AddInt32(&stats.tcpConn, -1)+atomic.LoadInt32(&stats.udpConn) == 0 {
-					atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
-				}
-			}()
-			destConn = &statsConn{destConn, &stats.uplink, &stats.downlink}
 		}
 	}
 
-	_ = task.Run(ctx, func() error {
-		_, _ = io.Copy(conn, destConn)
+	if err != nil {
+		atomic.AddUint32(&t.dialFailures, 1)
+		t.logLimited("[TCP] dial failed", log.Errorf, "[%s] dial failed: %s", logTag, err.Error())
+		entry.setCloseReason(CloseReasonDialFailed)
+		return
+	}
+	if poolKey != "" {
+		t.refillWarm(poolKey, inbound, src, dest)
+	}
+
+	var counted *statsConn
+	if stats != nil {
+		atomic.AddUint32(&stats.tcpConnTotal, 1)
+		counted = &statsConn{destConn, t.newStatsCounter(&stats.uplink, &stats.tcpUplink), t.newStatsCounter(&stats.downlink, &stats.tcpDownlink)}
+		destConn = counted
+	}
+	// rate limit waits end with the relay, they do not notice the conns
+	// being closed.
+	limitCtx, cancelLimits := context.WithCancel(ctx)
+	defer cancelLimits()
+	if !isDns {
+		destConn = &rateLimitedConn{destConn, limitCtx, t.uplinkLimiter, t.downlinkLimiter}
+		destConn = &domainLimitedConn{destConn, limitCtx, entry}
+		destConn = &latencyConn{Conn: destConn, onResponse: func() {
+			t.recordLatency(entry)
+			if access != nil {
+				entry.recordOutbound(access)
+			}
+		}}
+	}
+	destConn = &errorConn{destConn, entry, false}
+	destConn = &activityConn{destConn, entry}
+	entry.setCloser(func() {
+		cancelLimits()
+		_ = conn.Close()
+		_ = destConn.Close()
+	})
+
+	var appConn net.Conn = &errorConn{conn, entry, true}
+	localConn := appConn
+	if !isDns {
+		appConn = &sniffConn{Conn: appConn, wait: t.getSniffHelloWait(), onSniff: func(payload []byte) {
+			t.countProtocol(false, payload)
+			t.onTlsHello(entry, payload)
+			if sniff {
+				t.onSniffed(logTag, entry, dest, payload)
+			}
+		}}
+	}
+
+	if lifetime := t.getMaxConnLifetime(); lifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lifetime)
+		defer cancel()
+	}
+	if timeout := t.getIdleTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		timer := signal.CancelAfterInactivity(ctx, cancel, timeout)
+		localConn = &activityConn{localConn, timer}
+		appConn = &activityConn{appConn, timer}
+	}
+
+	// task.Run returns once either copy ended, the other is waited for
+	// after the conns are closed so its bytes and errors are counted
+	// before the connection is reported closed.
+	var copies sync.WaitGroup
+	copies.Add(2)
+	err = task.Run(ctx, func() error {
+		defer copies.Done()
+		_, err := t.relayCopy(localConn, &progressConn{Conn: destConn, entry: entry})
+		entry.setCloseReason(copyCloseReason(err, true))
 		return io.EOF
 	}, func() error {
-		_, _ = io.Copy(destConn, conn)
+		defer copies.Done()
+		_, err := t.relayCopy(destConn, &progressConn{Conn: appConn, entry: entry, local: true})
+		entry.setCloseReason(copyCloseReason(err, false))
 		return io.EOF
 	})
+	if err == context.Canceled {
+		entry.setCloseReason(CloseReasonTimeout)
+	} else if err == context.DeadlineExceeded {
+		atomic.AddUint32(&t.lifetimeExpired, 1)
+		entry.setCloseReason(CloseReasonLifetime)
+	}
 
+	cancelLimits()
 	_ = conn.Close()
 	_ = destConn.Close()
+	copies.Wait()
+	if counted != nil {
+		counted.flush()
+	}
 }
 
 func (t *Tun2socks) AddPacket(packet core.UDPPacket) {
@@ -255,34 +738,48 @@ func (t *Tun2socks) AddPacket(packet core.UDPPacket) {
 }
 
 func (t *Tun2socks) addPacket(packet core.UDPPacket) {
+	packet = t.withFaults(packet)
 	id := packet.ID()
-	la := fmt.Sprintf("udp:%s", net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort))))
-	src, err := v2rayNet.ParseDestination(la)
+	src, err := endpointDestination(v2rayNet.Network_UDP, string(id.RemoteAddress), id.RemotePort)
 	if err != nil {
-		log.Errorf("[UDP] parse source address %s failed: %s", la, err.Error())
-		return
-	}
-	if src.Address.Family().IsDomain() {
-		log.Errorf("[UDP] conn with domain src %s received: %s", la, err.Error())
+		t.logLimited("[UDP] parse address failed", log.Errorf, "[UDP] parse source address %s failed: %s", id.RemoteAddress, err.Error())
 		return
 	}
-	da := fmt.Sprintf("udp:%s", net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort))))
-	dest, err := v2rayNet.ParseDestination(da)
+	dest, err := endpointDestination(v2rayNet.Network_UDP, string(id.LocalAddress), id.LocalPort)
 	if err != nil {
-		log.Errorf("[UDP] parse destination address %s failed: %s", da, err.Error())
+		t.logLimited("[UDP] parse address failed", log.Errorf, "[UDP] parse destination address %s failed: %s", id.LocalAddress, err.Error())
 		return
 	}
-	if dest.Address.Family().IsDomain() {
-		log.Errorf("[UDP] conn with domain destination %s received: %s", da, err.Error())
+
+	t.waitReady()
+	if t.routerBlocked(dest) {
+		if t.debug {
+			log.Infof("[UDP] router port blocked: %s ==> %s", src.NetAddr(), dest.NetAddr())
+		}
+		packet.Drop()
 		return
 	}
 
 	natKey := src.NetAddr()
+	directKey := natKey + "->" + dest.NetAddr()
 
 	sendTo := func(drop bool) bool {
-		conn := t.udpTable.Get(natKey)
+		conn := t.udpTable.Get(directKey)
 		if conn == nil {
-			return false
+			session := t.udpTable.session(natKey)
+			if session == nil {
+				return false
+			}
+			switch t.udpVerdict(session, dest) {
+			case udpVerdictDrop:
+				if drop {
+					packet.Drop()
+				}
+				return true
+			case udpVerdictSetup:
+				return false
+			}
+			conn = session.PacketConn
 		}
 
 		if drop {
@@ -300,18 +797,44 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 		return
 	}
 
+	// another packet of the flow may be setting up the session, wait for it
+	// and take over the setup if it ended without a session, as it happens
+	// for failed dials or queries handed to the DNS workers.
 	lockKey := natKey + "-lock"
-	cond, loaded := t.udpTable.GetOrCreateLock(lockKey)
-	if loaded {
-		cond.L.Lock()
-		cond.Wait()
-		sendTo(true)
-		cond.L.Unlock()
-		return
+	var lock chan struct{}
+	var deadline <-chan time.Time
+	for {
+		var loaded bool
+		lock, loaded = t.udpTable.GetOrCreateLock(lockKey)
+		if !loaded {
+			break
+		}
+		if deadline == nil {
+			deadline = time.After(t.getUdpSetupTimeout())
+		}
+		waitStart := time.Now()
+		select {
+		case <-lock:
+			t.udpSetupWait.observe(time.Since(waitStart))
+		case <-deadline:
+			t.udpSetupWait.observe(time.Since(waitStart))
+			atomic.AddUint32(&t.udpDropped, 1)
+			packet.Drop()
+			return
+		}
+		if sendTo(true) {
+			return
+		}
 	}
 
-	t.udpTable.Delete(lockKey)
-	cond.Broadcast()
+	var unlockOnce sync.Once
+	unlock := func() {
+		unlockOnce.Do(func() {
+			t.udpTable.Delete(lockKey)
+			close(lock)
+		})
+	}
+	defer unlock()
 
 	srcIp := src.Address.IP()
 	dstIp := dest.Address.IP()
@@ -319,27 +842,37 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 	inbound := &session.Inbound{
 		Source: src,
 		Tag:    "socks",
+		User:   t.getInboundUser(),
 	}
 	isDns := dest.Address.String() == t.router
 
-	if !isDns && t.hijackDns {
-		dnsMsg := dns.Msg{}
-		err := dnsMsg.Unpack(packet.Data())
-		if err == nil && !dnsMsg.Response && len(dnsMsg.Question) > 0 {
+	if isDns || t.hijackDns {
+		problem := dnsQueryProblem(packet.Data())
+		if problem == "" {
 			isDns = true
+		} else if isDns || dest.Port == 53 {
+			if t.dropMalformedDns(src, dest, problem) {
+				packet.Drop()
+				return
+			}
 		}
 	}
 
 	if isDns {
 		inbound.Tag = "dns-in"
+		atomic.AddUint32(&t.dnsQueries, 1)
 	}
+	atomic.AddUint32(&t.udpHandled, 1)
 
 	var uid uint16
 	var self bool
 
 	if t.dumpUid || t.trafficStats {
-
-		u, err := uidDumper.DumpUid(srcIp.To4() == nil, true, srcIp.String(), int32(src.Port), dstIp.String(), int32(dest.Port))
+		dumper := loadUidDumper()
+		u, err := dumper.DumpUid(srcIp.To4() == nil, true, srcIp.String(), int32(src.Port), dstIp.String(), int32(dest.Port))
+		if err == nil {
+			err = t.injectFault(faultUidDump)
+		}
 		if err == nil {
 			uid = uint16(u)
 			var info *UidInfo
@@ -347,7 +880,7 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 
 			if t.debug && !self && uid >= 1000 {
 				if err == nil {
-					info, _ = uidDumper.GetUidInfo(int32(uid))
+					info, _ = dumper.GetUidInfo(int32(uid))
 				}
 				var tag string
 				if !isDns {
@@ -368,120 +901,368 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 			}
 
 			inbound.Uid = uint32(uid)
-			if uid == foregroundUid || uid == foregroundImeUid {
-				inbound.AppStatus = append(inbound.AppStatus, appStatusForeground)
-			} else {
-				inbound.AppStatus = append(inbound.AppStatus, appStatusBackground)
+			if !self {
+				t.markAppSeen(uid)
 			}
+			inbound.AppStatus = append(inbound.AppStatus, appStatus(uid)...)
 
+		} else {
+			t.uidResolveFailed("udp", src.NetAddr(), dest.NetAddr(), err)
 		}
 
 	}
+	inbound.AppStatus = append(inbound.AppStatus, networkStatus())
+	if !isDns && uid > 0 {
+		if tag := t.uidTag(uid); tag != "" {
+			inbound.Tag = tag
+		}
+	}
 
-	ctx := session.ContextWithInbound(context.Background(), inbound)
+	if isDns && !t.dnsLimit.allow(uid) {
+		atomic.AddUint32(&t.dnsDropped, 1)
+		if t.debug {
+			log.Warnf("[DNS] rate limit reached, dropped %s ==> %s", src.NetAddr(), dest.NetAddr())
+		}
+		packet.Drop()
+		return
+	}
+
+	var uidDns *uidDnsServer
+	if isDns {
+		uidDns = t.uidDnsServer(uid)
+		packet = t.withDnssec(packet)
+	}
 
-	if !isDns && t.sniffing {
-		req := session.SniffingRequest{
-			Enabled:      true,
-			MetadataOnly: false,
+	if isDns && uidDns == nil {
+		if response := t.dnsCache.lookup(packet.Data()); response != nil {
+			t.recordDns(response, DnsUpstreamCache)
+			_, _ = packet.WriteBack(t.truncateDns(response), nil)
+			packet.Drop()
+			return
 		}
-		if !t.fakedns {
-			req.OverrideDestinationForProtocol = []string{"http", "tls"}
-		} else {
-			req.OverrideDestinationForProtocol = []string{"fakedns", "http", "tls"}
+	}
+
+	if isDns {
+		var ok bool
+		if packet, ok = t.acquireDns(packet); !ok {
+			if t.debug {
+				log.Warnf("[DNS] too many queries in flight, refused %s ==> %s", src.NetAddr(), dest.NetAddr())
+			}
+			return
 		}
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			SniffingRequest: req,
-		})
 	}
 
-	conn, err := v2rayCore.DialUDP(ctx, t.v2ray.core)
+	if isDns && uidDns != nil && t.resolveUidDns(uidDns, packet) {
+		return
+	}
 
-	if err != nil {
-		log.Errorf("[UDP] dial failed: %s", err.Error())
+	if isDns && t.resolveDnsRoute(packet) {
+		return
+	}
+
+	if isDns && t.resolveDnsTls(packet) {
+		return
+	}
+
+	if isDns && t.submitDns(packet) {
+		return
+	}
+
+	if isDns {
+		release, ok := t.acquireDnsConn()
+		if !ok {
+			if t.debug {
+				log.Warnf("[DNS] too many dns connections, dropped %s ==> %s", src.NetAddr(), dest.NetAddr())
+			}
+			packet.Drop()
+			return
+		}
+		defer release()
+	}
+
+	entry := t.conns.add(&connEntry{
+		uid:         uid,
+		network:     "udp",
+		source:      src.NetAddr(),
+		destination: dest.NetAddr(),
+	})
+	defer t.closeConn(entry)
+	logTag := t.logTag("UDP", entry)
+
+	if self && !isDns && t.loops.check(dest.NetAddr()) {
+		log.Errorf("[%s] relay loop detected: %s ==> %s, dropped", logTag, src.NetAddr(), dest.NetAddr())
+		entry.setCloseReason(CloseReasonBlocked)
+		packet.Drop()
+		return
+	}
+
+	if !self && !t.allowConn(entry) {
+		log.Infof("[%s] refused by filter: %s ==> %s", logTag, src.NetAddr(), dest.NetAddr())
+		entry.setCloseReason(CloseReasonBlocked)
+		packet.Drop()
 		return
 	}
 
+	if !isDns && t.ipv6Blocked(dest) {
+		if t.debug {
+			log.Infof("[%s] ipv6 disabled: %s ==> %s", logTag, src.NetAddr(), dest.NetAddr())
+		}
+		entry.setCloseReason(CloseReasonBlocked)
+		packet.Drop()
+		return
+	}
+
+	policy := int32(LanPolicyProxy)
+	if !isDns {
+		policy = t.destinationPolicy(dest)
+	}
+	if policy == LanPolicyBlock {
+		log.Warnf("[%s] destination blocked by policy: %s ==> %s", logTag, src.NetAddr(), dest.NetAddr())
+		entry.setCloseReason(CloseReasonBlocked)
+		packet.Drop()
+		return
+	}
+
+	ctx := session.ContextWithInbound(context.Background(), inbound)
+	ctx = withConnectionId(ctx, entry)
+
+	sniff := !isDns && t.shouldSniff(dest.NetAddr(), uid)
+	if sniff {
+		ctx = session.ContextWithContent(ctx, t.sniffingContent(dest))
+	}
+	ctx = t.withTos(ctx, "udp", src.NetAddr())
+	ctx = t.withTtl(ctx, "udp", src.NetAddr())
+
+	if policy == LanPolicyProxy && !isDns {
+		if tag, blocked := t.blockedOutbound(ctx, dest); blocked {
+			log.Infof("[%s] blocked by outbound %s: %s ==> %s", logTag, tag, src.NetAddr(), dest.NetAddr())
+			entry.setCloseReason(CloseReasonBlocked)
+			packet.Drop()
+			return
+		}
+	}
+
+	var stats *appStats
 	if t.trafficStats && !self && !isDns {
-		t.access.Lock()
-		if !t.trafficStats {
-			t.access.Unlock()
-		} else {
-			stats := t.appStats[uid]
-			if stats == nil {
-				stats = &appStats{}
-				t.appStats[uid] = stats
+		stats = t.getAppStats(uid)
+	}
+
+	if stats != nil {
+		if limit := t.uidConnLimit(uid, true); !reserveConn(&stats.udpConn, limit) {
+			atomic.AddUint32(&stats.udpConnRejected, 1)
+			log.Warnf("[%s] connection limit (%d) reached for uid %d, rejected %s ==> %s", logTag, limit, uid, src.NetAddr(), dest.NetAddr())
+			entry.setCloseReason(CloseReasonBlocked)
+			packet.Drop()
+			return
+		}
+		atomic.StoreInt64(&stats.deactivateAt, 0)
+		defer func() {
+			if atomic.AddInt32(&stats.udpConn, -1)+atomic.LoadInt32(&stats.tcpConn) == 0 {
+				atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
+			}
+		}()
+	}
+
+	var sticky net.PacketConn
+	if policy != LanPolicyDirect && !isDns {
+		sticky = t.takeSticky(natKey)
+	}
+
+	var conn net.PacketConn
+	if policy == LanPolicyDirect {
+		var directConn net.Conn
+		directConn, err = internet.DialSystem(ctx, dest, nil)
+		if err == nil {
+			conn = &directPacketConn{directConn, packet.LocalAddr()}
+		}
+	} else if sticky != nil {
+		conn = sticky
+	} else if instance, coreErr := t.runningCore(); coreErr != nil {
+		err = coreErr
+	} else {
+		conn, err = v2rayCore.DialUDP(ctx, instance)
+		if err != nil && !isDns {
+			if fallbackCtx, ok := t.fallbackContext(ctx, logTag, inbound, err); ok {
+				conn, err = v2rayCore.DialUDP(fallbackCtx, instance)
 			}
-			t.access.Unlock()
-			atomic.AddInt32(&stats.udpConn, 1)
-			atomic.AddUint32(&stats.udpConnTotal, 1)
-			atomic.StoreInt64(&stats.deactivateAt, 0)
-			defer func() {
-				if atomic.AddInt32(&stats.udpConn, -1)+atomic.LoadInt32(&stats.tcpConn) == 0 {
-					atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
-				}
-			}()
-			conn = &statsPacketConn{conn, &stats.uplink, &stats.downlink}
 		}
+		if err == nil && !isDns {
+			conn = t.stickyConn(natKey, conn)
+		}
+	}
+
+	if err != nil {
+		atomic.AddUint32(&t.dialFailures, 1)
+		t.logLimited("[UDP] dial failed", log.Errorf, "[%s] dial failed: %s", logTag, err.Error())
+		entry.setCloseReason(CloseReasonDialFailed)
+		releaseDns(packet)
+		return
 	}
 
-	t.udpTable.Set(natKey, conn)
+	if stats != nil {
+		atomic.AddUint32(&stats.udpConnTotal, 1)
+		conn = &statsPacketConn{conn, t.newStatsCounter(&stats.uplink, &stats.udpUplink), t.newStatsCounter(&stats.downlink, &stats.udpDownlink)}
+	}
+	limitCtx, cancelLimits := context.WithCancel(ctx)
+	defer cancelLimits()
+	if !isDns {
+		conn = t.transformedPacketConn(conn, src.NetAddr())
+		conn = &rateLimitedPacketConn{conn, limitCtx, t.uplinkLimiter, t.downlinkLimiter}
+		conn = &domainLimitedPacketConn{conn, limitCtx, entry}
+		conn = &latencyPacketConn{PacketConn: conn, onResponse: func() {
+			t.recordLatency(entry)
+		}}
+	}
+	conn = &errorPacketConn{conn, entry}
+	conn = &activityPacketConn{conn, entry}
+	conn = &countingPacketConn{conn, entry}
+	entry.setCloser(func() {
+		cancelLimits()
+		_ = conn.Close()
+	})
+
+	if !isDns {
+		t.countProtocol(true, packet.Data())
+	}
+	if sniff {
+		t.onSniffed(logTag, entry, dest, nil)
+	}
+
+	// direct sessions only reach their destination, so they are keyed by
+	// it too and leave the source free for sessions to other ones.
+	sessionKey := natKey
+	if policy == LanPolicyDirect {
+		sessionKey = directKey
+	}
+	t.udpTable.Set(sessionKey, &natSession{PacketConn: conn, entry: entry, ctx: ctx, self: self})
+	unlock()
 
 	go sendTo(false)
 
+	var queue *writebackQueue
+	if size := atomic.LoadInt32(&t.writebackSize); size > 0 && !isDns {
+		queue = newWritebackQueue(size, &t.udpDownlinkDropped)
+		go queue.run(packet, func(err error) {
+			entry.countError(err, true, true)
+			entry.setCloseReason(copyCloseReason(err, false))
+			_ = conn.Close()
+		})
+	}
+
+	if timeout := t.getUdpSessionTimeout(isDns); timeout > 0 {
+		stop := evictIdleUdp(entry, timeout)
+		defer stop()
+	}
+	linger := t.getUdpLinger()
+
 	buf := pool.Get(pool.RelayBufferSize)
 
 	for {
 		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
+			if linger > 0 && !isDns && transientUdpError(err) && time.Since(entry.lastActiveAt()) < linger {
+				continue
+			}
+			entry.setCloseReason(copyCloseReason(err, true))
 			break
 		}
+		data := buf[:n]
 		if isDns {
 			addr = nil
+			data = t.answerDns(data, DnsUpstreamCore)
+			releaseDns(packet)
+		}
+		if queue != nil {
+			queue.push(data, addr)
+			continue
 		}
-		_, err = packet.WriteBack(buf[:n], addr)
+		_, err = packet.WriteBack(data, addr)
 		if err != nil {
+			entry.countError(err, true, true)
+			entry.setCloseReason(copyCloseReason(err, false))
 			break
 		}
 	}
 
 	// close
 
+	if queue != nil {
+		queue.close()
+	}
 	_ = pool.Put(buf)
 	_ = conn.Close()
 	packet.Drop()
-	t.udpTable.Delete(natKey)
+	t.udpTable.Delete(sessionKey)
+}
+
+// endpointDestination builds a destination from the raw address bytes of
+// the stack. Going through the string form breaks on IPv4-mapped and
+// scoped IPv6 literals, which end up parsed as domains.
+func endpointDestination(network v2rayNet.Network, address string, port uint16) (v2rayNet.Destination, error) {
+	if len(address) != net.IPv4len && len(address) != net.IPv6len {
+		return v2rayNet.Destination{}, fmt.Errorf("invalid address length %d", len(address))
+	}
+	return v2rayNet.Destination{
+		Network: network,
+		Address: v2rayNet.IPAddress([]byte(address)),
+		Port:    v2rayNet.Port(port),
+	}, nil
 }
 
 func (t *Tun2socks) dialDNS(ctx context.Context, _, _ string) (net.Conn, error) {
-	return v2rayCore.Dial(session.ContextWithInbound(ctx, &session.Inbound{
+	instance, err := t.runningCore()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := v2rayCore.Dial(session.ContextWithInbound(ctx, &session.Inbound{
 		Tag: "dns-in",
-	}), t.v2ray.core, v2rayNet.Destination{
+	}), instance, v2rayNet.Destination{
 		Network: v2rayNet.Network_TCP,
 		Address: v2rayNet.ParseAddress("1.0.0.1"),
 		Port:    53,
 	})
+	if err != nil {
+		return nil, err
+	}
+	// the connections of the core ignore the deadlines the resolver sets,
+	// it is closed once the deadline of the exchange passed instead
+	if deadline, ok := ctx.Deadline(); ok {
+		time.AfterFunc(time.Until(deadline), func() {
+			_ = conn.Close()
+		})
+	}
+	return conn, nil
 }
 
 type natTable struct {
 	mapping sync.Map
 }
 
-func (t *natTable) Set(key string, pc net.PacketConn) {
-	t.mapping.Store(key, pc)
+func (t *natTable) Set(key string, session *natSession) {
+	t.mapping.Store(key, session)
 }
 
 func (t *natTable) Get(key string) net.PacketConn {
+	if session := t.session(key); session != nil {
+		return session.PacketConn
+	}
+	return nil
+}
+
+func (t *natTable) session(key string) *natSession {
 	item, exist := t.mapping.Load(key)
 	if !exist {
 		return nil
 	}
-	return item.(net.PacketConn)
+	session, _ := item.(*natSession)
+	return session
 }
 
-func (t *natTable) GetOrCreateLock(key string) (*sync.Cond, bool) {
-	item, loaded := t.mapping.LoadOrStore(key, sync.NewCond(&sync.Mutex{}))
-	return item.(*sync.Cond), loaded
+// GetOrCreateLock returns a channel closed once the session for key is set
+// up, loaded tells whether another packet is already setting it up.
+func (t *natTable) GetOrCreateLock(key string) (chan struct{}, bool) {
+	item, loaded := t.mapping.LoadOrStore(key, make(chan struct{}))
+	return item.(chan struct{}), loaded
 }
 
 func (t *natTable) Delete(key string) {
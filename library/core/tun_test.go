@@ -0,0 +1,70 @@
+package libcore
+
+import (
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"net"
+	"testing"
+)
+
+func TestEndpointDestination(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		address net.IP
+		port    uint16
+		netAddr string
+	}{
+		{"ipv4", net.ParseIP("192.0.2.1").To4(), 443, "192.0.2.1:443"},
+		{"ipv6", net.ParseIP("2001:db8::1"), 443, "[2001:db8::1]:443"},
+		{"link-local ipv6", net.ParseIP("fe80::1"), 5353, "[fe80::1]:5353"},
+		{"link-local ipv6 with interface id", net.ParseIP("fe80::a00:27ff:fe4e:66a1"), 53, "[fe80::a00:27ff:fe4e:66a1]:53"},
+		{"multicast ipv6", net.ParseIP("ff02::fb"), 5353, "[ff02::fb]:5353"},
+		{"ipv4-mapped ipv6", net.ParseIP("::ffff:192.0.2.1"), 80, "192.0.2.1:80"},
+		{"unspecified ipv6", net.ParseIP("::"), 0, "[::]:0"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, network := range []v2rayNet.Network{v2rayNet.Network_TCP, v2rayNet.Network_UDP} {
+				dest, err := endpointDestination(network, string(test.address), test.port)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !dest.Address.Family().IsIP() {
+					t.Fatalf("%s parsed as a domain", test.address)
+				}
+				if dest.Network != network {
+					t.Fatalf("network %s, want %s", dest.Network, network)
+				}
+				if dest.NetAddr() != test.netAddr {
+					t.Fatalf("address %s, want %s", dest.NetAddr(), test.netAddr)
+				}
+				if !dest.Address.IP().Equal(test.address) {
+					t.Fatalf("ip %s, want %s", dest.Address.IP(), test.address)
+				}
+			}
+		})
+	}
+}
+
+// TestEndpointDestinationScoped checks that a scoped address, which the
+// stack passes on without its zone, keeps the same destination as the
+// address without one instead of failing to parse.
+func TestEndpointDestinationScoped(t *testing.T) {
+	scoped, err := net.ResolveUDPAddr("udp6", "[fe80::1%1]:53")
+	if err != nil {
+		t.Skip(err)
+	}
+	dest, err := endpointDestination(v2rayNet.Network_UDP, string(scoped.IP.To16()), uint16(scoped.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest.NetAddr() != "[fe80::1]:53" {
+		t.Fatalf("address %s, want [fe80::1]:53", dest.NetAddr())
+	}
+}
+
+func TestEndpointDestinationInvalid(t *testing.T) {
+	for _, address := range []string{"", "\x01\x02\x03", string(make([]byte, 5)), string(make([]byte, 17))} {
+		if _, err := endpointDestination(v2rayNet.Network_TCP, address, 80); err == nil {
+			t.Fatalf("address of %d bytes accepted", len(address))
+		}
+	}
+}
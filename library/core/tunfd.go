@@ -0,0 +1,50 @@
+package libcore
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"sync/atomic"
+)
+
+var dupTunFd int32
+
+// SetDupTunFd sets whether NewTun2socks duplicates the TUN fd it is given.
+//
+// By default the tun wraps the fd itself and so takes ownership of it, the
+// Go runtime closes it once the tun is garbage collected, which may be
+// after the VpnService closed its ParcelFileDescriptor and the number got
+// reused. With dup enabled the tun reads and writes a duplicate it closes
+// in Close, while the fd passed in stays owned by the caller, which must
+// still close it. The interface stays up while the duplicate is open, so
+// closing the caller's fd alone neither brings it down nor stops the read
+// loop, only Tun2socks.Close does.
+func SetDupTunFd(dup bool) {
+	var value int32
+	if dup {
+		value = 1
+	}
+	atomic.StoreInt32(&dupTunFd, value)
+}
+
+// openTun wraps fd into a file, reporting whether the file is a duplicate
+// the tun has to close itself.
+func openTun(fd int32) (*os.File, bool, error) {
+	dup := atomic.LoadInt32(&dupTunFd) == 1
+	if dup {
+		newFd, err := unix.Dup(int(fd))
+		if err != nil {
+			return nil, false, err
+		}
+		unix.CloseOnExec(newFd)
+		fd = int32(newFd)
+	}
+	file := os.NewFile(uintptr(fd), "tun")
+	if file == nil {
+		if dup {
+			_ = unix.Close(int(fd))
+		}
+		return nil, false, errors.New("failed to open TUN file descriptor")
+	}
+	return file, dup, nil
+}
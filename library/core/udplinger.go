@@ -0,0 +1,81 @@
+package libcore
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SetUdpLinger keeps UDP sessions open across errors caused by ICMP
+// replies, such as a refused port on a direct socket, as long as they were
+// active within the last linger seconds, so bursty exchanges keep their
+// upstream conn and source mapping. Idle sessions are still closed after
+// their session timeout. Zero disables it.
+func (t *Tun2socks) SetUdpLinger(linger int32) {
+	atomic.StoreInt32(&t.udpLinger, linger)
+}
+
+func (t *Tun2socks) getUdpLinger() time.Duration {
+	return time.Duration(atomic.LoadInt32(&t.udpLinger)) * time.Second
+}
+
+// udpSetupWaitBuckets bound the time packets wait for another packet of
+// their flow to set up its session.
+var udpSetupWaitBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+const (
+	defaultDnsSessionTimeout = 10
+	defaultUdpSessionTimeout = 120
+)
+
+// SetDnsSessionTimeout closes UDP sessions carrying DNS after timeout
+// seconds without activity, 10 by default, zero keeps them open.
+func (t *Tun2socks) SetDnsSessionTimeout(timeout int32) {
+	atomic.StoreInt32(&t.dnsSessionTimeout, timeout)
+}
+
+// SetUdpSessionTimeout closes other UDP sessions after timeout seconds
+// without activity, 120 by default, zero keeps them open.
+func (t *Tun2socks) SetUdpSessionTimeout(timeout int32) {
+	atomic.StoreInt32(&t.udpSessionTimeout, timeout)
+}
+
+func (t *Tun2socks) getUdpSessionTimeout(isDns bool) time.Duration {
+	timeout := atomic.LoadInt32(&t.udpSessionTimeout)
+	if isDns {
+		timeout = atomic.LoadInt32(&t.dnsSessionTimeout)
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// evictIdleUdp closes the session of entry once it has been idle for
+// timeout, the same way CloseIdleConnections does. The returned function
+// stops watching it.
+func evictIdleUdp(entry *connEntry, timeout time.Duration) func() bool {
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		if idle := time.Since(entry.lastActiveAt()); idle < timeout {
+			timer.Reset(timeout - idle)
+			return
+		}
+		entry.closeIdle()
+	})
+	return timer.Stop
+}
+
+// transientUdpError reports whether err was caused by an ICMP error for an
+// earlier packet, after which the socket can still be read from.
+func transientUdpError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH)
+}
@@ -0,0 +1,163 @@
+package libcore
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type UDPSession struct {
+	Key         string `json:"key"`
+	Uid         int32  `json:"uid"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Uplink      int64  `json:"uplink"`
+	Downlink    int64  `json:"downlink"`
+	StartedAt   int64  `json:"startedAt"`
+
+	// Idle is the time in seconds since a packet last went through.
+	Idle int64 `json:"idle"`
+}
+
+// natSession is a UDP session stored in the nat table.
+type natSession struct {
+	net.PacketConn
+	entry *connEntry
+
+	// ctx and self are kept to check packets to other destinations than
+	// the one the session was set up for, verdicts caches the outcome.
+	ctx            context.Context
+	self           bool
+	verdictsAccess sync.Mutex
+	verdicts       map[string]int32
+}
+
+const (
+	udpVerdictSend = iota
+	udpVerdictDrop
+	udpVerdictSetup
+)
+
+const udpVerdictCacheSize = 256
+
+// udpVerdict decides what happens to a packet to dest from the source of
+// session. Sessions of proxied flows are keyed by source only, so a packet
+// to another destination goes through the checks a new session would once
+// per destination. A blocked one is dropped, a direct one is set up as a
+// session of its own, keyed by destination as well.
+func (t *Tun2socks) udpVerdict(session *natSession, dest v2rayNet.Destination) int32 {
+	address := dest.NetAddr()
+	if address == session.entry.destination {
+		return udpVerdictSend
+	}
+
+	session.verdictsAccess.Lock()
+	verdict, ok := session.verdicts[address]
+	session.verdictsAccess.Unlock()
+	if ok {
+		return verdict
+	}
+
+	verdict = t.checkUdpDestination(session, dest)
+	if verdict == udpVerdictDrop && t.debug {
+		log.Infof("[UDP] %s ==> %s blocked for session to %s", session.entry.source, address, session.entry.destination)
+	}
+
+	session.verdictsAccess.Lock()
+	if session.verdicts == nil {
+		session.verdicts = map[string]int32{}
+	}
+	if len(session.verdicts) < udpVerdictCacheSize {
+		session.verdicts[address] = verdict
+	}
+	session.verdictsAccess.Unlock()
+	return verdict
+}
+
+func (t *Tun2socks) checkUdpDestination(session *natSession, dest v2rayNet.Destination) int32 {
+	if t.ipv6Blocked(dest) {
+		return udpVerdictDrop
+	}
+	switch t.destinationPolicy(dest) {
+	case LanPolicyBlock:
+		return udpVerdictDrop
+	case LanPolicyDirect:
+		return udpVerdictSetup
+	}
+	entry := session.entry
+	if !session.self && !t.allowConn(&connEntry{
+		id:          entry.id,
+		uid:         entry.uid,
+		network:     entry.network,
+		source:      entry.source,
+		destination: dest.NetAddr(),
+		startedAt:   entry.startedAt,
+	}) {
+		return udpVerdictDrop
+	}
+	if _, blocked := t.blockedOutbound(session.ctx, dest); blocked {
+		return udpVerdictDrop
+	}
+	return udpVerdictSend
+}
+
+// DumpUDPSessions lists the UDP sessions in the nat table as a JSON array,
+// oldest first. The table is walked without locking it, each entry is read
+// consistently but sessions set up or closed during the walk may or may
+// not be included. Queries answered by the DNS workers have no session.
+func (t *Tun2socks) DumpUDPSessions() []byte {
+	now := time.Now()
+	sessions := []UDPSession{}
+	t.udpTable.mapping.Range(func(key, value interface{}) bool {
+		session, ok := value.(*natSession)
+		if !ok {
+			return true
+		}
+		entry := session.entry
+		sessions = append(sessions, UDPSession{
+			Key:         key.(string),
+			Uid:         int32(entry.uid),
+			Source:      entry.source,
+			Destination: entry.destination,
+			Uplink:      atomic.LoadInt64(&entry.uplink),
+			Downlink:    atomic.LoadInt64(&entry.downlink),
+			StartedAt:   entry.startedAt.Unix(),
+			Idle:        int64(now.Sub(entry.lastActiveAt()).Seconds()),
+		})
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt < sessions[j].StartedAt
+	})
+
+	content, _ := json.Marshal(sessions)
+	return content
+}
+
+// countingPacketConn counts the bytes of a UDP session on its entry.
+type countingPacketConn struct {
+	net.PacketConn
+	entry *connEntry
+}
+
+func (c *countingPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if n > 0 {
+		atomic.AddInt64(&c.entry.downlink, int64(n))
+	}
+	return
+}
+
+func (c *countingPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	if n > 0 {
+		atomic.AddInt64(&c.entry.uplink, int64(n))
+	}
+	return
+}
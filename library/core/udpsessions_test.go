@@ -0,0 +1,78 @@
+package libcore
+
+import (
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"testing"
+)
+
+type destinationFilter string
+
+func (f destinationFilter) Allow(c *Connection) bool {
+	return c.Destination != string(f)
+}
+
+func udpDestination(address string, port uint16) v2rayNet.Destination {
+	return v2rayNet.UDPDestination(v2rayNet.ParseAddress(address), v2rayNet.Port(port))
+}
+
+func TestUdpVerdict(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		setup   func(tun *Tun2socks)
+		dest    v2rayNet.Destination
+		verdict int32
+	}{
+		{"same destination", func(tun *Tun2socks) {
+			tun.SetLanPolicy(LanPolicyBlock)
+		}, udpDestination("203.0.113.1", 443), udpVerdictSend},
+		{"other proxied destination", nil, udpDestination("203.0.113.2", 443), udpVerdictSend},
+		{"lan blocked", func(tun *Tun2socks) {
+			tun.SetLanPolicy(LanPolicyBlock)
+		}, udpDestination("192.168.1.1", 53), udpVerdictDrop},
+		{"lan direct", func(tun *Tun2socks) {
+			tun.SetLanPolicy(LanPolicyDirect)
+		}, udpDestination("192.168.1.1", 53), udpVerdictSetup},
+		{"bypass blocked", func(tun *Tun2socks) {
+			_ = tun.SetBypassDestinations("198.51.100.0/24", LanPolicyBlock)
+		}, udpDestination("198.51.100.7", 443), udpVerdictDrop},
+		{"ipv6 disabled", func(tun *Tun2socks) {
+			tun.SetDisableIPv6(true, BlockActionDrop)
+		}, udpDestination("2001:db8::1", 443), udpVerdictDrop},
+		{"filtered", func(tun *Tun2socks) {
+			tun.SetConnectionFilter(destinationFilter("203.0.113.9:443"))
+		}, udpDestination("203.0.113.9", 443), udpVerdictDrop},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tun := &Tun2socks{}
+			if test.setup != nil {
+				test.setup(tun)
+			}
+			session := &natSession{entry: &connEntry{
+				uid:         10001,
+				network:     "udp",
+				source:      "172.19.0.1:40000",
+				destination: "203.0.113.1:443",
+			}}
+			if verdict := tun.udpVerdict(session, test.dest); verdict != test.verdict {
+				t.Fatalf("verdict %d, want %d", verdict, test.verdict)
+			}
+			// the cached verdict must agree with the first one
+			if verdict := tun.udpVerdict(session, test.dest); verdict != test.verdict {
+				t.Fatalf("cached verdict %d, want %d", verdict, test.verdict)
+			}
+		})
+	}
+}
+
+func TestUdpVerdictSelfSkipsFilter(t *testing.T) {
+	tun := &Tun2socks{}
+	tun.SetConnectionFilter(destinationFilter("203.0.113.9:443"))
+	session := &natSession{self: true, entry: &connEntry{
+		network:     "udp",
+		source:      "172.19.0.1:40000",
+		destination: "203.0.113.1:443",
+	}}
+	if verdict := tun.udpVerdict(session, udpDestination("203.0.113.9", 443)); verdict != udpVerdictSend {
+		t.Fatalf("verdict %d for own traffic, want send", verdict)
+	}
+}
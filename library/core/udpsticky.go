@@ -0,0 +1,196 @@
+package libcore
+
+import (
+	"github.com/Dreamacro/clash/common/pool"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stickyQueueSize is how many packets an upstream conn buffers for the
+// session reading it, including while it is parked.
+const stickyQueueSize = 16
+
+// SetUdpStickiness keeps the upstream conn of a closed UDP session for
+// window seconds, a new session from the same local address within the
+// window reuses it instead of dialing, and so keeps the outbound source
+// port for apps relying on a stable NAT mapping. The reused conn keeps the
+// routing of the session that dialed it. Only sessions through the core
+// are kept, DNS and direct ones are not. Zero disables it.
+func (t *Tun2socks) SetUdpStickiness(window int32) {
+	atomic.StoreInt32(&t.stickyWindow, window)
+}
+
+// stickyTable holds the upstream conns parked after their session closed.
+type stickyTable struct {
+	access    sync.Mutex
+	upstreams map[string]*stickyUpstream
+}
+
+// stickyUpstream reads an upstream conn on its own goroutine, so sessions
+// can stop reading it without closing it.
+type stickyUpstream struct {
+	conn    net.PacketConn
+	packets chan stickyPacket
+	done    chan struct{}
+	err     error
+	expire  *time.Timer
+}
+
+type stickyPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func newStickyUpstream(conn net.PacketConn) *stickyUpstream {
+	u := &stickyUpstream{
+		conn:    conn,
+		packets: make(chan stickyPacket, stickyQueueSize),
+		done:    make(chan struct{}),
+	}
+	go u.pump()
+	return u
+}
+
+func (u *stickyUpstream) pump() {
+	buf := pool.Get(pool.RelayBufferSize)
+	defer pool.Put(buf)
+
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			u.err = err
+			close(u.done)
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case u.packets <- stickyPacket{data, addr}:
+		default:
+		}
+	}
+}
+
+func (u *stickyUpstream) failed() bool {
+	select {
+	case <-u.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stickySession is the view of a session on an upstream conn, closing it
+// parks the conn instead.
+type stickySession struct {
+	net.PacketConn
+	upstream *stickyUpstream
+	closed   chan struct{}
+	once     sync.Once
+	park     func(u *stickyUpstream)
+}
+
+func (s *stickySession) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-s.upstream.packets:
+		return copy(p, packet.data), packet.addr, nil
+	case <-s.upstream.done:
+		return 0, nil, s.upstream.err
+	case <-s.closed:
+		return 0, nil, io.EOF
+	}
+}
+
+func (s *stickySession) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.park(s.upstream)
+	})
+	return nil
+}
+
+// stickyConn wraps a conn just dialed for the session of key so it is
+// parked when the session closes, conn is returned as is if stickiness is
+// disabled.
+func (t *Tun2socks) stickyConn(key string, conn net.PacketConn) net.PacketConn {
+	if atomic.LoadInt32(&t.stickyWindow) <= 0 {
+		return conn
+	}
+	return t.stickySession(key, newStickyUpstream(conn))
+}
+
+// takeSticky returns a session on the conn parked for key, or nil if there
+// is none.
+func (t *Tun2socks) takeSticky(key string) net.PacketConn {
+	t.sticky.access.Lock()
+	u := t.sticky.upstreams[key]
+	delete(t.sticky.upstreams, key)
+	t.sticky.access.Unlock()
+
+	if u == nil {
+		return nil
+	}
+	u.expire.Stop()
+	if u.failed() {
+		_ = u.conn.Close()
+		return nil
+	}
+	return t.stickySession(key, u)
+}
+
+func (t *Tun2socks) stickySession(key string, u *stickyUpstream) net.PacketConn {
+	return &stickySession{
+		PacketConn: u.conn,
+		upstream:   u,
+		closed:     make(chan struct{}),
+		park: func(u *stickyUpstream) {
+			t.parkSticky(key, u)
+		},
+	}
+}
+
+func (t *Tun2socks) parkSticky(key string, u *stickyUpstream) {
+	window := time.Duration(atomic.LoadInt32(&t.stickyWindow)) * time.Second
+	if window <= 0 || u.failed() {
+		_ = u.conn.Close()
+		return
+	}
+
+	t.sticky.access.Lock()
+	defer t.sticky.access.Unlock()
+
+	if t.sticky.upstreams == nil {
+		t.sticky.upstreams = map[string]*stickyUpstream{}
+	}
+	if old := t.sticky.upstreams[key]; old != nil {
+		old.expire.Stop()
+		_ = old.conn.Close()
+	}
+	t.sticky.upstreams[key] = u
+	u.expire = time.AfterFunc(window, func() {
+		t.sticky.access.Lock()
+		parked := t.sticky.upstreams[key] == u
+		if parked {
+			delete(t.sticky.upstreams, key)
+		}
+		t.sticky.access.Unlock()
+		if parked {
+			_ = u.conn.Close()
+		}
+	})
+}
+
+// closeSticky closes every parked conn.
+func (t *Tun2socks) closeSticky() {
+	t.sticky.access.Lock()
+	defer t.sticky.access.Unlock()
+
+	for key, u := range t.sticky.upstreams {
+		u.expire.Stop()
+		_ = u.conn.Close()
+		delete(t.sticky.upstreams, key)
+	}
+}
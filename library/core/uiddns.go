@@ -0,0 +1,66 @@
+package libcore
+
+import (
+	"github.com/xjasonlyu/tun2socks/core"
+)
+
+// uidDnsServer is the upstream of the queries of one app, the system
+// resolvers if resolver is nil.
+type uidDnsServer struct {
+	resolver *dnsTlsResolver
+}
+
+// SetUidDnsServer sends the hijacked queries of uid to server, such as a
+// filtering resolver for a kids app, ahead of the DNS routes and the
+// default upstream. server is in the upstream format of SetDnsRoutes, an
+// empty one goes back to the default. The answers bypass the DNS cache in
+// both directions, so the app never gets those of another upstream nor
+// the other way around. Uids below 10000 are all treated as 1000. This
+// requires uid lookups, enabled by dumpUid or trafficStats, queries whose
+// uid is unknown use the default.
+func (t *Tun2socks) SetUidDnsServer(uid int32, server string) error {
+	if uid < 10000 {
+		uid = 1000
+	}
+	var entry *uidDnsServer
+	if server != "" {
+		resolver, err := t.parseDnsUpstream(server)
+		if err != nil {
+			return err
+		}
+		entry = &uidDnsServer{resolver}
+	}
+
+	t.access.Lock()
+	old, _ := t.uidDns.Load(uint16(uid))
+	if entry != nil {
+		t.uidDns.Store(uint16(uid), entry)
+	} else {
+		t.uidDns.Delete(uint16(uid))
+	}
+	t.access.Unlock()
+
+	if old, ok := old.(*uidDnsServer); ok && old.resolver != nil {
+		old.resolver.close()
+	}
+	return nil
+}
+
+func (t *Tun2socks) uidDnsServer(uid uint16) *uidDnsServer {
+	if uid == 0 {
+		return nil
+	}
+	server, _ := t.uidDns.Load(uid)
+	entry, _ := server.(*uidDnsServer)
+	return entry
+}
+
+// resolveUidDns answers packet through server, returns false if server is
+// the system resolvers and none are set.
+func (t *Tun2socks) resolveUidDns(server *uidDnsServer, packet core.UDPPacket) bool {
+	if server.resolver == nil {
+		return t.resolveSystemDns(packet, DnsUpstreamUid)
+	}
+	go t.resolveWith(server.resolver, packet, DnsUpstreamUid)
+	return true
+}
@@ -0,0 +1,81 @@
+package libcore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	uidDumperAccess sync.Mutex
+	// uidDumper holds the uidDumperChain in use. A chain is never modified
+	// once stored, so lookups load it without a lock.
+	uidDumper atomic.Value
+)
+
+// loadUidDumper returns the dumpers in use, an empty chain fails every
+// lookup.
+func loadUidDumper() uidDumperChain {
+	chain, _ := uidDumper.Load().(uidDumperChain)
+	return chain
+}
+
+type uidDumperEntry struct {
+	dumper   UidDumper
+	priority int32
+}
+
+// uidDumperChain asks its dumpers in turn until one knows the answer.
+type uidDumperChain []uidDumperEntry
+
+// AddUidDumper adds dumper to the ones asked in turn for the uid of a
+// connection, such as an in-process cache before /proc and netlink. Lower
+// priorities are asked first, equal ones in the order they were added. A
+// dumper returning an error or a negative uid passes on to the next, the
+// error of the last one is reported if all fail. GetUidInfo is asked the
+// same way. SetUidDumper replaces all of them.
+func AddUidDumper(dumper UidDumper, priority int32) {
+	if dumper == nil {
+		return
+	}
+
+	uidDumperAccess.Lock()
+	defer uidDumperAccess.Unlock()
+
+	previous := loadUidDumper()
+	chain := make(uidDumperChain, len(previous), len(previous)+1)
+	copy(chain, previous)
+	chain = append(chain, uidDumperEntry{dumper, priority})
+	sort.SliceStable(chain, func(i, j int) bool {
+		return chain[i].priority < chain[j].priority
+	})
+	uidDumper.Store(chain)
+}
+
+func (c uidDumperChain) DumpUid(ipv6 bool, udp bool, srcIp string, srcPort int32, destIp string, destPort int32) (int32, error) {
+	err := errors.New("no uid dumper")
+	for _, entry := range c {
+		var uid int32
+		uid, err = entry.dumper.DumpUid(ipv6, udp, srcIp, srcPort, destIp, destPort)
+		if err == nil && uid >= 0 {
+			return uid, nil
+		}
+		if err == nil {
+			err = errors.New("uid not found")
+		}
+	}
+	return 0, err
+}
+
+func (c uidDumperChain) GetUidInfo(uid int32) (*UidInfo, error) {
+	err := errors.New("no uid dumper")
+	for _, entry := range c {
+		var info *UidInfo
+		info, err = entry.dumper.GetUidInfo(uid)
+		if err == nil && info != nil {
+			return info, nil
+		}
+	}
+	return nil, err
+}
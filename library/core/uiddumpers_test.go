@@ -0,0 +1,66 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Without a uid dumper the lookups fail, connections are relayed all the
+// same and attributed to no app.
+func TestRelayWithoutUidDumper(t *testing.T) {
+	echo := startUdpEcho(t)
+	tun, _, closed := startRelayTest(t)
+	if err := tun.SetBypassDestinations("127.0.0.1/32", LanPolicyDirect); err != nil {
+		t.Fatal(err)
+	}
+	SetUidDumper(nil)
+
+	app, peer := net.Pipe()
+	_ = peer.Close()
+	relay(t, tun, app)
+	if conn := closed.only(t); conn.Uid != 0 {
+		t.Errorf("uid = %d, want 0", conn.Uid)
+	}
+
+	packet := newTestUDPPacket([]byte("hello"), "10.0.0.2:40000", echo.LocalAddr().String())
+	tun.AddPacket(packet)
+	select {
+	case reply := <-packet.written:
+		if string(reply) != "hello" {
+			t.Errorf("reply %q, want %q", reply, "hello")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("no reply")
+	}
+}
+
+// The dumpers may be replaced while connections look up their uid.
+func TestUidDumperReplacedDuringRelays(t *testing.T) {
+	tun, _, _ := startRelayTest(t)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			SetUidDumper(nil)
+			AddUidDumper(testUidDumper{}, 1)
+			SetUidDumper(testUidDumper{})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		app, peer := net.Pipe()
+		_ = peer.Close()
+		relay(t, tun, app)
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,30 @@
+package libcore
+
+import "sync/atomic"
+
+// UidResolveListener is told about every connection whose uid could not be
+// resolved, which is then relayed without per-app attribution.
+type UidResolveListener interface {
+	OnUidResolveFailed(network string, source string, destination string, message string)
+}
+
+// SetUidResolveListener sets the listener for failed uid lookups, nil
+// disables it. The failures are counted in the metrics either way.
+func (t *Tun2socks) SetUidResolveListener(listener UidResolveListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.uidListener = listener
+}
+
+func (t *Tun2socks) uidResolveFailed(network string, source string, destination string, err error) {
+	atomic.AddUint32(&t.uidFailures, 1)
+
+	t.access.Lock()
+	listener := t.uidListener
+	t.access.Unlock()
+
+	if listener != nil {
+		listener.OnUidResolveFailed(network, source, destination, err.Error())
+	}
+}
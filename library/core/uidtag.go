@@ -0,0 +1,31 @@
+package libcore
+
+// SetUidTag routes the connections of uid through the given inbound tag in
+// place of "socks", so routing rules on inboundTag can pin an app to an
+// outbound. An empty tag removes it. DNS queries keep the "dns-in" tag, and
+// a dial that fails is still retried with the fallback tag. Uids are only
+// known when dumpUid or trafficStats is enabled.
+func (t *Tun2socks) SetUidTag(uid int32, tag string) {
+	if uid < 10000 {
+		uid = 1000
+	}
+
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if tag == "" {
+		delete(t.uidTags, uint16(uid))
+		return
+	}
+	if t.uidTags == nil {
+		t.uidTags = map[uint16]string{}
+	}
+	t.uidTags[uint16(uid)] = tag
+}
+
+func (t *Tun2socks) uidTag(uid uint16) string {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	return t.uidTags[uid]
+}
@@ -7,6 +7,7 @@ import (
 	v2rayNet "github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/common/session"
 	"github.com/xtls/xray-core/core"
+	"io"
 	"net"
 	"net/http"
 	"time"
@@ -60,3 +61,53 @@ func UrlTestClashBased(instance *ClashBasedInstance, link string, timeout int32)
 		return instance.out.DialContext(ctx, dest)
 	}, link, timeout)
 }
+
+// CheckReachable dials addr through the core the same way relayed app
+// connections are and returns the time until the destination answered. The
+// core connects lazily and many servers wait for the client, so a HEAD
+// request is written as probe; any reply, or the destination closing the
+// connection, counts as reachable within timeout milliseconds.
+func (t *Tun2socks) CheckReachable(network string, addr string, timeout int32) (int32, error) {
+	if network != "tcp" {
+		return 0, errors.New("unsupported network: " + network)
+	}
+	if timeout <= 0 {
+		return 0, errors.Errorf("invalid timeout: %dms", timeout)
+	}
+	dest, err := v2rayNet.ParseDestination(fmt.Sprintf("%s:%s", network, addr))
+	if err != nil {
+		return 0, err
+	}
+	instance, err := t.runningCore()
+	if err != nil {
+		return 0, err
+	}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:       "socks",
+		User:      t.getInboundUser(),
+		AppStatus: []string{networkStatus()},
+	})
+	start := time.Now()
+	conn, err := core.Dial(ctx, instance, dest)
+	if err != nil {
+		return 0, err
+	}
+	timer := time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+		_ = conn.Close()
+	})
+	defer timer.Stop()
+	defer conn.Close()
+
+	probe := "HEAD / HTTP/1.1\r\nHost: " + addr + "\r\nConnection: close\r\n\r\n"
+	// the write fails too once the destination closed the connection, the
+	// read tells that apart from a failed dial.
+	_, _ = conn.Write([]byte(probe))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || err == io.EOF {
+		return int32(time.Since(start).Milliseconds()), nil
+	}
+	if !timer.Stop() {
+		return 0, errors.Errorf("no reply within %dms", timeout)
+	}
+	return 0, errors.WithMessage(err, "unreachable")
+}
@@ -0,0 +1,65 @@
+package libcore
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckReachable(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		addr      string
+		serve     func(conn net.Conn)
+		reachable bool
+	}{
+		{"waits for the client", "198.51.100.1:443", func(conn net.Conn) {
+			if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+				_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+			}
+		}, true},
+		{"speaks first", "198.51.100.1:22", func(conn net.Conn) {
+			_, _ = conn.Write([]byte("SSH-2.0-test\r\n"))
+			time.Sleep(time.Second)
+		}, true},
+		{"silent", "198.51.100.1:25", func(net.Conn) {
+			time.Sleep(time.Second)
+		}, false},
+		{"blocked", "blocked:80", nil, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			origin, accepted := startTestOrigin(t)
+			tun := startTestTun(t, startTestCore(t, domainRoutingConfig(origin.Addr(), "blocked")))
+			if test.serve != nil {
+				go func(serve func(net.Conn)) {
+					select {
+					case conn := <-accepted:
+						serve(conn)
+						_ = conn.Close()
+					case <-time.After(5 * time.Second):
+					}
+				}(test.serve)
+			}
+
+			_, err := tun.CheckReachable("tcp", test.addr, 500)
+			if test.reachable && err != nil {
+				t.Errorf("unreachable: %v", err)
+			} else if !test.reachable && err == nil {
+				t.Error("reported reachable")
+			}
+		})
+	}
+}
+
+func TestCheckReachableRejectsTimeout(t *testing.T) {
+	origin, _ := startTestOrigin(t)
+	tun := startTestTun(t, startTestCore(t, domainRoutingConfig(origin.Addr(), "blocked")))
+	for _, timeout := range []int32{0, -1} {
+		if _, err := tun.CheckReachable("tcp", "198.51.100.1:80", timeout); err == nil || !strings.Contains(err.Error(), "invalid timeout") {
+			t.Errorf("timeout %d: error %v, want invalid timeout", timeout, err)
+		}
+	}
+}
@@ -94,6 +94,7 @@ func (instance *V2RayInstance) Close() error {
 	instance.access.Lock()
 	defer instance.access.Unlock()
 	if instance.started {
+		instance.started = false
 		return instance.core.Close()
 	}
 	return nil
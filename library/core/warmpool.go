@@ -0,0 +1,149 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	v2rayLog "github.com/xtls/xray-core/common/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	v2rayCore "github.com/xtls/xray-core/core"
+	"net"
+	"sync"
+	"time"
+)
+
+// warmSeenLimit bounds the destinations remembered for the warm pool.
+const warmSeenLimit = 1024
+
+// warmPool keeps connections dialed ahead through the core for the
+// destinations apps connect to repeatedly.
+type warmPool struct {
+	access sync.Mutex
+	size   int
+	ttl    time.Duration
+	seen   map[string]time.Time
+	conns  map[string]*warmConn
+}
+
+type warmConn struct {
+	conn     net.Conn
+	access   *v2rayLog.AccessMessage
+	instance *V2RayInstance
+	expire   *time.Timer
+}
+
+// SetWarmPool keeps up to size connections dialed ahead through the core,
+// one for each destination an app connected to twice within ttl seconds,
+// so its next connection skips the outbound handshake. A connection not
+// used within ttl is closed. The core only routes a connection before its
+// first payload when sniffing is off, so the pool is not used with
+// sniffing enabled. Pooled connections are not marked with the TOS or TTL
+// of the flow that ends up using them. Zero size disables it.
+func (t *Tun2socks) SetWarmPool(size int32, ttl int32) {
+	t.warm.access.Lock()
+	defer t.warm.access.Unlock()
+
+	t.warm.size = int(size)
+	t.warm.ttl = time.Duration(ttl) * time.Second
+	if size <= 0 || ttl <= 0 {
+		t.warm.size = 0
+		t.warm.seen = nil
+		for key, warm := range t.warm.conns {
+			warm.expire.Stop()
+			_ = warm.conn.Close()
+			delete(t.warm.conns, key)
+		}
+	}
+}
+
+func warmKey(uid uint16, inbound *session.Inbound, dest v2rayNet.Destination) string {
+	return fmt.Sprintf("%d/%s/%s", uid, inbound.Tag, dest.NetAddr())
+}
+
+// takeWarm returns the connection pooled for key, or nil if there is none.
+func (t *Tun2socks) takeWarm(key string) *warmConn {
+	if t.sniffing {
+		return nil
+	}
+
+	t.warm.access.Lock()
+	warm := t.warm.conns[key]
+	delete(t.warm.conns, key)
+	t.warm.access.Unlock()
+
+	if warm == nil {
+		return nil
+	}
+	warm.expire.Stop()
+	if warm.instance != t.getV2Ray() {
+		_ = warm.conn.Close()
+		return nil
+	}
+	return warm
+}
+
+// refillWarm dials a connection ahead for key if its destination was seen
+// within the pool ttl and there is room for it.
+func (t *Tun2socks) refillWarm(key string, inbound *session.Inbound, src v2rayNet.Destination, dest v2rayNet.Destination) {
+	if t.sniffing {
+		return
+	}
+	instance := t.getV2Ray()
+	if instance == nil {
+		return
+	}
+	running := instance.runningCore()
+	if running == nil {
+		return
+	}
+
+	t.warm.access.Lock()
+	defer t.warm.access.Unlock()
+
+	if t.warm.size <= 0 {
+		return
+	}
+	now := time.Now()
+	if t.warm.seen == nil || len(t.warm.seen) >= warmSeenLimit {
+		for seenKey, at := range t.warm.seen {
+			if now.Sub(at) >= t.warm.ttl {
+				delete(t.warm.seen, seenKey)
+			}
+		}
+		if t.warm.seen == nil || len(t.warm.seen) >= warmSeenLimit {
+			t.warm.seen = map[string]time.Time{}
+		}
+	}
+	last, seen := t.warm.seen[key]
+	t.warm.seen[key] = now
+	if !seen || now.Sub(last) >= t.warm.ttl || t.warm.conns[key] != nil || len(t.warm.conns) >= t.warm.size {
+		return
+	}
+
+	var email string
+	if inbound.User != nil {
+		email = inbound.User.Email
+	}
+	ctx, access := withAccessMessage(session.ContextWithInbound(context.Background(), inbound), src, dest, email)
+	conn, err := v2rayCore.Dial(ctx, running, dest)
+	if err != nil {
+		return
+	}
+
+	warm := &warmConn{conn: conn, access: access, instance: instance}
+	if t.warm.conns == nil {
+		t.warm.conns = map[string]*warmConn{}
+	}
+	t.warm.conns[key] = warm
+	warm.expire = time.AfterFunc(t.warm.ttl, func() {
+		t.warm.access.Lock()
+		pooled := t.warm.conns[key] == warm
+		if pooled {
+			delete(t.warm.conns, key)
+		}
+		t.warm.access.Unlock()
+		if pooled {
+			_ = warm.conn.Close()
+		}
+	})
+}
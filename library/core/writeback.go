@@ -0,0 +1,72 @@
+package libcore
+
+import (
+	"github.com/xjasonlyu/tun2socks/core"
+	"net"
+	"sync/atomic"
+)
+
+// SetUdpWritebackBuffer queues up to size packets per UDP session between
+// the core and the tun, dropping the oldest ones when the app falls behind
+// instead of stalling the session. Zero writes back synchronously.
+func (t *Tun2socks) SetUdpWritebackBuffer(size int32) {
+	atomic.StoreInt32(&t.writebackSize, size)
+}
+
+type writebackPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+type writebackQueue struct {
+	packets chan writebackPacket
+	done    chan struct{}
+	dropped *uint32
+}
+
+func newWritebackQueue(size int32, dropped *uint32) *writebackQueue {
+	return &writebackQueue{
+		packets: make(chan writebackPacket, size),
+		done:    make(chan struct{}),
+		dropped: dropped,
+	}
+}
+
+// push copies data into the queue, evicting the oldest packet if it is full.
+func (q *writebackQueue) push(data []byte, addr net.Addr) {
+	p := writebackPacket{append([]byte(nil), data...), addr}
+	for {
+		select {
+		case q.packets <- p:
+			return
+		default:
+		}
+		select {
+		case <-q.packets:
+			atomic.AddUint32(q.dropped, 1)
+		default:
+		}
+	}
+}
+
+// run writes the queued packets back to the app until the queue is closed,
+// onError is called once if a write fails and the rest is discarded.
+func (q *writebackQueue) run(packet core.UDPPacket, onError func(err error)) {
+	defer close(q.done)
+
+	var failed bool
+	for p := range q.packets {
+		if failed {
+			continue
+		}
+		if _, err := packet.WriteBack(p.data, p.addr); err != nil {
+			failed = true
+			onError(err)
+		}
+	}
+}
+
+func (q *writebackQueue) close() {
+	close(q.packets)
+	<-q.done
+}